@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// banner bans client IPs failing the shadowsocks handshake (wrong key, replayed salt,
+// garbage) too often, shutting out active probers in the way fail2ban does.
+type banner struct {
+	sync.Mutex
+	threshold int           // failures within window that trigger a ban
+	window    time.Duration // period failures are counted in
+	duration  time.Duration // how long a ban lasts
+	allow     []*net.IPNet  // never banned
+	failures  map[string][]time.Time
+	banned    map[string]time.Time // IP -> end of ban
+	replays   int                  // total replayed salts seen
+	fails     int                  // total handshake failures seen
+}
+
+// bans is nil unless banning is enabled with -ban-threshold.
+var bans *banner
+
+func newBanner(threshold int, window, duration time.Duration, allow string) (*banner, error) {
+	b := &banner{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		failures:  make(map[string][]time.Time),
+		banned:    make(map[string]time.Time),
+	}
+	if allow != "" {
+		for _, s := range strings.Split(allow, ",") {
+			if !strings.Contains(s, "/") {
+				if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+					s += "/32"
+				} else {
+					s += "/128"
+				}
+			}
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			b.allow = append(b.allow, n)
+		}
+	}
+	go b.expire()
+	return b, nil
+}
+
+// Banned reports whether ip is currently banned.
+func (b *banner) Banned(ip net.IP) bool {
+	b.Lock()
+	defer b.Unlock()
+	until, ok := b.banned[ip.String()]
+	return ok && time.Now().Before(until)
+}
+
+// Fail records a failed handshake from ip, replayed or not, and bans ip once it reaches the threshold.
+func (b *banner) Fail(ip net.IP, replay bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.fails++
+	if replay {
+		b.replays++
+	}
+	for _, n := range b.allow {
+		if n.Contains(ip) {
+			return
+		}
+	}
+
+	key := ip.String()
+	now := time.Now()
+	recent := b.failures[key][:0]
+	for _, t := range b.failures[key] {
+		if now.Sub(t) < b.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < b.threshold {
+		b.failures[key] = recent
+		return
+	}
+	delete(b.failures, key)
+	b.banned[key] = now.Add(b.duration)
+	logf("banned %s for %v after %d failed handshakes within %v (total failures: %d, replays: %d)",
+		key, b.duration, len(recent), b.window, b.fails, b.replays)
+}
+
+// expire periodically forgets ended bans and stale failures.
+func (b *banner) expire() {
+	for range time.Tick(b.window) {
+		b.Lock()
+		now := time.Now()
+		for k, until := range b.banned {
+			if now.After(until) {
+				delete(b.banned, k)
+			}
+		}
+		for k, ts := range b.failures {
+			if now.Sub(ts[len(ts)-1]) >= b.window {
+				delete(b.failures, k)
+			}
+		}
+		b.Unlock()
+	}
+}
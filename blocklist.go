@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/blocklist"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// blocks is the compiled list of -blocklist, if any.
+var blocks *blocklist.List
+
+// blocked reports whether the host of tgt is in blocks. Domain names are checked as they
+// are, not the IPs they resolve to.
+func blocked(tgt socks.Addr) bool {
+	if blocks == nil || tgt == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(tgt.String())
+	if err != nil {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return blocks.BlocksIP(ip)
+	}
+	return blocks.BlocksHost(host)
+}
+
+// compileBlocklist implements the compile-blocklist subcommand which compiles a text list of
+// domains, IPs and CIDRs into the binary form -blocklist memory-maps.
+func compileBlocklist(args []string) error {
+	fs := flag.NewFlagSet("compile-blocklist", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s compile-blocklist [list.txt] [list.bin]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	in, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	domains, ranges, err := blocklist.Compile(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "compiled %d domains and %d IP ranges into %s\n", domains, ranges, fs.Arg(1))
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// chainDialer connects to targets through a chain of shadowsocks servers: the connection
+// to the first server carries one to the second server, encrypted with its own cipher, and
+// so on, so that no server sees both the client and the target.
+type chainDialer struct {
+	hops []chainHop
+}
+
+type chainHop struct {
+	addr   string
+	shadow func(net.Conn) net.Conn
+}
+
+// parseChain returns the dialer of the chain starting at server, reached with shadow,
+// followed by the servers of the comma-separated ss:// URLs of s in order.
+func parseChain(server string, shadow func(net.Conn) net.Conn, s string) (*chainDialer, error) {
+	d := &chainDialer{hops: []chainHop{{server, shadow}}}
+	for _, u := range strings.Split(s, ",") {
+		addr, cipher, password, err := parseURL(u)
+		if err != nil {
+			return nil, err
+		}
+		if addr == "" || cipher == "" {
+			return nil, fmt.Errorf("chain server %q lacks an address or cipher", u)
+		}
+		addSecret(password)
+		ciph, err := core.PickCipher(cipher, nil, password)
+		if err != nil {
+			return nil, err
+		}
+		d.hops = append(d.hops, chainHop{addr, ciph.StreamConn})
+	}
+	return d, nil
+}
+
+func (d *chainDialer) Dial(tgt socks.Addr) (net.Conn, error) {
+	first := d.hops[0]
+	c, err := link.Dial(first.addr)
+	if err != nil {
+		return nil, err
+	}
+	setLinkKeepAlive(c)
+	rc := first.shadow(c)
+	for _, h := range d.hops[1:] {
+		if _, err := rc.Write(socks.ParseAddr(h.addr)); err != nil {
+			c.Close()
+			return nil, err
+		}
+		rc = h.shadow(rc)
+	}
+	if _, err := rc.Write(tgt); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return rc, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// chaosConfig injects faults into the connections between client and server to test how
+// retries and failover cope with them. Rates are probabilities between 0 and 1.
+type chaosConfig struct {
+	DialFail  float64       // rate of dials to fail
+	Delay     time.Duration // delay of the first write of a connection
+	DelayRate float64       // rate of connections whose first write is delayed
+	Reset     float64       // rate of connections to reset after a random amount of traffic
+}
+
+var errChaosDial = errors.New("chaos: injected dial failure")
+
+// chaosResetMax bounds the traffic a connection carries before an injected reset.
+const chaosResetMax = 64 << 10
+
+var chaosRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// chance returns true with probability p.
+func chance(p float64) bool {
+	chaosRand.Lock()
+	defer chaosRand.Unlock()
+	return chaosRand.Float64() < p
+}
+
+// enabled reports whether any fault is injected.
+func (c *chaosConfig) enabled() bool {
+	return c.DialFail > 0 || (c.Delay > 0 && c.DelayRate > 0) || c.Reset > 0
+}
+
+func (c *chaosConfig) validate() error {
+	for _, r := range []float64{c.DialFail, c.DelayRate, c.Reset} {
+		if r < 0 || r > 1 {
+			return fmt.Errorf("chaos rates must be between 0 and 1, got %v", r)
+		}
+	}
+	return nil
+}
+
+// wrap returns c with faults injected, or c if it is spared.
+func (c *chaosConfig) wrap(conn net.Conn) net.Conn {
+	cc := &chaosConn{Conn: conn}
+	if c.Delay > 0 && chance(c.DelayRate) {
+		cc.delay = c.Delay
+	}
+	if chance(c.Reset) {
+		chaosRand.Lock()
+		cc.resetAfter = 1 + chaosRand.Int63n(chaosResetMax)
+		chaosRand.Unlock()
+	}
+	if cc.delay == 0 && cc.resetAfter == 0 {
+		return conn
+	}
+	return cc
+}
+
+// chaosTransport injects faults into the connections of a transport.
+type chaosTransport struct {
+	transport
+	config *chaosConfig
+}
+
+func (t *chaosTransport) Dial(addr string) (net.Conn, error) {
+	if chance(t.config.DialFail) {
+		logf("chaos: failing dial to %s", addr)
+		return nil, errChaosDial
+	}
+	c, err := t.transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.config.wrap(c), nil
+}
+
+func (t *chaosTransport) Listen(addr string) (net.Listener, error) {
+	l, err := t.transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return wrapListener{l, t.config.wrap}, nil
+}
+
+// chaosConn delays its first write and resets itself once it carried resetAfter bytes.
+type chaosConn struct {
+	traffic    int64 // first for 64-bit alignment of atomic accesses
+	resetAfter int64 // 0 never resets
+	net.Conn
+	delay     time.Duration
+	delayOnce sync.Once
+}
+
+// NetConn returns the underlying connection.
+func (c *chaosConn) NetConn() net.Conn { return c.Conn }
+
+func (c *chaosConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.count(n) {
+		return 0, c.reset()
+	}
+	return n, err
+}
+
+func (c *chaosConn) Write(b []byte) (int, error) {
+	if c.delay > 0 {
+		c.delayOnce.Do(func() {
+			logf("chaos: delaying connection to %s by %v", c.RemoteAddr(), c.delay)
+			time.Sleep(c.delay)
+		})
+	}
+	if c.count(len(b)) {
+		return 0, c.reset()
+	}
+	return c.Conn.Write(b)
+}
+
+// count adds n bytes to the traffic and reports whether the connection is due to reset.
+func (c *chaosConn) count(n int) bool {
+	return c.resetAfter > 0 && atomic.AddInt64(&c.traffic, int64(n)) >= c.resetAfter
+}
+
+// reset closes the connection, aborting it with a TCP RST if possible.
+func (c *chaosConn) reset() error {
+	logf("chaos: resetting connection to %s after %d bytes", c.RemoteAddr(), atomic.LoadInt64(&c.traffic))
+	var conn net.Conn = c.Conn
+	for {
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = u.NetConn()
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	c.Conn.Close()
+	return errors.New("chaos: injected connection reset")
+}
+
+// hideChaosFlags leaves the -chaos-* flags out of the usage message, as they are meant for
+// testing only.
+func hideChaosFlags() {
+	flag.Usage = func() {
+		fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		flag.VisitAll(func(f *flag.Flag) {
+			if !strings.HasPrefix(f.Name, "chaos-") {
+				fs.Var(f.Value, f.Name, f.Usage)
+				fs.Lookup(f.Name).DefValue = f.DefValue
+			}
+		})
+		fs.SetOutput(flag.CommandLine.Output())
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+}
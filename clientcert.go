@@ -0,0 +1,170 @@
+// +build !router
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// setTransportClientAuth makes servers of t terminating TLS, wss and grpc, require client
+// certificates issued by a CA in caFile and, given crlFile, not revoked by the CRL in it, in
+// addition to the key of the cipher.
+func setTransportClientAuth(t transport, caFile, crlFile string) error {
+	var cfg *tls.Config
+	switch t := t.(type) {
+	case *wsTransport:
+		cfg = t.tlsConfig
+	case *grpcTransport:
+		cfg = t.tlsConfig
+	}
+	if cfg == nil {
+		return errors.New("-transport-client-ca requires -transport wss or grpc")
+	}
+	cas, err := loadCerts(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+	var crl *revocationList
+	if crlFile != "" {
+		crl = &revocationList{path: crlFile, cas: cas}
+		if err := crl.load(); err != nil {
+			return err
+		}
+	}
+
+	cfg.ClientCAs = pool
+	// the ACME TLS-ALPN challenge comes without client certificate, see VerifyConnection
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if cs.NegotiatedProtocol == "acme-tls/1" {
+			return nil
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no client certificate")
+		}
+		if cert := cs.PeerCertificates[0]; crl != nil && crl.Revoked(cert) {
+			logf("rejected revoked client certificate %q with serial number %x", cert.Subject.CommonName, cert.SerialNumber)
+			return fmt.Errorf("client certificate %q revoked", cert.Subject.CommonName)
+		}
+		return nil
+	}
+	return nil
+}
+
+// setTransportClientCert makes clients of t, wss or grpc, present the certificate in
+// certFile and keyFile to the server.
+func setTransportClientCert(t transport, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	switch t := t.(type) {
+	case *wsTransport:
+		if t.tls {
+			t.clientCert = []tls.Certificate{cert}
+			return nil
+		}
+	case *grpcTransport:
+		t.clientCert = []tls.Certificate{cert}
+		return nil
+	}
+	return errors.New("-transport-client-cert requires -transport wss or grpc")
+}
+
+// loadCerts returns the certificates in the PEM file path.
+func loadCerts(path string) ([]*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return certs, nil
+}
+
+// revocationList holds the serial numbers revoked by the CRL in a file, PEM or DER, signed
+// by one of cas. The file is reloaded when it changes, so that the certificates of
+// compromised devices are rejected without restarting.
+type revocationList struct {
+	path string
+	cas  []*x509.Certificate
+
+	sync.Mutex
+	modTime time.Time
+	revoked map[string]bool // by serial number
+}
+
+// Revoked reports whether cert is revoked, reloading the CRL if its file changed. If
+// reloading fails, the CRL loaded last stays in effect.
+func (l *revocationList) Revoked(cert *x509.Certificate) bool {
+	l.Lock()
+	defer l.Unlock()
+	if fi, err := os.Stat(l.path); err == nil && !fi.ModTime().Equal(l.modTime) {
+		if err := l.load(); err != nil {
+			logger.Printf("failed to reload CRL %s, keeping the one loaded before: %v", l.path, err)
+			l.modTime = fi.ModTime() // do not retry until it changes again
+		}
+	}
+	return l.revoked[cert.SerialNumber.String()]
+}
+
+// load reads the CRL from the file. l must be locked, except before it is in use.
+func (l *revocationList) load() error {
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	crl, err := x509.ParseCRL(b) // PEM or DER
+	if err != nil {
+		return err
+	}
+	var signed bool
+	for _, ca := range l.cas {
+		if ca.CheckCRLSignature(crl) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("CRL %s is not signed by a CA of -transport-client-ca", l.path)
+	}
+	revoked := make(map[string]bool)
+	for _, c := range crl.TBSCertList.RevokedCertificates {
+		revoked[c.SerialNumber.String()] = true
+	}
+	l.revoked, l.modTime = revoked, fi.ModTime()
+	logf("loaded CRL %s revoking %d certificates", l.path, len(revoked))
+	return nil
+}
@@ -0,0 +1,182 @@
+// +build !router
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates and CRLs in a temporary directory.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{t: t, dir: t.TempDir()}
+	ca.cert, ca.key = ca.issue("ca", 1, nil)
+	return ca
+}
+
+// issue returns a certificate named cn with serial number serial, signed by parent, or
+// self-signed as a CA if parent is nil, and writes it and its key to dir as cn.pem and cn.key.
+func (ca *testCA) issue(cn string, serial int64, parent *testCA) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	ca.write(cn+".pem", &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	ca.write(cn+".key", &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+// revoke writes a CRL revoking serials to crl.pem.
+func (ca *testCA) revoke(serials ...int64) {
+	var revoked []pkix.RevokedCertificate
+	for _, s := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(int64(len(serials)) + 1),
+		ThisUpdate:          time.Now(),
+		NextUpdate:          time.Now().Add(time.Hour),
+		RevokedCertificates: revoked,
+	}, ca.cert, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	ca.write("crl.pem", &pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func (ca *testCA) write(name string, block *pem.Block) {
+	if err := ioutil.WriteFile(ca.path(name), pem.EncodeToMemory(block), 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+}
+
+func (ca *testCA) path(name string) string { return filepath.Join(ca.dir, name) }
+
+func TestTransportClientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	ca.issue("localhost", 2, ca)
+	ca.issue("laptop", 3, ca)
+	ca.issue("phone", 4, ca)
+	other := newTestCA(t)
+	other.issue("stranger", 2, other)
+	ca.revoke()
+
+	srv := &wsTransport{tls: true, host: "localhost", path: "/"}
+	if err := setTransportTLS(srv, ca.path("localhost.pem"), ca.path("localhost.key"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := setTransportClientAuth(srv, ca.path("ca.pem"), ca.path("crl.pem")); err != nil {
+		t.Fatal(err)
+	}
+	starting.Add(1)
+	l, err := srv.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(certs ...tls.Certificate) error {
+		// with TLS 1.2, the handshake fails as the server rejects the certificate
+		c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			ServerName: "localhost", RootCAs: roots, Certificates: certs, MaxVersion: tls.VersionTLS12,
+		})
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+	load := func(ca *testCA, name string) tls.Certificate {
+		cert, err := tls.LoadX509KeyPair(ca.path(name+".pem"), ca.path(name+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	if err := dial(load(ca, "laptop")); err != nil {
+		t.Errorf("certificate of the CA rejected: %v", err)
+	}
+	if err := dial(); err == nil {
+		t.Error("connection without certificate accepted")
+	}
+	if err := dial(load(other, "stranger")); err == nil {
+		t.Error("certificate of another CA accepted")
+	}
+
+	// revoking the phone takes effect once the CRL changes
+	ca.revoke(4)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(ca.path("crl.pem"), future, future)
+	if err := dial(load(ca, "phone")); err == nil {
+		t.Error("revoked certificate accepted")
+	}
+	if err := dial(load(ca, "laptop")); err != nil {
+		t.Errorf("certificate not revoked rejected: %v", err)
+	}
+
+	// a CRL of another CA is ignored
+	other.revoke(3)
+	if err := os.Rename(other.path("crl.pem"), ca.path("crl.pem")); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(ca.path("crl.pem"), future.Add(time.Minute), future.Add(time.Minute))
+	if err := dial(load(ca, "laptop")); err != nil {
+		t.Errorf("certificate rejected after loading a CRL of another CA: %v", err)
+	}
+	if err := dial(load(ca, "phone")); err == nil {
+		t.Error("revoked certificate accepted after loading a CRL of another CA")
+	}
+}
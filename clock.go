@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead2022"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// clockTarget is the HTTPS server whose Date header the local clock is compared with.
+const clockTarget = "www.google.com:443"
+
+// clockCheckInterval is the interval of clock checks after the one at startup.
+const clockCheckInterval = time.Hour
+
+// clockMargin is added to the skew of the server when widening the timestamp tolerance.
+const clockMargin = 10 * time.Second
+
+// checkClock compares the local clock with the Date header of clockTarget fetched through the
+// tunnel, and with the server's clock through the timestamp of its response, at startup and
+// every clockCheckInterval. Shadowsocks 2022 rejects timestamps more than
+// shadowaead2022.MaxTimeDiff off, which otherwise only shows as failing connections.
+//
+// If the response of the server is rejected for a skew of up to widen, the tolerance is
+// widened to accept it. If the tunnel fails, the local clock is checked directly.
+func checkClock(server string, shadow func(net.Conn) net.Conn, widen time.Duration) {
+	checkClockOnce(server, shadow, widen)
+	for range time.Tick(clockCheckInterval) {
+		checkClockOnce(server, shadow, widen)
+	}
+}
+
+func checkClockOnce(server string, shadow func(net.Conn) net.Conn, widen time.Duration) {
+	offset, err := fetchClockOffset(server, shadow)
+	var se *shadowaead2022.SkewError
+	if errors.As(err, &se) && abs(se.Skew) <= widen {
+		shadowaead2022.SetMaxTimeDiff(abs(se.Skew) + clockMargin)
+		logger.Printf("clock: the clock of the server is %s, widened the timestamp tolerance to %v",
+			describeSkew(se.Skew), shadowaead2022.MaxTimeDiff())
+		offset, err = fetchClockOffset(server, shadow)
+	}
+	tunneled := err == nil
+	if err != nil {
+		logf("clock: checking through the tunnel failed: %v", err)
+		if errors.As(err, &se) {
+			logger.Printf("clock: the clock of the server is %s, beyond the timestamp tolerance of %v; sync the clocks with NTP",
+				describeSkew(se.Skew), shadowaead2022.MaxTimeDiff())
+		}
+		if offset, err = fetchClockOffset("", nil); err != nil {
+			logf("clock: checking directly failed: %v", err)
+			return
+		}
+	}
+
+	max := shadowaead2022.MaxTimeDiff()
+	host, _, _ := net.SplitHostPort(clockTarget)
+	if abs(offset) > max/2 {
+		logger.Printf("clock: compared with %s, the local clock is %s, while Shadowsocks 2022 servers reject requests more than %v off; sync it with NTP",
+			host, describeSkew(-offset), max)
+	} else {
+		logf("clock: compared with %s, the local clock is %s", host, describeSkew(-offset))
+	}
+	if skew, ok := shadowaead2022.Skew(); ok && tunneled {
+		if abs(skew) > max/2 {
+			logger.Printf("clock: the clock of the server is %s, close to the timestamp tolerance of %v; sync the clocks with NTP",
+				describeSkew(skew), max)
+		} else {
+			logf("clock: the clock of the server is %s", describeSkew(skew))
+		}
+	}
+}
+
+// fetchClockOffset requests clockTarget over HTTPS through the tunnel to server, or directly
+// if server is empty, and returns how far the time of its Date header is ahead of the local
+// clock, to the second.
+func fetchClockOffset(server string, shadow func(net.Conn) net.Conn) (time.Duration, error) {
+	var c net.Conn
+	var err error
+	if server != "" {
+		c, err = dialTarget(server, shadow, socks.ParseAddr(clockTarget))
+	} else {
+		c, err = net.DialTimeout("tcp", clockTarget, 10*time.Second)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	host, _, _ := net.SplitHostPort(clockTarget)
+	tc := tls.Client(c, &tls.Config{ServerName: host})
+	if err := tc.Handshake(); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if _, err := fmt.Fprintf(tc, "HEAD / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", host); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(tc), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	rtt := time.Since(start)
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("bad Date header: %v", err)
+	}
+	// the Date header is truncated to the second, sent about half a round trip ago
+	return date.Add(500 * time.Millisecond).Sub(start.Add(rtt / 2)).Round(time.Second), nil
+}
+
+// describeSkew describes a clock that is skew ahead of another.
+func describeSkew(skew time.Duration) string {
+	switch {
+	case skew > 0:
+		return fmt.Sprintf("%v ahead", skew)
+	case skew < 0:
+		return fmt.Sprintf("%v behind", -skew)
+	}
+	return "in sync"
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
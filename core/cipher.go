@@ -2,12 +2,18 @@ package core
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"sort"
 	"strings"
 
 	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead2022"
+	"golang.org/x/crypto/hkdf"
 )
 
 type Cipher interface {
@@ -27,9 +33,11 @@ type PacketConnCipher interface {
 var ErrCipherNotSupported = errors.New("cipher not supported")
 
 const (
-	aeadAes128Gcm        = "AEAD_AES_128_GCM"
-	aeadAes256Gcm        = "AEAD_AES_256_GCM"
-	aeadChacha20Poly1305 = "AEAD_CHACHA20_POLY1305"
+	aeadAes128Gcm         = "AEAD_AES_128_GCM"
+	aeadAes256Gcm         = "AEAD_AES_256_GCM"
+	aeadChacha20Poly1305  = "AEAD_CHACHA20_POLY1305"
+	aeadXChacha20Poly1305 = "AEAD_XCHACHA20_POLY1305"
+	aeadAes256GcmSiv      = "AEAD_AES_256_GCM_SIV"
 )
 
 // List of AEAD ciphers: key size in bytes and constructor
@@ -37,9 +45,27 @@ var aeadList = map[string]struct {
 	KeySize int
 	New     func([]byte) (shadowaead.Cipher, error)
 }{
-	aeadAes128Gcm:        {16, shadowaead.AESGCM},
-	aeadAes256Gcm:        {32, shadowaead.AESGCM},
-	aeadChacha20Poly1305: {32, shadowaead.Chacha20Poly1305},
+	aeadAes128Gcm:         {16, shadowaead.AESGCM},
+	aeadAes256Gcm:         {32, shadowaead.AESGCM},
+	aeadChacha20Poly1305:  {32, shadowaead.Chacha20Poly1305},
+	aeadXChacha20Poly1305: {32, shadowaead.XChacha20Poly1305},
+	aeadAes256GcmSiv:      {32, shadowaead.AESGCMSIV},
+}
+
+const (
+	aead2022Aes128Gcm        = "2022-blake3-aes-128-gcm"
+	aead2022Aes256Gcm        = "2022-blake3-aes-256-gcm"
+	aead2022Chacha20Poly1305 = "2022-blake3-chacha20-poly1305"
+)
+
+// List of Shadowsocks 2022 ciphers: key size in bytes and constructor
+var aead2022List = map[string]struct {
+	KeySize int
+	New     func([]byte) (*shadowaead2022.Cipher, error)
+}{
+	aead2022Aes128Gcm:        {16, shadowaead2022.AESGCM},
+	aead2022Aes256Gcm:        {32, shadowaead2022.AESGCM},
+	aead2022Chacha20Poly1305: {32, shadowaead2022.Chacha20Poly1305},
 }
 
 // ListCipher returns a list of available cipher names sorted alphabetically.
@@ -48,23 +74,58 @@ func ListCipher() []string {
 	for k := range aeadList {
 		l = append(l, k)
 	}
+	for k := range aead2022List {
+		l = append(l, k)
+	}
 	sort.Strings(l)
 	return l
 }
 
-// PickCipher returns a Cipher of the given name. Derive key from password if given key is empty.
-func PickCipher(name string, key []byte, password string) (Cipher, error) {
+// canonicalName maps a cipher name or one of its aliases to the name used in aeadList.
+func canonicalName(name string) string {
 	name = strings.ToUpper(name)
 
 	switch name {
-	case "DUMMY":
-		return &dummy{}, nil
 	case "CHACHA20-IETF-POLY1305":
-		name = aeadChacha20Poly1305
+		return aeadChacha20Poly1305
+	case "XCHACHA20-IETF-POLY1305":
+		return aeadXChacha20Poly1305
+	case "AES-256-GCM-SIV":
+		return aeadAes256GcmSiv
 	case "AES-128-GCM":
-		name = aeadAes128Gcm
+		return aeadAes128Gcm
 	case "AES-256-GCM":
-		name = aeadAes256Gcm
+		return aeadAes256Gcm
+	}
+	if strings.HasPrefix(name, "2022-") {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// KeySize returns the key size in bytes of the named cipher, or an error if the cipher is
+// unknown or takes no key.
+func KeySize(name string) (int, error) {
+	name = canonicalName(name)
+	if choice, ok := aead2022List[name]; ok {
+		return choice.KeySize, nil
+	}
+	if choice, ok := aeadList[name]; ok {
+		return choice.KeySize, nil
+	}
+	if name == "DUMMY" {
+		return 0, errors.New("cipher DUMMY takes no key")
+	}
+	return 0, ErrCipherNotSupported
+}
+
+// PickCipher returns a Cipher of the given name. Derive key from password if given key is empty.
+// Shadowsocks 2022 ciphers take no password but a base64-encoded key in its place instead.
+func PickCipher(name string, key []byte, password string) (Cipher, error) {
+	name = canonicalName(name)
+
+	if name == "DUMMY" {
+		return &dummy{}, nil
 	}
 
 	if choice, ok := aeadList[name]; ok {
@@ -78,6 +139,26 @@ func PickCipher(name string, key []byte, password string) (Cipher, error) {
 		return &aeadCipher{aead}, err
 	}
 
+	if choice, ok := aead2022List[name]; ok {
+		if len(key) == 0 {
+			var err error
+			if key, err = base64.StdEncoding.DecodeString(password); err != nil {
+				if key, err = base64.URLEncoding.DecodeString(password); err != nil {
+					return nil, fmt.Errorf("%s takes a base64-encoded key of %d bytes instead of a password", name, choice.KeySize)
+				}
+			}
+		}
+		if len(key) != choice.KeySize {
+			return nil, shadowaead.KeySizeError(choice.KeySize)
+		}
+		aead, err := choice.New(key)
+		return &aead2022Cipher{aead}, err
+	}
+
+	if isLegacy(name) {
+		return nil, fmt.Errorf("%w: %s is a legacy stream cipher without integrity protection; use %s on both server and clients",
+			ErrCipherNotSupported, strings.ToLower(name), strings.Join(ListCipher(), ", "))
+	}
 	return nil, ErrCipherNotSupported
 }
 
@@ -88,6 +169,15 @@ func (aead *aeadCipher) PacketConn(c net.PacketConn) net.PacketConn {
 	return shadowaead.NewPacketConn(c, aead)
 }
 
+type aead2022Cipher struct{ *shadowaead2022.Cipher }
+
+func (aead *aead2022Cipher) StreamConn(c net.Conn) net.Conn {
+	return shadowaead2022.NewConn(c, aead.Cipher)
+}
+func (aead *aead2022Cipher) PacketConn(c net.PacketConn) net.PacketConn {
+	return shadowaead2022.NewPacketConn(c, aead.Cipher)
+}
+
 // dummy cipher does not encrypt
 type dummy struct{}
 
@@ -107,3 +197,14 @@ func kdf(password string, keyLen int) []byte {
 	}
 	return b[:keyLen]
 }
+
+// DeriveKey derives a key of keyLen bytes for the given device ID from a master key
+// using HKDF-SHA256 with info "ss-device-key:" followed by the device ID.
+func DeriveKey(master []byte, device string, keyLen int) []byte {
+	key := make([]byte, keyLen)
+	r := hkdf.New(sha256.New, master, nil, []byte("ss-device-key:"+device))
+	if _, err := io.ReadFull(r, key); err != nil {
+		panic(err) // should never happen
+	}
+	return key
+}
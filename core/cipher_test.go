@@ -0,0 +1,65 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+func TestExtraCiphers(t *testing.T) {
+	for _, name := range []string{"xchacha20-ietf-poly1305", "aes-256-gcm-siv"} {
+		if size, err := KeySize(name); err != nil || size != 32 {
+			t.Fatalf("alias %s not recognized", name)
+		}
+		ciph, err := PickCipher(name, nil, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the client side writes its salt by hand, as one from another process, since the salt
+		// filter would take a salt this process wrote for a replay when reading it back
+		aead := ciph.(*aeadCipher)
+		salt := make([]byte, aead.SaltSize())
+		if _, err := rand.Read(salt); err != nil {
+			t.Fatal(err)
+		}
+		enc, err := aead.Encrypter(salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, sc := net.Pipe()
+		s := ciph.StreamConn(sc)
+		msg := []byte("GET / HTTP/1.1\r\n")
+		go func() {
+			c.Write(salt)
+			shadowaead.NewWriter(c, enc).Write(msg)
+		}()
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(s, b); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(b, msg) {
+			t.Fatalf("%s: got %q, want %q", name, b, msg)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestKeySize(t *testing.T) {
+	for name, want := range map[string]int{"AEAD_AES_128_GCM": 16, "chacha20-ietf-poly1305": 32, "2022-blake3-aes-128-gcm": 16} {
+		if size, err := KeySize(name); err != nil || size != want {
+			t.Errorf("KeySize(%s) = %d, %v, want %d", name, size, err, want)
+		}
+	}
+	// ciphers without a key of their own cannot have one derived for them
+	for _, name := range []string{"dummy", "rc4-md5", "no-such-cipher"} {
+		if size, err := KeySize(name); err == nil {
+			t.Errorf("KeySize(%s) = %d, want an error", name, size)
+		}
+	}
+}
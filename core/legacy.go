@@ -0,0 +1,133 @@
+package core
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rc4"
+	"crypto/sha1"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// Stream ciphers of the original Shadowsocks protocol. They are not supported since they
+// provide no integrity protection, but are recognized to tell users of old clients what to do.
+var legacyList = map[string]struct {
+	KeySize, IVSize int
+	New             func(key, iv []byte) (cipher.Stream, error)
+}{
+	"aes-128-cfb":   {16, 16, aesCFB},
+	"aes-192-cfb":   {24, 16, aesCFB},
+	"aes-256-cfb":   {32, 16, aesCFB},
+	"aes-128-ctr":   {16, 16, aesCTR},
+	"aes-192-ctr":   {24, 16, aesCTR},
+	"aes-256-ctr":   {32, 16, aesCTR},
+	"chacha20-ietf": {32, 12, chacha20IETF},
+	"rc4-md5":       {16, 16, rc4MD5},
+}
+
+func aesCFB(key, iv []byte) (cipher.Stream, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCFBDecrypter(blk, iv), nil
+}
+
+func aesCTR(key, iv []byte) (cipher.Stream, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(blk, iv), nil
+}
+
+func chacha20IETF(key, iv []byte) (cipher.Stream, error) {
+	return chacha20.NewUnauthenticatedCipher(key, iv)
+}
+
+func rc4MD5(key, iv []byte) (cipher.Stream, error) {
+	h := md5.New()
+	h.Write(key)
+	h.Write(iv)
+	return rc4.NewCipher(h.Sum(nil))
+}
+
+// isLegacy reports whether name is a legacy stream cipher.
+func isLegacy(name string) bool {
+	_, ok := legacyList[strings.ToLower(name)]
+	return ok
+}
+
+// DetectLegacy reports which legacy stream cipher with a key derived from password encrypts
+// the request header at the start of head, and whether the client uses one-time auth (OTA).
+// Only headers that can be told apart from random data are recognized: those with OTA, which
+// are authenticated, and those with a domain name target. It returns "" if there is no match.
+// As CFB and CTR mode decrypt the first block alike, short headers may match both AES modes,
+// which are then returned joined by " or ".
+func DetectLegacy(password string, head []byte) (name string, ota bool) {
+	var names []string
+	for n, c := range legacyList {
+		if len(head) <= c.IVSize {
+			continue
+		}
+		key := kdf(password, c.KeySize)
+		iv := head[:c.IVSize]
+		s, err := c.New(key, iv)
+		if err != nil {
+			continue
+		}
+		hdr := make([]byte, len(head)-c.IVSize)
+		s.XORKeyStream(hdr, head[c.IVSize:])
+		if hl, ok := legacyHeader(hdr); ok {
+			names = append(names, n)
+		} else if hl > 0 && hdr[0]&0x10 != 0 && len(hdr) >= hl+10 {
+			// OTA: header followed by HMAC-SHA1 of it keyed with IV and key, truncated to 10 bytes
+			mac := hmac.New(sha1.New, append(append([]byte{}, iv...), key...))
+			mac.Write(hdr[:hl])
+			if hmac.Equal(mac.Sum(nil)[:10], hdr[hl:hl+10]) {
+				names = append(names, n)
+				ota = true
+			}
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, " or "), ota
+}
+
+// legacyHeader returns the length of the address header at the start of b, if b is long
+// enough to hold it, and whether it is a plausible header without OTA with a domain name.
+func legacyHeader(b []byte) (n int, ok bool) {
+	if len(b) < 2 {
+		return 0, false
+	}
+	switch b[0] &^ 0x10 {
+	case 1: // IPv4
+		n = 1 + 4 + 2
+	case 4: // IPv6
+		n = 1 + 16 + 2
+	case 3: // domain name
+		n = 1 + 1 + int(b[1]) + 2
+	default:
+		return 0, false
+	}
+	if len(b) < n {
+		return 0, false
+	}
+	if b[0] != 3 || b[1] == 0 || b[n-2] == 0 && b[n-1] == 0 {
+		return n, false
+	}
+	name := b[2 : n-2]
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return n, false
+		}
+	}
+	// a dot between labels, as random bytes rarely have, unlike the names of targets
+	dot := bytes.IndexByte(name[1:], '.')
+	return n, dot >= 0 && dot < len(name)-2
+}
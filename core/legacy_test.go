@@ -0,0 +1,91 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	mrand "math/rand"
+	"strings"
+	"testing"
+)
+
+// legacyRequest encrypts the request header of a legacy client for example.com:443.
+func legacyRequest(t *testing.T, name, password string, ota bool) []byte {
+	c := legacyList[name]
+	key := kdf(password, c.KeySize)
+	iv := make([]byte, c.IVSize)
+	rand.Read(iv)
+
+	hdr := append([]byte{3, 11}, "example.com"...)
+	hdr = append(hdr, 1, 187)
+	if ota {
+		hdr[0] |= 0x10
+		mac := hmac.New(sha1.New, append(append([]byte{}, iv...), key...))
+		mac.Write(hdr)
+		hdr = append(hdr, mac.Sum(nil)[:10]...)
+	}
+	hdr = append(hdr, "GET / HTTP/1.1\r\n"...)
+
+	s, err := c.New(key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasSuffix(name, "-cfb") {
+		blk, _ := aes.NewCipher(key)
+		s = cipher.NewCFBEncrypter(blk, iv)
+	}
+	s.XORKeyStream(hdr, hdr)
+	return append(iv, hdr...)
+}
+
+func TestDetectLegacy(t *testing.T) {
+	for name := range legacyList {
+		for _, ota := range []bool{false, true} {
+			got, gotOTA := DetectLegacy("password", legacyRequest(t, name, "password", ota))
+			if !strings.Contains(got, name) || gotOTA != ota {
+				t.Errorf("DetectLegacy(%s, ota=%v) = %q, %v", name, ota, got, gotOTA)
+			}
+			if got, _ := DetectLegacy("other", legacyRequest(t, name, "password", ota)); got != "" {
+				t.Errorf("DetectLegacy(%s, ota=%v) with wrong password = %q", name, ota, got)
+			}
+		}
+	}
+
+	// seeded, so that a buffer looking like a header by chance fails every run
+	r := mrand.New(mrand.NewSource(1))
+	b := make([]byte, 50)
+	for i := 0; i < 1000; i++ {
+		r.Read(b)
+		if got, _ := DetectLegacy("password", b); got != "" {
+			t.Fatalf("DetectLegacy(random %x) = %q", b, got)
+		}
+	}
+}
+
+func TestLegacyHeaderDomain(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ok   bool
+	}{
+		{"example.com", true},
+		{"a.b", true},
+		{"localhost", false},
+		{"example.", false},
+		{".example", false},
+	} {
+		hdr := append([]byte{3, byte(len(tc.name))}, tc.name...)
+		hdr = append(hdr, 1, 187)
+		if n, ok := legacyHeader(hdr); n != len(hdr) || ok != tc.ok {
+			t.Errorf("legacyHeader(%q) = %d, %v", tc.name, n, ok)
+		}
+	}
+}
+
+func TestPickLegacyCipher(t *testing.T) {
+	_, err := PickCipher("AES-256-CFB", nil, "password")
+	if err == nil || !isLegacy("AES-256-CFB") {
+		t.Fatalf("PickCipher(AES-256-CFB) error = %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+// +build !router
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/relay"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// decoyLocal fetches a random one of urls through server every 30 to 120 seconds while
+// no other flow is active, to mask when the tunnel is actually used. At most budget
+// bytes of responses are fetched per hour.
+func decoyLocal(urls []string, server string, shadow func(net.Conn) net.Conn, budget int64) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialTarget(server, shadow, socks.ParseAddr(addr))
+			},
+			DisableKeepAlives: true,
+		},
+		Timeout: 30 * time.Second,
+	}
+
+	logf("decoy traffic via %s, %d bytes per hour", server, budget)
+	period, used := time.Now(), int64(0)
+	for {
+		time.Sleep(30*time.Second + time.Duration(rand.Int63n(int64(90*time.Second))))
+		if time.Since(period) >= time.Hour {
+			period, used = time.Now(), 0
+		}
+		if relay.Active() > 0 || used >= budget {
+			continue
+		}
+
+		u := urls[rand.Intn(len(urls))]
+		resp, err := client.Get(u)
+		if err != nil {
+			logf("decoy error: %v", err)
+			continue
+		}
+		n, _ := io.Copy(ioutil.Discard, io.LimitReader(resp.Body, budget-used))
+		resp.Body.Close()
+		used += n
+		logf("decoy fetched %d bytes", n)
+	}
+}
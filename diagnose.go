@@ -0,0 +1,180 @@
+// +build !router
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// diagnoseTarget is the host connectivity is checked against, answering HTTP with 204.
+const diagnoseTarget = "www.gstatic.com:80"
+
+// diagnosis collects what is written to a diagnostics bundle.
+type diagnosis struct {
+	log    bytes.Buffer
+	checks bytes.Buffer
+}
+
+// check runs the named connectivity check f and records its result and duration.
+func (d *diagnosis) check(name string, f func() error) {
+	start := time.Now()
+	err := f()
+	result := "ok"
+	if err != nil {
+		result = "FAILED: " + err.Error()
+	}
+	fmt.Fprintf(&d.checks, "%-24s %s (%v)\n", name, result, time.Since(start).Round(time.Millisecond))
+	logf("diagnose: %s: %s", name, result)
+}
+
+// diagnose runs connectivity checks of the client connecting to server through shadow, or of
+// the server if server is empty, and writes them together with the configuration, the log of
+// the checks and the environment into a gzipped tar archive at path. Secrets are redacted.
+func diagnose(path, server string, shadow func(net.Conn) net.Conn) error {
+	d := new(diagnosis)
+	logger.SetOutput(redactWriter{io.MultiWriter(os.Stderr, &d.log)})
+	defer logger.SetOutput(redactWriter{os.Stderr})
+	setVerbose(true)
+
+	host, _, _ := net.SplitHostPort(diagnoseTarget)
+	if server != "" {
+		if h, _, err := net.SplitHostPort(server); err == nil && net.ParseIP(h) == nil {
+			d.check("resolve server", func() error {
+				_, err := net.LookupHost(h)
+				return err
+			})
+		}
+		d.check("connect server", func() error {
+			c, err := link.Dial(server)
+			if err == nil {
+				c.Close()
+			}
+			return err
+		})
+		d.check("HTTP through tunnel", func() error {
+			c, err := dialTarget(server, shadow, socks.ParseAddr(diagnoseTarget))
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			return checkHTTP(c, host)
+		})
+		d.check("resolve through tunnel", func() error {
+			_, err := resolver.LookupIP(host)
+			return err
+		})
+	} else {
+		d.check("resolve target", func() error {
+			_, err := net.LookupHost(host)
+			return err
+		})
+		d.check("HTTP direct", func() error {
+			c, err := net.DialTimeout("tcp", diagnoseTarget, 10*time.Second)
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			return checkHTTP(c, host)
+		})
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	files := []struct{ name, body string }{
+		{"config.txt", diagnoseConfig()},
+		{"environment.txt", diagnoseEnvironment()},
+		{"checks.txt", d.checks.String()},
+		{"log.txt", d.log.String()},
+	}
+	for _, file := range files {
+		body := redact(file.body)
+		hdr := &tar.Header{Name: file.name, Mode: 0600, Size: int64(len(body)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	logger.Printf("diagnostics written to %s", path)
+	return f.Close()
+}
+
+// checkHTTP sends a request for host over c and expects a response without content.
+func checkHTTP(c net.Conn, host string) error {
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := fmt.Fprintf(c, "GET /generate_204 HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", host); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
+
+// diagnoseConfig lists the flags set on the command line, with passwords and keys replaced
+// by their fingerprints.
+func diagnoseConfig() string {
+	var b strings.Builder
+	flag.Visit(func(f *flag.Flag) {
+		v := f.Value.String()
+		if (strings.Contains(f.Name, "password") || strings.HasSuffix(f.Name, "key")) && v != "" {
+			v = fingerprint(v)
+		}
+		fmt.Fprintf(&b, "-%s=%s\n", f.Name, v)
+	})
+	return b.String()
+}
+
+// diagnoseEnvironment describes the build and the system, and names the environment
+// variables of the program that are set without their values.
+func diagnoseEnvironment() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "cpus: %d\n", runtime.NumCPU())
+	if info, ok := debug.ReadBuildInfo(); ok {
+		fmt.Fprintf(&b, "module: %s %s\n", info.Main.Path, info.Main.Version)
+	}
+	var names []string
+	for _, kv := range os.Environ() {
+		if name := strings.SplitN(kv, "=", 2)[0]; strings.HasPrefix(name, "SHADOWSOCKS_") ||
+			strings.HasSuffix(name, "_PROXY") || strings.HasSuffix(name, "_proxy") || name == listenFDsEnv {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	fmt.Fprintf(&b, "environment: %s\n", strings.Join(names, " "))
+	return b.String()
+}
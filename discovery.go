@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// srvRefresh is how long the server addresses looked up from SRV records are used.
+const srvRefresh = 5 * time.Minute
+
+// srvDiscovery looks up the server addresses from the DNS SRV records of name, so that
+// servers can be moved or added without reconfiguring clients.
+type srvDiscovery struct {
+	name string
+
+	sync.Mutex
+	addrs   []string
+	expires time.Time
+}
+
+// Addrs returns the server addresses in the order to try them: by priority, and randomly
+// by weight within a priority. It returns the last addresses found if a lookup fails.
+func (d *srvDiscovery) Addrs() ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+	if time.Now().Before(d.expires) {
+		return d.addrs, nil
+	}
+
+	_, srvs, err := net.LookupSRV("", "", d.name)
+	if err == nil && len(srvs) == 0 {
+		err = fmt.Errorf("no SRV records of %s", d.name)
+	}
+	if err != nil {
+		if len(d.addrs) == 0 {
+			return nil, err
+		}
+		logf("failed to look up servers, using the last ones: %v", err)
+		d.expires = time.Now().Add(time.Minute)
+		return d.addrs, nil
+	}
+	var addrs []string
+	for _, srv := range srvs {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+	if strings.Join(addrs, ",") != strings.Join(d.addrs, ",") {
+		logf("servers of %s: %s", d.name, strings.Join(addrs, ", "))
+	}
+	d.addrs, d.expires = addrs, time.Now().Add(srvRefresh)
+	return addrs, nil
+}
+
+// srvTransport dials the servers found by a srvDiscovery in turn instead of the given address.
+type srvTransport struct {
+	transport
+	d *srvDiscovery
+}
+
+func (t srvTransport) Dial(string) (net.Conn, error) {
+	addrs, err := t.d.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		var c net.Conn
+		if c, err = t.transport.Dial(addr); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// dnsQueryTimeout is how long a DNS query relayed by dnsFastPath waits for its answer.
+const dnsQueryTimeout = 10 * time.Second
+
+// dnsFastPath relays UDP DNS queries of all local clients through one packet connection to
+// the server instead of a UDP session each, rewriting their IDs to tell the answers apart.
+// Most DNS flows are a single query and answer, which would otherwise hold a NAT entry, a
+// socket and a goroutine until the UDP timeout.
+type dnsFastPath struct {
+	shadow func(net.PacketConn) net.PacketConn
+
+	sync.Mutex
+	pc      net.PacketConn // nil until the first query and after errors
+	pending map[uint16]*dnsQuery
+	next    uint16
+}
+
+type dnsQuery struct {
+	id      uint16 // of the client
+	peer    net.Addr
+	reply   net.PacketConn // to answer peer through
+	role    mode           // relayClient or socksClient
+	expires time.Time
+}
+
+// dnsFast is set on clients with -dns-fast-path.
+var dnsFast *dnsFastPath
+
+var errDNSBusy = errors.New("too many DNS queries in flight")
+
+func newDNSFastPath(shadow func(net.PacketConn) net.PacketConn) *dnsFastPath {
+	return &dnsFastPath{shadow: shadow, pending: make(map[uint16]*dnsQuery)}
+}
+
+// isDNSQuery reports whether pkt, a target address followed by the payload, is a DNS query
+// to port 53.
+func isDNSQuery(pkt []byte) bool {
+	tgt := socks.SplitAddr(pkt)
+	if tgt == nil || len(pkt)-len(tgt) < 12 {
+		return false
+	}
+	_, port, err := net.SplitHostPort(tgt.String())
+	return err == nil && port == "53" && pkt[len(tgt)+2]&0x80 == 0 // QR bit clear
+}
+
+// Query relays pkt, a target address followed by a DNS query from peer, through server
+// and sends the answer to peer through reply as role does.
+func (d *dnsFastPath) Query(pkt []byte, server, peer net.Addr, reply net.PacketConn, role mode) error {
+	tgt := socks.SplitAddr(pkt)
+	msg := pkt[len(tgt):]
+
+	d.Lock()
+	if d.pc == nil {
+		pc, err := newUDPSession(d.shadow)
+		if err != nil {
+			d.Unlock()
+			return err
+		}
+		d.pc = pc
+		go d.answer(pc)
+	}
+	pc := d.pc
+	now := time.Now()
+	id := d.next
+	for q := d.pending[id]; q != nil && now.Before(q.expires); q = d.pending[id] {
+		id++
+		if id == d.next {
+			d.Unlock()
+			return errDNSBusy
+		}
+	}
+	d.next = id + 1
+	d.pending[id] = &dnsQuery{binary.BigEndian.Uint16(msg), peer, reply, role, now.Add(dnsQueryTimeout)}
+	d.Unlock()
+
+	out := append(append([]byte{}, tgt...), msg...)
+	binary.BigEndian.PutUint16(out[len(tgt):], id)
+	_, err := pc.WriteTo(out, server)
+	return err
+}
+
+// answer relays the answers arriving at pc to the clients that asked until pc fails.
+func (d *dnsFastPath) answer(pc net.PacketConn) {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			logf("DNS fast path read error: %v", err)
+			d.Lock()
+			if d.pc == pc {
+				d.pc = nil
+			}
+			d.Unlock()
+			pc.Close()
+			return
+		}
+		src := socks.SplitAddr(buf[:n])
+		if src == nil || n-len(src) < 12 {
+			continue
+		}
+		msg := buf[len(src):n]
+		id := binary.BigEndian.Uint16(msg)
+		d.Lock()
+		q := d.pending[id]
+		delete(d.pending, id)
+		d.Unlock()
+		if q == nil {
+			continue
+		}
+		binary.BigEndian.PutUint16(msg, q.id)
+		if q.role == socksClient {
+			_, err = q.reply.WriteTo(append([]byte{0, 0, 0}, buf[:n]...), q.peer)
+		} else {
+			_, err = q.reply.WriteTo(msg, q.peer)
+		}
+		if err != nil {
+			logf("DNS fast path write error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// +build !router
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/dnsmsg"
+)
+
+const dohContentType = "application/dns-message"
+
+// startDoH starts dohServer on addr with the certificate in certFile and keyFile, or
+// without TLS if certFile is empty.
+func startDoH(addr, certFile, keyFile string) error {
+	var tlsConfig *tls.Config
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	starting.Add(1)
+	go dohServer(addr, tlsConfig)
+	return nil
+}
+
+// dohServer serves DNS over HTTPS (RFC 8484) on addr at /dns-query, answering queries with
+// the tunnel resolver. Without a TLS config it serves plain HTTP, e.g. behind a reverse proxy.
+func dohServer(addr string, tlsConfig *tls.Config) {
+	cache := newDNSCache(1024)
+	go cache.Prefetch(resolver.Exchange)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		var query []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohContentType {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			query, err = ioutil.ReadAll(io.LimitReader(r.Body, 65535))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil || len(query) < 12 {
+			http.Error(w, "invalid DNS query", http.StatusBadRequest)
+			return
+		}
+
+		resp, ttl, ok := cache.Get(query)
+		if !ok {
+			if resp, err = resolver.Exchange(query); err != nil {
+				logf("DoH query failed: %v", err)
+				http.Error(w, "DNS query failed", http.StatusBadGateway)
+				return
+			}
+			ttl = cache.Put(query, resp)
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl/time.Second)))
+		w.Write(resp)
+	})
+
+	l, err := listen("tcp", addr)
+	if err != nil {
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+		logf("DNS over HTTPS https://%s/dns-query -> %s", addr, resolver.dns)
+	} else {
+		logf("DNS over HTTP http://%s/dns-query -> %s", addr, resolver.dns)
+	}
+	if err := http.Serve(l, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+		logf("DoH server error: %v", err)
+	}
+}
+
+const (
+	prefetchHits = 3 // answers from the cache an entry needs to be prefetched
+	prefetchRate = 4 // prefetches per second at most
+)
+
+// dnsCache caches DNS responses by question for the lowest TTL of their answers.
+type dnsCache struct {
+	sync.Mutex
+	size    int
+	entries map[string]*dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	resp    []byte
+	ttl     time.Duration
+	expires time.Time
+	hits    int // answers from the cache since the entry was stored
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{size: size, entries: make(map[string]*dnsCacheEntry)}
+}
+
+// Get returns the cached response to query, with the ID of query, and its remaining TTL.
+func (c *dnsCache) Get(query []byte) ([]byte, time.Duration, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[string(query[2:])]
+	if !ok {
+		return nil, 0, false
+	}
+	ttl := time.Until(e.expires)
+	if ttl <= 0 {
+		return nil, 0, false
+	}
+	e.hits++
+	resp := append([]byte{}, e.resp...)
+	copy(resp, query[:2])
+	return resp, ttl, true
+}
+
+// Put caches resp, the response to query, if it has answers and returns its TTL.
+func (c *dnsCache) Put(query, resp []byte) time.Duration {
+	answers, err := dnsmsg.Answers(resp, uint16(query[0])<<8|uint16(query[1]))
+	if err != nil || len(answers) == 0 {
+		return 0
+	}
+	ttl := answers[0].TTL
+	for _, a := range answers {
+		if a.TTL < ttl {
+			ttl = a.TTL
+		}
+	}
+	d := time.Duration(ttl) * time.Second
+
+	c.Lock()
+	defer c.Unlock()
+	if len(c.entries) >= c.size {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.size {
+			return d
+		}
+	}
+	c.entries[string(query[2:])] = &dnsCacheEntry{resp: resp, ttl: d, expires: time.Now().Add(d)}
+	return d
+}
+
+// Prefetch refreshes popular entries with exchange in the last tenth of their TTL, so that
+// names in frequent use are answered from the cache without waiting for the tunnel. At most
+// prefetchRate entries are refreshed per second, the most used first. An entry is popular
+// if answered prefetchHits times since it was stored, so names no longer used expire.
+func (c *dnsCache) Prefetch(exchange func([]byte) ([]byte, error)) {
+	for range time.Tick(time.Second) {
+		for _, q := range c.expiring(prefetchRate) {
+			query := append([]byte{byte(rand.Intn(256)), byte(rand.Intn(256))}, q...)
+			resp, err := exchange(query)
+			if err != nil {
+				logf("DNS prefetch failed: %v", err)
+				continue
+			}
+			c.Put(query, resp)
+		}
+	}
+}
+
+// expiring returns the questions of at most n popular entries due to be prefetched, the
+// most used first, and resets their hits so that they are not returned again.
+func (c *dnsCache) expiring(n int) []string {
+	c.Lock()
+	defer c.Unlock()
+	var due []string
+	now := time.Now()
+	for k, e := range c.entries {
+		left := e.expires.Sub(now)
+		if e.hits >= prefetchHits && left > 0 && left <= e.ttl/10+time.Second {
+			due = append(due, k)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return c.entries[due[i]].hits > c.entries[due[j]].hits })
+	if len(due) > n {
+		due = due[:n]
+	}
+	for _, k := range due {
+		c.entries[k].hits = 0
+	}
+	return due
+}
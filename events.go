@@ -0,0 +1,142 @@
+// +build !router
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/relay"
+)
+
+// flowEvent is a line of the event stream, written when a flow opens and closes.
+type flowEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"` // "open" or "close"
+	ID       string    `json:"id"`
+	Network  string    `json:"network"`
+	Source   string    `json:"source,omitempty"`
+	Target   string    `json:"target"`
+	Remote   string    `json:"remote,omitempty"` // the server on clients, the target on servers
+	Up       int64     `json:"up,omitempty"`     // bytes, on close
+	Down     int64     `json:"down,omitempty"`
+	Duration float64   `json:"duration,omitempty"` // seconds, on close
+	Error    string    `json:"error,omitempty"`
+}
+
+// eventSubscriberQueue is the number of events queued for a subscriber before further
+// events are dropped for it.
+const eventSubscriberQueue = 256
+
+// eventHub sends the events of all flows to its subscribers as JSON lines.
+type eventHub struct {
+	sync.Mutex
+	subs map[chan []byte]struct{}
+}
+
+// newEventHub returns an eventHub publishing the events of all flows. It must be called
+// before any flow is relayed.
+func newEventHub() *eventHub {
+	h := &eventHub{subs: make(map[chan []byte]struct{})}
+	relay.Register(relay.Hooks{
+		OnOpen: func(f *relay.Flow) error {
+			h.publish(newFlowEvent("open", f, nil))
+			return nil
+		},
+		OnClose: func(f *relay.Flow, err error) {
+			e := newFlowEvent("close", f, err)
+			e.Up, e.Down = f.Bytes()
+			e.Duration = e.Time.Sub(f.Start).Seconds()
+			h.publish(e)
+		},
+	})
+	return h
+}
+
+func newFlowEvent(event string, f *relay.Flow, err error) *flowEvent {
+	e := &flowEvent{Time: time.Now(), Event: event, ID: f.ID, Network: f.Network, Target: f.Target}
+	if f.Source != nil {
+		e.Source = f.Source.String()
+	}
+	if f.Remote != nil {
+		e.Remote = f.Remote.String()
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+func (h *eventHub) publish(e *flowEvent) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	for ch := range h.subs {
+		select {
+		case ch <- b:
+		default: // a slow subscriber misses events rather than slowing down flows
+		}
+	}
+}
+
+// serve streams events to subscribers connecting to addr until they disconnect.
+func (h *eventHub) serve(addr string) {
+	l, err := listen("tcp", addr)
+	if err != nil {
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
+	logf("flow events on %s", addr)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logf("failed to accept: %v", err)
+			continue
+		}
+		go h.stream(c)
+	}
+}
+
+func (h *eventHub) stream(c net.Conn) {
+	defer c.Close()
+	ch := make(chan []byte, eventSubscriberQueue)
+	h.Lock()
+	h.subs[ch] = struct{}{}
+	h.Unlock()
+	defer func() {
+		h.Lock()
+		delete(h.subs, ch)
+		h.Unlock()
+	}()
+
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, c) // until the subscriber disconnects
+		close(closed)
+	}()
+	for {
+		select {
+		case b := <-ch:
+			if _, err := c.Write(b); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// fragment returns c, to be used for a TLS handshake with the server, splitting the
+// ClientHello into records of at most config.TLSFragment bytes written apart, so that DPI
+// matching the server name in single records or segments misses it. It returns c as is
+// unless enabled with -tls-fragment.
+func fragment(c net.Conn) net.Conn {
+	if config.TLSFragment <= 0 {
+		return c
+	}
+	return &fragmentConn{Conn: c, size: config.TLSFragment, delay: config.TLSFragmentDelay}
+}
+
+// fragmentConn splits the TLS handshake record first written into records of at most size
+// bytes of data, each written on its own after delay.
+type fragmentConn struct {
+	net.Conn
+	size  int
+	delay time.Duration
+	done  bool
+}
+
+func (c *fragmentConn) Write(b []byte) (int, error) {
+	if c.done {
+		return c.Conn.Write(b)
+	}
+	c.done = true
+	if len(b) < 5 || b[0] != 0x16 || b[1] != 3 { // not a TLS handshake record
+		return c.Conn.Write(b)
+	}
+	end := 5 + (int(b[3])<<8 | int(b[4]))
+	if end > len(b) {
+		return c.Conn.Write(b)
+	}
+	for data := b[5:end]; len(data) > 0; {
+		n := c.size
+		if n > len(data) {
+			n = len(data)
+		}
+		rec := append([]byte{b[0], b[1], b[2], byte(n >> 8), byte(n)}, data[:n]...)
+		if _, err := c.Conn.Write(rec); err != nil {
+			return 0, err
+		}
+		data = data[n:]
+		if len(data) > 0 && c.delay > 0 {
+			time.Sleep(c.delay)
+		}
+	}
+	if end < len(b) {
+		if _, err := c.Conn.Write(b[end:]); err != nil {
+			return end, err
+		}
+	}
+	return len(b), nil
+}
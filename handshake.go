@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/internal"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead2022"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Classes of failed server handshakes. Misconfigured clients mostly fail with wrong-key or
+// bad-address from a few IPs, scanners with truncated, garbage or replay from many.
+const (
+	failEmpty      = "empty"       // closed without sending anything, not a handshake attempt
+	failTruncated  = "truncated"   // closed or cut short before the target address
+	failReplay     = "replay"      // salt or packet seen before
+	failClock      = "clock"       // Shadowsocks 2022 timestamp out of range, replayed or from a client whose clock is off
+	failWrongKey   = "wrong-key"   // authentication failed, as with a client using another key
+	failGarbage    = "garbage"     // authentication failed on what looks like a plaintext protocol
+	failBadAddress = "bad-address" // decrypted, but no valid target address
+	failLegacy     = "legacy"      // legacy stream cipher client, see -detect-legacy
+)
+
+// headSize is the number of leading bytes kept of every handshake to classify failures.
+const headSize = 64
+
+// classifyFailure returns the class of a handshake that failed with err after receiving
+// head, the leading bytes of the connection or packet.
+func classifyFailure(err error, head []byte) string {
+	var ne net.Error
+	switch {
+	case err == io.EOF && len(head) == 0:
+		return failEmpty
+	case errors.Is(err, shadowaead.ErrRepeatedSalt), errors.Is(err, shadowaead2022.ErrRepeatedPacket):
+		return failReplay
+	case errors.Is(err, shadowaead2022.ErrBadTimestamp):
+		return failClock
+	case looksPlaintext(head):
+		return failGarbage
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, shadowaead.ErrShortPacket), errors.As(err, &ne):
+		return failTruncated
+	case errors.Is(err, socks.ErrAddressNotSupported):
+		return failBadAddress
+	}
+	return failWrongKey
+}
+
+var plaintextPrefixes = [][]byte{
+	{0x16, 0x03}, // TLS handshake record
+	[]byte("SSH-"),
+}
+
+// looksPlaintext reports whether head starts like a known protocol or consists of
+// printable ASCII, which a random salt almost never does.
+func looksPlaintext(head []byte) bool {
+	for _, p := range plaintextPrefixes {
+		if bytes.HasPrefix(head, p) {
+			return true
+		}
+	}
+	if len(head) == 0 {
+		return false
+	}
+	for _, b := range head {
+		if (b < 0x20 || b > 0x7e) && b != '\r' && b != '\n' && b != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// detectLegacy reads the rest of what the client sent with the first bytes head and checks
+// whether it is the request header of a legacy stream cipher client using the -password.
+func detectLegacy(c net.Conn, head []byte) (cipher string, ota bool) {
+	b := make([]byte, 1024)
+	n := copy(b, head)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	m, _ := c.Read(b[n:])
+	c.SetReadDeadline(time.Time{})
+	return core.DetectLegacy(config.LegacyPassword, b[:n+m])
+}
+
+// headConn keeps the first headSize bytes read from the embedded net.Conn.
+type headConn struct {
+	net.Conn
+	head []byte
+}
+
+func (c *headConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if k := headSize - len(c.head); k > 0 {
+		if k > n {
+			k = n
+		}
+		c.head = append(c.head, b[:k]...)
+	}
+	return n, err
+}
+
+// failures aggregates failed handshakes by client IP and class.
+var failures = struct {
+	sync.Mutex
+	byIP map[string]map[string]int
+}{byIP: make(map[string]map[string]int)}
+
+const failReportInterval = 10 * time.Minute
+
+// recordFailure counts a failed handshake of class from ip.
+func recordFailure(ip net.IP, class string) {
+	failures.Lock()
+	defer failures.Unlock()
+	key := ip.String()
+	if failures.byIP[key] == nil {
+		failures.byIP[key] = make(map[string]int)
+	}
+	failures.byIP[key][class]++
+}
+
+// reportFailures logs a summary of the worst offenders every failReportInterval.
+func reportFailures() {
+	for range time.Tick(failReportInterval) {
+		logFailures()
+		logSaltFilter()
+	}
+}
+
+// logFailures logs the failures recorded since the last call and resets them.
+func logFailures() {
+	failures.Lock()
+	byIP := failures.byIP
+	failures.byIP = make(map[string]map[string]int)
+	failures.Unlock()
+	if len(byIP) == 0 {
+		return
+	}
+
+	type row struct {
+		ip     string
+		total  int
+		counts string
+	}
+	var rows []row
+	var total, clock, clockIPs int
+	for ip, classes := range byIP {
+		r := row{ip: ip}
+		var cs []string
+		if n := classes[failClock]; n > 0 {
+			clock += n
+			clockIPs++
+		}
+		for class, n := range classes {
+			r.total += n
+			cs = append(cs, fmt.Sprintf("%s=%d", class, n))
+		}
+		sort.Strings(cs)
+		r.counts = strings.Join(cs, " ")
+		total += r.total
+		rows = append(rows, r)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].total > rows[j].total })
+
+	const top = 10
+	logf("%d failed handshakes from %d IPs in the last %v", total, len(rows), failReportInterval)
+	for i, r := range rows {
+		if i == top {
+			logf("  and %d more IPs", len(rows)-top)
+			break
+		}
+		logf("  %s: %s", r.ip, r.counts)
+	}
+	if clock > 0 {
+		logger.Printf("%d handshakes from %d IPs had timestamps more than %v off; check the clocks of these clients or widen -clock-tolerance",
+			clock, clockIPs, shadowaead2022.MaxTimeDiff())
+	}
+}
+
+// logSaltFilter logs the replays the salt filter rejected since the last call and how far
+// back it remembers salts, warning if it forgot salts of less than failReportInterval ago:
+// replays of connections older than that pass, and the filter needs a larger
+// SHADOWSOCKS_SF_CAPACITY.
+func logSaltFilter() {
+	recorded, replays, window, forgot := internal.SaltStats()
+	if window == 0 {
+		return // disabled
+	}
+	logf("salt filter: %d replays rejected, %d salts received in the last %v, remembering salts of the last %v",
+		replays, recorded, failReportInterval, window.Round(time.Second))
+	if forgot && window < failReportInterval {
+		logger.Printf("salt filter only remembers salts of the last %v, raise SHADOWSOCKS_SF_CAPACITY to reject older replays",
+			window.Round(time.Second))
+	}
+}
@@ -0,0 +1,156 @@
+// +build !router
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const (
+	warmTTL     = 30 * time.Second // how long a pre-warmed connection waits to be used
+	warmMax     = 64               // pre-warmed connections kept at most
+	hintsPerReq = 16               // hosts of a request pre-warmed at most
+)
+
+// warmPool holds connections to targets through the server opened ahead of time on hints,
+// e.g. from a browser about the hosts of links on a page, so that connecting to them does
+// not wait for the round trips to the server and from the server to the target.
+type warmPool struct {
+	server string
+	shadow func(net.Conn) net.Conn
+
+	sync.Mutex
+	conns map[string][]warmConn // by target
+	n     int
+}
+
+type warmConn struct {
+	net.Conn
+	expires time.Time
+}
+
+// warm is set on clients with -hints and used by dialTarget before dialing.
+var warm *warmPool
+
+func newWarmPool(server string, shadow func(net.Conn) net.Conn) *warmPool {
+	p := &warmPool{server: server, shadow: shadow, conns: make(map[string][]warmConn)}
+	go func() {
+		for range time.Tick(warmTTL / 3) {
+			p.expire()
+		}
+	}()
+	return p
+}
+
+// Take returns a pre-warmed connection to tgt, or nil if there is none.
+func (p *warmPool) Take(tgt socks.Addr) net.Conn {
+	p.Lock()
+	defer p.Unlock()
+	key := tgt.String()
+	for cs := p.conns[key]; len(cs) > 0; cs = p.conns[key] {
+		c := cs[len(cs)-1]
+		p.remove(key, len(cs)-1)
+		if time.Now().Before(c.expires) {
+			return c.Conn
+		}
+		c.Close()
+	}
+	return nil
+}
+
+// remove removes the i-th connection to key without closing it.
+func (p *warmPool) remove(key string, i int) {
+	cs := p.conns[key]
+	cs = append(cs[:i], cs[i+1:]...)
+	if len(cs) == 0 {
+		delete(p.conns, key)
+	} else {
+		p.conns[key] = cs
+	}
+	p.n--
+}
+
+func (p *warmPool) expire() {
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	for key, cs := range p.conns {
+		for i := len(cs) - 1; i >= 0; i-- {
+			if now.After(cs[i].expires) {
+				cs[i].Close()
+				p.remove(key, i)
+			}
+		}
+	}
+}
+
+// Warm opens a connection to tgt through the server unless one is waiting already.
+func (p *warmPool) Warm(tgt socks.Addr) {
+	key := tgt.String()
+	p.Lock()
+	if len(p.conns[key]) > 0 || p.n >= warmMax {
+		p.Unlock()
+		return
+	}
+	p.n++ // reserved for the connection being opened
+	p.Unlock()
+
+	c, err := dialTarget(p.server, p.shadow, tgt)
+	p.Lock()
+	defer p.Unlock()
+	if err != nil {
+		p.n--
+		logf("failed to pre-warm a connection to %s: %v", tgt, err)
+		return
+	}
+	p.conns[key] = append(p.conns[key], warmConn{c, time.Now().Add(warmTTL)})
+}
+
+// hintsServer accepts hints of hosts to connect to soon on addr: POST requests to /hints
+// with a host or host:port per line, the port defaulting to 443.
+func hintsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hints", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s := bufio.NewScanner(io.LimitReader(r.Body, 64<<10))
+		for n := 0; n < hintsPerReq && s.Scan(); {
+			host := strings.TrimSpace(s.Text())
+			if host == "" {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(host); err != nil {
+				host = net.JoinHostPort(host, "443")
+			}
+			tgt := socks.ParseAddr(host)
+			if tgt == nil || blocked(tgt) {
+				continue
+			}
+			tgt, _ = lookupHosts(tgt)
+			go warm.Warm(tgt)
+			n++
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	l, err := listen("tcp", addr)
+	if err != nil {
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
+	logf("pre-warming hints at http://%s/hints", addr)
+	if err := http.Serve(l, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+		logf("hints server error: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// hosts maps lower-case host names to the IPs given in the file of -hosts.
+var hosts map[string]net.IP
+
+// loadHosts reads static host name to IP mappings from a file in the format of /etc/hosts:
+// an IP followed by one or more host names per line, with comments starting with #.
+func loadHosts(path string) (map[string]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := make(map[string]net.IP)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			m[strings.ToLower(name)] = ip
+		}
+	}
+	return m, s.Err()
+}
+
+// lookupHosts returns addr with its host name replaced by the IP configured for it in hosts.
+// It returns addr and false if addr is not a host name or the host name is not configured.
+func lookupHosts(addr socks.Addr) (socks.Addr, bool) {
+	if len(hosts) == 0 || addr[0] != socks.AtypDomainName {
+		return addr, false
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr, false
+	}
+	ip, ok := hosts[strings.ToLower(strings.TrimSuffix(host, "."))]
+	if !ok {
+		return addr, false
+	}
+	return socks.ParseAddr(net.JoinHostPort(ip.String(), port)), true
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// An inbound accepts client connections of a front-end protocol and learns the target each
+// connection wants to reach, so that all front-ends share the same relay pipeline in tcpLocal.
+// The handshake is separate from Accept so that slow clients do not hold up accepting others.
+type inbound interface {
+	net.Listener
+
+	// Handshake performs the protocol handshake on an accepted connection and returns its target.
+	Handshake(c net.Conn) (socks.Addr, error)
+}
+
+// socksInbound accepts SOCKS5 clients.
+type socksInbound struct{ net.Listener }
+
+func (socksInbound) Handshake(c net.Conn) (socks.Addr, error) { return socks.Handshake(c) }
+
+// tunInbound forwards every connection to a fixed target.
+type tunInbound struct {
+	net.Listener
+	target socks.Addr
+}
+
+func (in tunInbound) Handshake(net.Conn) (socks.Addr, error) { return in.target, nil }
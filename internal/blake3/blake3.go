@@ -0,0 +1,96 @@
+// Package blake3 implements the key derivation mode of BLAKE3 for contexts and key material
+// of up to one block (64 bytes), which is all the Shadowsocks 2022 ciphers need.
+package blake3
+
+import "encoding/binary"
+
+// BlockSize is the maximum length in bytes of the context, key material and derived key.
+const BlockSize = 64
+
+const (
+	chunkStart        = 1 << 0
+	chunkEnd          = 1 << 1
+	root              = 1 << 3
+	deriveKeyContext  = 1 << 5
+	deriveKeyMaterial = 1 << 6
+)
+
+var iv = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A, 0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+// DeriveKey fills out with a key derived from material in the given context, as the
+// derive_key function of BLAKE3. It panics if any of them is longer than BlockSize.
+func DeriveKey(out []byte, context string, material []byte) {
+	if len(out) > BlockSize {
+		panic("blake3: derived key longer than one block")
+	}
+	h := hashBlock(iv, []byte(context), deriveKeyContext)
+	var key [8]uint32
+	copy(key[:], h[:8])
+	h = hashBlock(key, material, deriveKeyMaterial)
+
+	var b [BlockSize]byte
+	for i, w := range h {
+		binary.LittleEndian.PutUint32(b[4*i:], w)
+	}
+	copy(out, b[:])
+}
+
+// hashBlock returns the root output of a single chunk holding the single block in.
+func hashBlock(key [8]uint32, in []byte, flags uint32) [16]uint32 {
+	if len(in) > BlockSize {
+		panic("blake3: input longer than one block")
+	}
+	var block [BlockSize]byte
+	copy(block[:], in)
+	var m [16]uint32
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(block[4*i:])
+	}
+	return compress(key, m, uint32(len(in)), flags|chunkStart|chunkEnd|root)
+}
+
+// compress is the BLAKE3 compression function with a block counter of 0.
+func compress(cv [8]uint32, m [16]uint32, blockLen, flags uint32) [16]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		iv[0], iv[1], iv[2], iv[3], 0, 0, blockLen, flags,
+	}
+	for r := 0; r < 7; r++ {
+		g(&s, 0, 4, 8, 12, m[0], m[1])
+		g(&s, 1, 5, 9, 13, m[2], m[3])
+		g(&s, 2, 6, 10, 14, m[4], m[5])
+		g(&s, 3, 7, 11, 15, m[6], m[7])
+		g(&s, 0, 5, 10, 15, m[8], m[9])
+		g(&s, 1, 6, 11, 12, m[10], m[11])
+		g(&s, 2, 7, 8, 13, m[12], m[13])
+		g(&s, 3, 4, 9, 14, m[14], m[15])
+
+		var p [16]uint32
+		for i, j := range permutation {
+			p[i] = m[j]
+		}
+		m = p
+	}
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+func g(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] += s[b] + mx
+	s[d] = rotr(s[d]^s[a], 16)
+	s[c] += s[d]
+	s[b] = rotr(s[b]^s[c], 12)
+	s[a] += s[b] + my
+	s[d] = rotr(s[d]^s[a], 8)
+	s[c] += s[d]
+	s[b] = rotr(s[b]^s[c], 7)
+}
+
+func rotr(x uint32, n uint) uint32 { return x>>n | x<<(32-n) }
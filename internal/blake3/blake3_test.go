@@ -0,0 +1,37 @@
+package blake3
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// Official BLAKE3 test vectors for derive_key, truncated to one block.
+var vectors = []struct {
+	inputLen int
+	key      string
+}{
+	{0, "2cc39783c223154fea8dfb7c1b1660f2ac2dcbd1c1de8277b0b0dd39b7e50d7d905630c8be290dfcf3e6842f13bddd573c098c3f17361f1f206b8cad9d088aa4"},
+	{1, "b3e2e340a117a499c6cf2398a19ee0d29cca2bb7404c73063382693bf66cb06c5827b91bf889b6b97c5477f535361caefca0b5d8c4746441c576171119331589"},
+	{63, "b6451e30b953c206e34644c6803724e9d2725e0893039cfc49584f991f451af3b89e8ff572d3da4f4022199b9563b9d70ebb616efff0763e9abec71b550f1371"},
+	{64, "a5c4a7053fa86b64746d4bb688d06ad1f02a18fce9afd3e818fefaa7126bf73e9b9493a9befebe0bf0c9509fb3105cfa0e262cde141aa8e3f2c2f77890bb64a4"},
+}
+
+func TestDeriveKey(t *testing.T) {
+	const context = "BLAKE3 2019-12-27 16:29:52 test vectors context"
+	for _, v := range vectors {
+		in := make([]byte, v.inputLen)
+		for i := range in {
+			in[i] = byte(i % 251)
+		}
+		out := make([]byte, BlockSize)
+		DeriveKey(out, context, in)
+		if got := hex.EncodeToString(out); got != v.key {
+			t.Errorf("DeriveKey(%d bytes) = %s, want %s", v.inputLen, got, v.key)
+		}
+		short := make([]byte, 32)
+		DeriveKey(short, context, in)
+		if got := hex.EncodeToString(short); got != v.key[:64] {
+			t.Errorf("DeriveKey(%d bytes) to 32 bytes = %s, want %s", v.inputLen, got, v.key[:64])
+		}
+	}
+}
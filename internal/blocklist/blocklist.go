@@ -0,0 +1,252 @@
+// Package blocklist compiles lists of blocked domains and IP ranges into a compact binary
+// form that is looked up in place, memory-mapped where supported, so that lists of millions
+// of entries cost little more resident memory than the pages touched by lookups.
+//
+// A compiled list is
+//
+//	[magic "SSBL"][version, uint32][domains, uint32][IPv4 ranges, uint32][IPv6 ranges, uint32]
+//	[domain hashes, 8 bytes each][IPv4 ranges, 8 bytes each][IPv6 ranges, 32 bytes each]
+//
+// with integers big-endian. Domains are stored as sorted 64-bit FNV-1a hashes of their
+// lower-case names, so a name not in the list matches with a chance of about one in 2^64
+// per entry. IP ranges are stored as sorted and merged pairs of their first and last
+// addresses.
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	version    = 1
+	headerSize = 20
+	v4Size     = 2 * net.IPv4len // of a range
+	v6Size     = 2 * net.IPv6len
+)
+
+var magic = []byte("SSBL")
+
+// ErrFormat is returned by Open for files that are not compiled lists.
+var ErrFormat = errors.New("blocklist: not a compiled list")
+
+// Compile reads a list from r and writes its compiled form to w. Each line of the list holds
+// a domain, blocking it and its subdomains, an IP or a CIDR, with comments starting with #.
+// Lines in the format of hosts files, such as "0.0.0.0 ads.example.com", block the names.
+// It returns the number of domains and IP ranges written.
+func Compile(w io.Writer, r io.Reader) (domains, ranges int, err error) {
+	var names []uint64
+	var v4, v6 [][2][]byte
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case len(fields) > 1 && net.ParseIP(fields[0]) != nil: // hosts file
+			for _, name := range fields[1:] {
+				names = append(names, hash(name))
+			}
+			continue
+		}
+		entry := fields[0]
+		if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			first, last := ipnet.IP, make(net.IP, len(ipnet.IP))
+			for i := range last {
+				last[i] = first[i] | ^ipnet.Mask[i]
+			}
+			v4, v6 = addRange(v4, v6, first, last)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			v4, v6 = addRange(v4, v6, ip, ip)
+		} else {
+			names = append(names, hash(strings.TrimPrefix(entry, "*.")))
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	names = dedup(names)
+	v4, v6 = merge(v4), merge(v6)
+
+	bw := bufio.NewWriter(w)
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	binary.BigEndian.PutUint32(header[4:], version)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(names)))
+	binary.BigEndian.PutUint32(header[12:], uint32(len(v4)))
+	binary.BigEndian.PutUint32(header[16:], uint32(len(v6)))
+	bw.Write(header)
+	var b [8]byte
+	for _, h := range names {
+		binary.BigEndian.PutUint64(b[:], h)
+		bw.Write(b[:])
+	}
+	for _, r := range append(v4, v6...) {
+		bw.Write(r[0])
+		bw.Write(r[1])
+	}
+	return len(names), len(v4) + len(v6), bw.Flush()
+}
+
+// hash returns the hash of the domain name.
+func hash(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(strings.Trim(name, "."))))
+	return h.Sum64()
+}
+
+func dedup(s []uint64) []uint64 {
+	out := s[:0]
+	for i, h := range s {
+		if i == 0 || h != s[i-1] {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// addRange adds the range from first to last to the IPv4 or IPv6 ranges.
+func addRange(v4, v6 [][2][]byte, first, last net.IP) ([][2][]byte, [][2][]byte) {
+	if f4, l4 := first.To4(), last.To4(); f4 != nil && l4 != nil {
+		return append(v4, [2][]byte{f4, l4}), v6
+	}
+	return v4, append(v6, [2][]byte{first.To16(), last.To16()})
+}
+
+// merge sorts ranges and merges those overlapping or adjacent.
+func merge(ranges [][2][]byte) [][2][]byte {
+	sort.Slice(ranges, func(i, j int) bool { return bytes.Compare(ranges[i][0], ranges[j][0]) < 0 })
+	var out [][2][]byte
+	for _, r := range ranges {
+		if n := len(out); n > 0 && bytes.Compare(r[0], next(out[n-1][1])) <= 0 {
+			if bytes.Compare(r[1], out[n-1][1]) > 0 {
+				out[n-1][1] = r[1]
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// next returns the address following ip, or ip if it is the last address.
+func next(ip []byte) []byte {
+	n := append([]byte(nil), ip...)
+	for i := len(n) - 1; i >= 0; i-- {
+		if n[i]++; n[i] != 0 {
+			return n
+		}
+	}
+	return ip
+}
+
+// List is a compiled list opened for lookups.
+type List struct {
+	close    func() error
+	domains  []byte
+	v4, v6   []byte
+	nDomains int
+	nV4, nV6 int
+}
+
+// Open opens the compiled list at path.
+func Open(path string) (*List, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, closeFn, err := mapFile(f)
+	if err != nil {
+		return nil, err
+	}
+	l, err := parse(data)
+	if err != nil {
+		closeFn()
+		return nil, err
+	}
+	l.close = closeFn
+	return l, nil
+}
+
+// parse returns the list compiled into data.
+func parse(data []byte) (*List, error) {
+	if len(data) < headerSize || !bytes.Equal(data[:4], magic) || binary.BigEndian.Uint32(data[4:]) != version {
+		return nil, ErrFormat
+	}
+	l := &List{
+		nDomains: int(binary.BigEndian.Uint32(data[8:])),
+		nV4:      int(binary.BigEndian.Uint32(data[12:])),
+		nV6:      int(binary.BigEndian.Uint32(data[16:])),
+	}
+	end4 := headerSize + 8*l.nDomains + v4Size*l.nV4
+	if end4+v6Size*l.nV6 != len(data) {
+		return nil, ErrFormat
+	}
+	l.domains = data[headerSize : headerSize+8*l.nDomains]
+	l.v4 = data[headerSize+8*l.nDomains : end4]
+	l.v6 = data[end4:]
+	return l, nil
+}
+
+// Len returns the number of domains and IP ranges of the list.
+func (l *List) Len() (domains, ranges int) { return l.nDomains, l.nV4 + l.nV6 }
+
+// BlocksHost reports whether host or a domain it is a subdomain of is in the list.
+func (l *List) BlocksHost(host string) bool {
+	host = strings.ToLower(strings.Trim(host, "."))
+	for host != "" {
+		if l.hasHash(hash(host)) {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return false
+}
+
+func (l *List) hasHash(h uint64) bool {
+	i := sort.Search(l.nDomains, func(i int) bool {
+		return binary.BigEndian.Uint64(l.domains[8*i:]) >= h
+	})
+	return i < l.nDomains && binary.BigEndian.Uint64(l.domains[8*i:]) == h
+}
+
+// BlocksIP reports whether ip is in a range of the list.
+func (l *List) BlocksIP(ip net.IP) bool {
+	ranges, n, size := l.v6, l.nV6, v6Size
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, ranges, n, size = ip4, l.v4, l.nV4, v4Size
+	} else if ip = ip.To16(); ip == nil {
+		return false
+	}
+	// the first range starting after ip follows the only one that may hold it
+	i := sort.Search(n, func(i int) bool {
+		return bytes.Compare(ranges[size*i:size*i+len(ip)], ip) > 0
+	})
+	if i == 0 {
+		return false
+	}
+	last := ranges[size*(i-1)+len(ip) : size*i]
+	return bytes.Compare(ip, last) <= 0
+}
+
+// Close releases the list, which must not be used afterwards.
+func (l *List) Close() error { return l.close() }
@@ -0,0 +1,84 @@
+package blocklist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const list = `# ads
+ads.example.com
+*.tracker.example.net
+0.0.0.0 Telemetry.Example.org metrics.example.org # hosts file
+10.0.0.0/8
+10.1.0.0/16
+192.0.2.7
+192.0.2.8
+2001:db8::/32
+`
+
+func TestCompileOpen(t *testing.T) {
+	var b bytes.Buffer
+	domains, ranges, err := Compile(&b, strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domains != 4 || ranges != 3 {
+		t.Fatalf("compiled %d domains and %d ranges", domains, ranges)
+	}
+	path := filepath.Join(t.TempDir(), "list.bin")
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for host, want := range map[string]bool{
+		"ads.example.com":       true,
+		"cdn.ads.example.com.":  true,
+		"example.com":           false,
+		"notads.example.com":    false,
+		"a.tracker.example.net": true,
+		"telemetry.example.org": true,
+		"example.org":           false,
+	} {
+		if got := l.BlocksHost(host); got != want {
+			t.Errorf("BlocksHost(%q) = %v", host, got)
+		}
+	}
+	for ip, want := range map[string]bool{
+		"10.255.255.255":  true,
+		"11.0.0.0":        false,
+		"192.0.2.7":       true,
+		"192.0.2.8":       true,
+		"192.0.2.9":       false,
+		"::ffff:10.0.0.1": true,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+		"::1":             false,
+	} {
+		if got := l.BlocksIP(net.ParseIP(ip)); got != want {
+			t.Errorf("BlocksIP(%s) = %v", ip, got)
+		}
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	if err := ioutil.WriteFile(path, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err != ErrFormat {
+		t.Fatalf("Open = %v", err)
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Fatalf("Open = %v", err)
+	}
+}
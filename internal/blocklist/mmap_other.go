@@ -0,0 +1,17 @@
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package blocklist
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// mapFile reads f into memory, as it cannot be memory-mapped on this platform.
+func mapFile(f *os.File) ([]byte, func() error, error) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
@@ -0,0 +1,24 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package blocklist
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps f into memory read-only, returning the mapping and a function unmapping it.
+func mapFile(f *os.File) ([]byte, func() error, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.Size() < headerSize || int64(int(fi.Size())) != fi.Size() {
+		return nil, nil, ErrFormat
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"hash/fnv"
 	"sync"
+	"time"
 
 	"github.com/riobard/go-bloom"
 )
@@ -24,6 +25,8 @@ type BloomRing struct {
 	slotCount    int
 	entryCounter int
 	slots        []bloom.Filter
+	resets       []time.Time // when each slot was last cleared, or the ring created
+	cleared      []bool      // whether each slot was cleared
 	mutex        sync.RWMutex
 }
 
@@ -33,9 +36,13 @@ func NewBloomRing(slot, capacity int, falsePositiveRate float64) *BloomRing {
 		slotCapacity: capacity / slot,
 		slotCount:    slot,
 		slots:        make([]bloom.Filter, slot),
+		resets:       make([]time.Time, slot),
+		cleared:      make([]bool, slot),
 	}
+	now := time.Now()
 	for i := 0; i < slot; i++ {
 		r.slots[i] = bloom.New(r.slotCapacity, falsePositiveRate, doubleFNV)
+		r.resets[i] = now
 	}
 	return r
 }
@@ -56,6 +63,8 @@ func (r *BloomRing) add(b []byte) {
 		r.slotPosition = (r.slotPosition + 1) % r.slotCount
 		slot = r.slots[r.slotPosition]
 		slot.Reset()
+		r.resets[r.slotPosition] = time.Now()
+		r.cleared[r.slotPosition] = true
 		r.entryCounter = 0
 	}
 	r.entryCounter++
@@ -81,12 +90,30 @@ func (r *BloomRing) test(b []byte) bool {
 	return false
 }
 
+// Check reports whether b is in the ring, adding it if not.
 func (r *BloomRing) Check(b []byte) bool {
+	if r == nil {
+		return false
+	}
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	if r.Test(b) {
+	if r.test(b) {
 		return true
 	}
-	r.Add(b)
+	r.add(b)
 	return false
 }
+
+// Window returns how long ago the oldest entries remembered were added: entries added since
+// then are all found. It shrinks as entries are added faster. Forgot reports whether older
+// entries were forgotten already, rather than the ring remembering all added.
+func (r *BloomRing) Window() (window time.Duration, forgot bool) {
+	if r == nil {
+		return 0, false
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	// the slot after the current one is the next to be cleared, holding the oldest entries
+	next := (r.slotPosition + 1) % r.slotCount
+	return time.Since(r.resets[next]), r.cleared[next]
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/shadowsocks/go-shadowsocks2/internal"
 )
@@ -83,3 +84,27 @@ func benchmarkBloomRing(samples, checkPoints [][]byte, slot int) func(*testing.B
 		}
 	}
 }
+
+func TestBloomRing_Check(t *testing.T) {
+	r := internal.NewBloomRing(2, 10, internal.DefaultSFFPR)
+	salt := []byte("salt")
+	if r.Check(salt) {
+		t.Fatal("new salt found")
+	}
+	if !r.Check(salt) {
+		t.Fatal("salt checked before not found")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if w, forgot := r.Window(); w < 20*time.Millisecond || forgot {
+		t.Fatalf("window %v (forgot %v) of a ring not rotated yet", w, forgot)
+	}
+	for i := 0; i < 20; i++ {
+		r.Add([]byte(fmt.Sprint(i)))
+	}
+	if r.Test(salt) {
+		t.Fatal("salt found after its slot was cleared")
+	}
+	if w, forgot := r.Window(); w >= 20*time.Millisecond || !forgot {
+		t.Fatalf("window %v (forgot %v) after rotating", w, forgot)
+	}
+}
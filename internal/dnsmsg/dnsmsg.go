@@ -0,0 +1,174 @@
+// Package dnsmsg builds DNS queries and extracts answers from responses (RFC 1035),
+// as far as needed to resolve names through the tunnel.
+package dnsmsg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Resource record types.
+const (
+	TypeA    = 1
+	TypePTR  = 12
+	TypeAAAA = 28
+)
+
+const classINET = 1
+
+var errFormat = errors.New("malformed DNS message")
+
+// RcodeError is a response code other than success.
+type RcodeError int
+
+func (e RcodeError) Error() string {
+	switch e {
+	case 2:
+		return "DNS server failure"
+	case 3:
+		return "no such host"
+	case 5:
+		return "DNS query refused"
+	}
+	return fmt.Sprintf("DNS response code %d", int(e))
+}
+
+// Query returns a recursive query with the given ID for records of type qtype of name.
+func Query(id uint16, name string, qtype uint16) ([]byte, error) {
+	b := make([]byte, 12, 12+len(name)+6)
+	binary.BigEndian.PutUint16(b[0:], id)
+	b[2] = 1                             // RD: recursion desired
+	binary.BigEndian.PutUint16(b[4:], 1) // QDCOUNT
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid DNS name %q", name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0, byte(qtype>>8), byte(qtype), 0, classINET)
+	return b, nil
+}
+
+// ReverseName returns the name to query PTR records of ip at.
+func ReverseName(ip net.IP) string {
+	var sb strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			fmt.Fprintf(&sb, "%d.", ip4[i])
+		}
+		sb.WriteString("in-addr.arpa.")
+		return sb.String()
+	}
+	const hex = "0123456789abcdef"
+	ip = ip.To16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		sb.WriteByte(hex[ip[i]&0xf])
+		sb.WriteByte('.')
+		sb.WriteByte(hex[ip[i]>>4])
+		sb.WriteByte('.')
+	}
+	sb.WriteString("ip6.arpa.")
+	return sb.String()
+}
+
+// Answer is a resource record of the answer section.
+type Answer struct {
+	Type uint16
+	TTL  uint32
+	IP   net.IP // for A and AAAA records
+	Name string // for PTR records
+}
+
+// Answers returns the answers in the response msg to the query with the given ID.
+func Answers(msg []byte, id uint16) ([]Answer, error) {
+	if len(msg) < 12 {
+		return nil, errFormat
+	}
+	if binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return nil, errors.New("DNS response does not match query")
+	}
+	if rcode := msg[3] & 0xf; rcode != 0 {
+		return nil, RcodeError(rcode)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, n, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n + 4 // QTYPE, QCLASS
+	}
+	var answers []Answer
+	for i := 0; i < ancount; i++ {
+		_, n, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+		if off+10 > len(msg) {
+			return nil, errFormat
+		}
+		a := Answer{Type: binary.BigEndian.Uint16(msg[off:]), TTL: binary.BigEndian.Uint32(msg[off+4:])}
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, errFormat
+		}
+		rdata := msg[off : off+rdlen]
+		switch {
+		case a.Type == TypeA && rdlen == net.IPv4len, a.Type == TypeAAAA && rdlen == net.IPv6len:
+			a.IP = net.IP(append([]byte{}, rdata...))
+		case a.Type == TypePTR:
+			if a.Name, _, err = readName(msg, off); err != nil {
+				return nil, err
+			}
+		}
+		answers = append(answers, a)
+		off += rdlen
+	}
+	return answers, nil
+}
+
+// readName reads the possibly compressed name at off in msg and returns it with the
+// offset following it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1 // offset following the name, set at the first pointer
+	for hops := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errFormat
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0: // pointer
+			if off+1 >= len(msg) || hops > 10 {
+				return "", 0, errFormat
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			hops++
+		case n > 63:
+			return "", 0, errFormat
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errFormat
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package dnsmsg
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAnswers(t *testing.T) {
+	q, err := Query(0x1234, "4.3.2.1.in-addr.arpa.", TypePTR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := append([]byte{}, q...)
+	resp[2] |= 0x80               // QR: response
+	resp[7] = 1                   // ANCOUNT
+	resp = append(resp, 0xc0, 12) // name: pointer to the question
+	resp = append(resp, 0, TypePTR, 0, classINET, 0, 0, 0, 60, 0, 7)
+	resp = append(resp, 4, 'h', 'o', 's', 't', 0xc0, 12+4) // "host." followed by "2.1.in-addr.arpa."
+
+	answers, err := Answers(resp, 0x1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 1 || answers[0].Name != "host.2.1.in-addr.arpa." || answers[0].TTL != 60 {
+		t.Fatalf("Answers() = %+v", answers)
+	}
+	if _, err := Answers(resp, 0x4321); err == nil {
+		t.Error("Answers() accepted a response to another query")
+	}
+	if _, err := Answers(resp[:len(resp)-1], 0x1234); err == nil {
+		t.Error("Answers() accepted a truncated response")
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	for ip, want := range map[string]string{
+		"1.2.3.4":     "4.3.2.1.in-addr.arpa.",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+	} {
+		if got := ReverseName(net.ParseIP(ip)); got != want {
+			t.Errorf("ReverseName(%s) = %s, want %s", ip, got, want)
+		}
+	}
+}
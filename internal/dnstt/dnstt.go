@@ -0,0 +1,118 @@
+// Package dnstt tunnels a stream in DNS queries and responses, for networks blocking all
+// but DNS through their resolvers. The client encodes data in the names of TXT queries
+// under a domain delegated to the server, which answers with data in TXT records. As only
+// the client can send, it polls the server while waiting for data, as implemented by the
+// pollconn package.
+//
+// The name of a query is the base32 encoding, split into labels, of
+//
+//	[nonce, 2 bytes][session ID, 8 bytes][payload]
+//
+// followed by the domain, and the TXT record of the response holds the payload of the
+// response. The server answers queries not of a session with name error.
+//
+// A round trip through the resolver carries a hundred bytes or so from the client and up
+// to a kilobyte from the server, which makes it an emergency transport of last resort.
+package dnstt
+
+import (
+	"crypto/rand"
+	mrand "math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/pollconn"
+)
+
+const (
+	upHeader     = 10              // nonce and session ID
+	queryTimeout = 2 * time.Second // before a query is sent again
+)
+
+// Dial opens a session through pc, a UDP socket connected to a resolver or the server,
+// with the server for domain.
+func Dial(pc net.Conn, domain string) net.Conn {
+	c := &carrier{Conn: pc, domain: strings.ToLower(strings.Trim(domain, "."))}
+	rand.Read(c.id[:])
+	return pollconn.Dial(c, nameCapacity(c.domain)-upHeader-pollconn.Header)
+}
+
+// carrier sends the payloads of a session in queries through the UDP socket it embeds.
+type carrier struct {
+	net.Conn
+	domain string
+	id     [8]byte
+}
+
+// Exchange sends a query carrying payload and returns the payload of the response.
+func (c *carrier) Exchange(payload []byte) ([]byte, error) {
+	up := make([]byte, upHeader, upHeader+len(payload))
+	rand.Read(up[:2])
+	copy(up[2:], c.id[:])
+	up = append(up, payload...)
+
+	id := uint16(mrand.Intn(1 << 16))
+	if _, err := c.Write(buildQuery(id, encodeName(up, c.domain))); err != nil {
+		return nil, err
+	}
+	c.SetReadDeadline(time.Now().Add(queryTimeout))
+	buf := make([]byte, ednsSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp, ok, err := parseResponse(buf[:n], id)
+		if ok {
+			return resp, err
+		}
+	}
+}
+
+// Listener accepts the sessions of clients from DNS queries for domain.
+type Listener struct {
+	pc     net.PacketConn
+	domain string
+	server *pollconn.Server
+}
+
+// Listen serves the sessions of clients from the DNS queries arriving at pc for domain.
+func Listen(pc net.PacketConn, domain string) *Listener {
+	l := &Listener{
+		pc:     pc,
+		domain: strings.ToLower(strings.Trim(domain, ".")),
+		server: pollconn.NewServer(pc.LocalAddr()),
+	}
+	go l.serve()
+	return l
+}
+
+// Accept waits for and returns the next session.
+func (l *Listener) Accept() (net.Conn, error) { return l.server.Accept() }
+
+// Close closes the listener and pc, failing all sessions.
+func (l *Listener) Close() error { return l.pc.Close() }
+
+// Addr returns the address of pc.
+func (l *Listener) Addr() net.Addr { return l.pc.LocalAddr() }
+
+func (l *Listener) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.server.Close(err)
+			return
+		}
+		q, err := parseQuery(buf[:n])
+		if err != nil {
+			continue
+		}
+		var payload []byte // name error for queries not of a session
+		if up, ok := decodeName(q.name, l.domain); ok && q.txt && len(up) >= upHeader+pollconn.Header {
+			payload = l.server.Handle(string(up[2:upHeader]), up[upHeader:], q.capacity()-pollconn.Header, addr)
+		}
+		l.pc.WriteTo(q.response(payload), addr)
+	}
+}
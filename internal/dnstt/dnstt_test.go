@@ -0,0 +1,80 @@
+package dnstt
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+const testDomain = "t.example.com"
+
+func TestName(t *testing.T) {
+	payload := make([]byte, nameCapacity(testDomain))
+	rand.Read(payload)
+	name := encodeName(payload, testDomain)
+	if len(name)+2 > maxName {
+		t.Fatalf("name of %d bytes", len(name)+2)
+	}
+	q, err := parseQuery(buildQuery(1, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := decodeName(q.name, testDomain); !ok || !bytes.Equal(got, payload) {
+		t.Fatalf("decodeName = %x, %v", got, ok)
+	}
+	if _, ok := decodeName("www.example.com", testDomain); ok {
+		t.Fatal("decodeName accepted a name not under the domain")
+	}
+
+	// the response fits and carries the payload
+	down := make([]byte, q.capacity())
+	rand.Read(down)
+	resp := q.response(down)
+	if len(resp) > ednsSize {
+		t.Fatalf("response of %d bytes", len(resp))
+	}
+	if got, ok, err := parseResponse(resp, 1); !ok || err != nil || !bytes.Equal(got, down) {
+		t.Fatalf("parseResponse = %v, %v", ok, err)
+	}
+	if _, ok, _ := parseResponse(resp, 2); ok {
+		t.Fatal("parseResponse took the response to another query")
+	}
+}
+
+func TestSession(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := Listen(pc, testDomain)
+	defer l.Close()
+	uc, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Dial(uc, testDomain+".")
+
+	up := make([]byte, 2000)
+	rand.Read(up)
+	go c.Write(up)
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(up))
+	if _, err := io.ReadFull(s, got); err != nil || !bytes.Equal(got, up) {
+		t.Fatalf("server read: %v", err)
+	}
+
+	down := make([]byte, 5000)
+	rand.Read(down)
+	s.Write(down)
+	s.Close()
+	if got, err := ioutil.ReadAll(c); err != nil || !bytes.Equal(got, down) {
+		t.Fatalf("client read %d bytes: %v", len(got), err)
+	}
+	c.Close()
+}
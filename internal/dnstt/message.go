@@ -0,0 +1,248 @@
+package dnstt
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	typeTXT   = 16
+	typeOPT   = 41
+	classIN   = 1
+	ednsSize  = 1232 // UDP payload size offered and accepted at most, avoiding fragmentation
+	minSize   = 512  // UDP payload size without EDNS
+	maxName   = 255  // bytes of a name in wire format
+	rcodeNX   = 3
+	queryHead = 12
+)
+
+var errFormat = errors.New("dnstt: malformed DNS message")
+
+// encoding encodes the payload of queries in names, which resolvers may change the case of.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// encodeName returns the name carrying payload under domain, which has no trailing dot.
+func encodeName(payload []byte, domain string) string {
+	s := strings.ToLower(encoding.EncodeToString(payload))
+	var labels []string
+	for len(s) > 63 {
+		labels = append(labels, s[:63])
+		s = s[63:]
+	}
+	labels = append(labels, s, domain)
+	return strings.Join(labels, ".")
+}
+
+// decodeName returns the payload of name, or false if name is not under domain.
+func decodeName(name, domain string) ([]byte, bool) {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, "."+domain) {
+		return nil, false
+	}
+	s := strings.ReplaceAll(strings.TrimSuffix(name, "."+domain), ".", "")
+	b, err := encoding.DecodeString(strings.ToUpper(s))
+	return b, err == nil
+}
+
+// nameCapacity returns how many bytes of payload fit into a name under domain.
+func nameCapacity(domain string) int {
+	avail := maxName - (len(domain) + 2) // the labels of domain and the root
+	chars := avail / 64 * 63
+	if r := avail % 64; r > 1 {
+		chars += r - 1
+	}
+	return chars * 5 / 8
+}
+
+// buildQuery returns a recursive query for the TXT records of name, offering EDNS.
+func buildQuery(id uint16, name string) []byte {
+	b := make([]byte, queryHead, queryHead+len(name)+2+4+11)
+	binary.BigEndian.PutUint16(b[0:], id)
+	b[2] = 1                              // RD: recursion desired
+	binary.BigEndian.PutUint16(b[4:], 1)  // QDCOUNT
+	binary.BigEndian.PutUint16(b[10:], 1) // ARCOUNT
+	for _, label := range strings.Split(name, ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0, 0, typeTXT, 0, classIN)
+	return append(b, 0, 0, typeOPT, ednsSize>>8, ednsSize&0xff, 0, 0, 0, 0, 0, 0)
+}
+
+// query is a query received by the server.
+type query struct {
+	id       uint16
+	question []byte // name, type and class
+	name     string
+	txt      bool // asks for TXT records
+	size     int  // UDP payload size the response may take
+	edns     bool
+}
+
+// parseQuery parses the query msg, whose name must not be compressed.
+func parseQuery(msg []byte) (*query, error) {
+	if len(msg) < queryHead || msg[2]&0x80 != 0 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil, errFormat
+	}
+	q := &query{id: binary.BigEndian.Uint16(msg), size: minSize}
+	var labels []string
+	off := queryHead
+	for {
+		if off >= len(msg) {
+			return nil, errFormat
+		}
+		n := int(msg[off])
+		if n == 0 {
+			off++
+			break
+		}
+		if n > 63 || off+1+n > len(msg) {
+			return nil, errFormat
+		}
+		labels = append(labels, string(msg[off+1:off+1+n]))
+		off += 1 + n
+	}
+	if off+4 > len(msg) {
+		return nil, errFormat
+	}
+	q.name = strings.Join(labels, ".")
+	q.txt = binary.BigEndian.Uint16(msg[off:]) == typeTXT
+	off += 4
+	q.question = msg[queryHead:off]
+
+	// an OPT record in the additional section gives the UDP payload size
+	if binary.BigEndian.Uint16(msg[10:]) > 0 && off+11 <= len(msg) && msg[off] == 0 &&
+		binary.BigEndian.Uint16(msg[off+1:]) == typeOPT {
+		q.edns = true
+		if size := int(binary.BigEndian.Uint16(msg[off+3:])); size > minSize {
+			q.size = size
+		}
+		if q.size > ednsSize {
+			q.size = ednsSize
+		}
+	}
+	return q, nil
+}
+
+// capacity returns how many bytes of payload fit into the TXT record of a response to q.
+func (q *query) capacity() int {
+	n := q.size - queryHead - len(q.question) - 12 // answer: pointer, type, class, TTL, length
+	if q.edns {
+		n -= 11
+	}
+	return n - (n+255)/256 // length bytes of the strings
+}
+
+// response returns the response to q with payload in a TXT record, or with name error if
+// payload is nil.
+func (q *query) response(payload []byte) []byte {
+	b := make([]byte, queryHead, q.size)
+	binary.BigEndian.PutUint16(b[0:], q.id)
+	b[2] = 0x85 // QR, AA, RD
+	binary.BigEndian.PutUint16(b[4:], 1)
+	if payload == nil {
+		b[3] = rcodeNX
+	} else {
+		binary.BigEndian.PutUint16(b[6:], 1)
+	}
+	if q.edns {
+		binary.BigEndian.PutUint16(b[10:], 1)
+	}
+	b = append(b, q.question...)
+	if payload != nil {
+		rdlen := len(payload) + (len(payload)+254)/255
+		if len(payload) == 0 {
+			rdlen = 1 // a TXT record has at least one string
+		}
+		b = append(b, 0xc0, queryHead, 0, typeTXT, 0, classIN, 0, 0, 0, 0, byte(rdlen>>8), byte(rdlen))
+		if len(payload) == 0 {
+			b = append(b, 0)
+		}
+		for len(payload) > 0 {
+			n := len(payload)
+			if n > 255 {
+				n = 255
+			}
+			b = append(b, byte(n))
+			b = append(b, payload[:n]...)
+			payload = payload[n:]
+		}
+	}
+	if q.edns {
+		b = append(b, 0, 0, typeOPT, ednsSize>>8, ednsSize&0xff, 0, 0, 0, 0, 0, 0)
+	}
+	return b
+}
+
+// parseResponse returns the concatenated strings of the first TXT record in the response
+// msg to the query with the given ID, or false if msg responds to another query.
+func parseResponse(msg []byte, id uint16) ([]byte, bool, error) {
+	if len(msg) < queryHead || binary.BigEndian.Uint16(msg) != id {
+		return nil, false, nil
+	}
+	if msg[2]&0x80 == 0 {
+		return nil, false, errFormat
+	}
+	if rcode := msg[3] & 0x0f; rcode != 0 {
+		return nil, true, fmt.Errorf("dnstt: DNS response code %d", rcode)
+	}
+	off := queryHead
+	for i := binary.BigEndian.Uint16(msg[4:]); i > 0; i-- {
+		var err error
+		if off, err = skipName(msg, off); err != nil {
+			return nil, true, err
+		}
+		off += 4
+	}
+	for i := binary.BigEndian.Uint16(msg[6:]); i > 0; i-- {
+		var err error
+		if off, err = skipName(msg, off); err != nil {
+			return nil, true, err
+		}
+		if off+10 > len(msg) {
+			return nil, true, errFormat
+		}
+		typ, rdlen := binary.BigEndian.Uint16(msg[off:]), int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, true, errFormat
+		}
+		if typ != typeTXT {
+			off += rdlen
+			continue
+		}
+		var payload []byte
+		for rd := msg[off : off+rdlen]; len(rd) > 0; {
+			n := int(rd[0])
+			if 1+n > len(rd) {
+				return nil, true, errFormat
+			}
+			payload = append(payload, rd[1:1+n]...)
+			rd = rd[1+n:]
+		}
+		return payload, true, nil
+	}
+	return nil, true, errFormat
+}
+
+// skipName returns the offset following the possibly compressed name at off in msg.
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errFormat
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			return off + 2, nil
+		case n > 63:
+			return 0, errFormat
+		}
+		off += 1 + n
+	}
+}
@@ -0,0 +1,199 @@
+// Package gcmsiv implements AES-GCM-SIV (RFC 8452), an AEAD that stays secure when a nonce is
+// reused with the same key, except for revealing whether the messages were equal. Its
+// POLYVAL is computed bit by bit in constant time, without hardware support, making it far
+// slower than AES-GCM, at tens of MB/s per core.
+package gcmsiv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// NonceSize is the size of nonces.
+	NonceSize = 12
+
+	tagSize   = 16
+	blockSize = 16
+
+	// maxSize is the maximum size of plaintexts and additional data, 2^36 bytes.
+	maxSize = 1 << 36
+)
+
+var errOpen = errors.New("gcmsiv: message authentication failed")
+
+type aead struct {
+	block  cipher.Block // with the key-generating key
+	keyLen int
+}
+
+// New returns AES-GCM-SIV with the given key of 16 or 32 bytes, for AEAD_AES_128_GCM_SIV or
+// AEAD_AES_256_GCM_SIV.
+func New(key []byte) (cipher.AEAD, error) {
+	if l := len(key); l != 16 && l != 32 {
+		return nil, aes.KeySizeError(l)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aead{block: block, keyLen: len(key)}, nil
+}
+
+func (a *aead) NonceSize() int { return NonceSize }
+func (a *aead) Overhead() int  { return tagSize }
+
+// keys derives the message authentication and encryption keys for nonce.
+func (a *aead) keys(nonce []byte) (authKey [16]byte, enc cipher.Block) {
+	var in, out [blockSize]byte
+	copy(in[4:], nonce)
+	material := make([]byte, 0, 16+a.keyLen)
+	for i := uint32(0); len(material) < cap(material); i++ {
+		binary.LittleEndian.PutUint32(in[:4], i)
+		a.block.Encrypt(out[:], in[:])
+		material = append(material, out[:8]...)
+	}
+	copy(authKey[:], material[:16])
+	enc, _ = aes.NewCipher(material[16:])
+	return authKey, enc
+}
+
+// tag computes the tag of plaintext and additional data.
+func tag(authKey [16]byte, enc cipher.Block, nonce, plaintext, additionalData []byte) [tagSize]byte {
+	p := newPolyval(authKey)
+	p.update(additionalData)
+	p.update(plaintext)
+	var lengths [blockSize]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(additionalData))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plaintext))*8)
+	p.update(lengths[:])
+
+	s := p.sum()
+	for i := range nonce {
+		s[i] ^= nonce[i]
+	}
+	s[15] &= 0x7f
+	var t [tagSize]byte
+	enc.Encrypt(t[:], s[:])
+	return t
+}
+
+// ctr XORs src with the key stream of enc starting at the counter block of tag into dst.
+func ctr(enc cipher.Block, tag [tagSize]byte, dst, src []byte) {
+	counter := tag
+	counter[15] |= 0x80
+	var ks [blockSize]byte
+	for i := range src {
+		if i%blockSize == 0 {
+			enc.Encrypt(ks[:], counter[:])
+			binary.LittleEndian.PutUint32(counter[:4], binary.LittleEndian.Uint32(counter[:4])+1)
+		}
+		dst[i] = src[i] ^ ks[i%blockSize]
+	}
+}
+
+func (a *aead) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != NonceSize {
+		panic("gcmsiv: incorrect nonce length given to GCM-SIV")
+	}
+	if uint64(len(plaintext)) > maxSize || uint64(len(additionalData)) > maxSize {
+		panic("gcmsiv: message too large for GCM-SIV")
+	}
+	authKey, enc := a.keys(nonce)
+	t := tag(authKey, enc, nonce, plaintext, additionalData)
+	ret, out := sliceForAppend(dst, len(plaintext)+tagSize)
+	ctr(enc, t, out, plaintext)
+	copy(out[len(plaintext):], t[:])
+	return ret
+}
+
+func (a *aead) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != NonceSize {
+		panic("gcmsiv: incorrect nonce length given to GCM-SIV")
+	}
+	if len(ciphertext) < tagSize || uint64(len(ciphertext)) > maxSize+tagSize || uint64(len(additionalData)) > maxSize {
+		return nil, errOpen
+	}
+	authKey, enc := a.keys(nonce)
+	var t [tagSize]byte
+	copy(t[:], ciphertext[len(ciphertext)-tagSize:])
+	ciphertext = ciphertext[:len(ciphertext)-tagSize]
+
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	ctr(enc, t, out, ciphertext)
+	if want := tag(authKey, enc, nonce, out, additionalData); subtle.ConstantTimeCompare(want[:], t[:]) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errOpen
+	}
+	return ret, nil
+}
+
+// sliceForAppend extends in by n bytes, returning the whole slice and the extension.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+// polyval computes POLYVAL, with field elements as little-endian 128-bit integers held in
+// two uint64s.
+type polyval struct {
+	hLo, hHi uint64
+	sLo, sHi uint64
+}
+
+func newPolyval(h [16]byte) *polyval {
+	return &polyval{hLo: binary.LittleEndian.Uint64(h[:8]), hHi: binary.LittleEndian.Uint64(h[8:])}
+}
+
+// update adds data, padded with zeros to whole blocks.
+func (p *polyval) update(data []byte) {
+	var block [blockSize]byte
+	for len(data) > 0 {
+		n := copy(block[:], data)
+		for i := n; i < blockSize; i++ {
+			block[i] = 0
+		}
+		data = data[n:]
+		p.sLo ^= binary.LittleEndian.Uint64(block[:8])
+		p.sHi ^= binary.LittleEndian.Uint64(block[8:])
+		p.sLo, p.sHi = dot(p.sLo, p.sHi, p.hLo, p.hHi)
+	}
+}
+
+func (p *polyval) sum() [16]byte {
+	var s [16]byte
+	binary.LittleEndian.PutUint64(s[:8], p.sLo)
+	binary.LittleEndian.PutUint64(s[8:], p.sHi)
+	return s
+}
+
+// dot returns a*b*x^-128 in GF(2^128) modulo x^128 + x^127 + x^126 + x^121 + 1, as the sum of
+// b*x^(i-128) over the bits i set in a, multiplying the sum by x^-1 after each bit.
+func dot(aLo, aHi, bLo, bHi uint64) (lo, hi uint64) {
+	for i := 0; i < 128; i++ {
+		bit := aLo
+		if i >= 64 {
+			bit = aHi
+		}
+		mask := -(bit >> (uint(i) % 64) & 1)
+		lo ^= bLo & mask
+		hi ^= bHi & mask
+
+		// times x^-1, which is x^127 + x^126 + x^125 + x^120
+		carry := -(lo & 1)
+		lo = lo>>1 | hi<<63
+		hi = hi>>1 ^ carry&0xe100000000000000
+	}
+	return lo, hi
+}
@@ -0,0 +1,76 @@
+package gcmsiv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPolyval(t *testing.T) {
+	// from RFC 8452, appendix A
+	var h [16]byte
+	copy(h[:], unhex("25629347589242761d31f826ba4b757b"))
+	p := newPolyval(h)
+	p.update(unhex("4f4f95668c83dfb6401762bb2d01a262d1a24ddd2721d006bbe45f20d3c9f362"))
+	if s := p.sum(); !bytes.Equal(s[:], unhex("f7a3b47b846119fae5b7866cf5e5b77e")) {
+		t.Fatalf("POLYVAL %x", s)
+	}
+}
+
+// Test vectors from RFC 8452, appendix C.
+var vectors = []struct {
+	key, nonce, plaintext, aad, result string
+}{
+	{"01000000000000000000000000000000", "030000000000000000000000", "", "",
+		"dc20e2d83f25705bb49e439eca56de25"},
+	{"01000000000000000000000000000000", "030000000000000000000000", "0100000000000000", "",
+		"b5d839330ac7b786578782fff6013b815b287c22493a364c"},
+	{"0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "", "",
+		"07f5f4169bbf55a8400cd47ea6fd400f"},
+	{"0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "0100000000000000", "",
+		"c2ef328e5c71c83b843122130f7364b761e0b97427e3df28"},
+}
+
+func TestVectors(t *testing.T) {
+	for _, v := range vectors {
+		a, err := New(unhex(v.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce, plaintext, aad := unhex(v.nonce), unhex(v.plaintext), unhex(v.aad)
+		if got := a.Seal(nil, nonce, plaintext, aad); !bytes.Equal(got, unhex(v.result)) {
+			t.Errorf("Seal with key %s: got %x, want %s", v.key, got, v.result)
+		}
+		got, err := a.Open(nil, nonce, unhex(v.result), aad)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("Open with key %s: got %x, %v", v.key, got, err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	a, _ := New(bytes.Repeat([]byte{7}, 32))
+	nonce := make([]byte, NonceSize)
+	for _, size := range []int{1, 15, 16, 17, 100, 16383} {
+		msg := bytes.Repeat([]byte{byte(size)}, size)
+		buf := a.Seal(append([]byte(nil), msg...)[:0], nonce, msg, []byte("ad"))
+		out, err := a.Open(buf[:0], nonce, buf, []byte("ad"))
+		if err != nil || !bytes.Equal(out, msg) {
+			t.Fatalf("size %d: %v", size, err)
+		}
+	}
+
+	sealed := a.Seal(nil, nonce, []byte("message"), nil)
+	sealed[0] ^= 1
+	if _, err := a.Open(nil, nonce, sealed, nil); err != errOpen {
+		t.Fatalf("tampered message opened: %v", err)
+	}
+}
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,274 @@
+// Package gun carries a byte stream in a gRPC call compatible with the "gun" transport of
+// V2Ray and Xray: a bidirectional stream of Hunk messages of the method Tun of a service,
+// so that it can pass through gRPC reverse proxies. Only what that needs of gRPC and
+// protocol buffers is implemented.
+package gun
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const contentType = "application/grpc"
+
+// maxHunkSize is the maximum size of the data written in one message.
+const maxHunkSize = 32 << 10
+
+var errProtocol = errors.New("gun: protocol error")
+
+// Path returns the path of the Tun method of service.
+func Path(service string) string { return "/" + service + "/Tun" }
+
+// Conn is a gun call, which reads and writes the data of Hunk messages.
+type Conn struct {
+	r    io.ReadCloser
+	br   *bufio.Reader
+	msg  int // unread bytes of the current message
+	hunk int // unread bytes of the data in the current message
+
+	dmu    sync.Mutex
+	expire *time.Timer
+	late   int32 // set atomically once the read deadline has passed and r was closed
+
+	wmu    sync.Mutex
+	w      io.Writer
+	flush  func()
+	closed bool // set on servers once the response can no longer be written
+
+	once   sync.Once
+	done   chan struct{}
+	closeW func() error
+
+	local, remote net.Addr
+}
+
+func newConn(r io.ReadCloser, w io.Writer) *Conn {
+	return &Conn{r: r, br: bufio.NewReader(r), w: w, done: make(chan struct{})}
+}
+
+// Dial calls the Tun method at url with client, which has to use HTTP/2, sending host as
+// the authority if not empty.
+func Dial(client *http.Client, url, host string) (*Conn, error) {
+	pr, pw := io.Pipe()
+	c := newConn(nil, pw)
+	c.closeW = pw.Close
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+		c.local, c.remote = info.Conn.LocalAddr(), info.Conn.RemoteAddr()
+	}}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodPost, url, pr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		req.Host = host
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("User-Agent", "grpc-go/1.36.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		pw.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 || !strings.HasPrefix(resp.Header.Get("Content-Type"), contentType) {
+		resp.Body.Close()
+		pw.Close()
+		return nil, fmt.Errorf("gun: unexpected response %s %s", resp.Proto, resp.Status)
+	}
+	c.r, c.br = resp.Body, bufio.NewReader(resp.Body)
+	return c, nil
+}
+
+// IsCall reports whether r is a call of the Tun method of service.
+func IsCall(r *http.Request, service string) bool {
+	return r.Method == http.MethodPost && r.ProtoMajor == 2 && r.URL.Path == Path(service) &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), contentType)
+}
+
+// Accept answers the call r with w and returns its connection. The caller has to call
+// Serve with it in the handler of r.
+func Accept(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("gun: response cannot be streamed")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	c := newConn(r.Body, w)
+	c.flush = f.Flush
+	c.local, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if a, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		c.remote = a
+	}
+	return c, nil
+}
+
+// Serve waits until c, accepted from the call r, is closed or the call ends, and then sets
+// the status of the call. The handler of r returns once Serve does.
+func Serve(c *Conn, w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-c.done:
+	case <-r.Context().Done():
+		c.Close()
+	}
+	c.wmu.Lock()
+	c.closed = true
+	c.wmu.Unlock()
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.read(b)
+	if err != nil && atomic.LoadInt32(&c.late) != 0 {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *Conn) read(b []byte) (int, error) {
+	for c.hunk == 0 {
+		if c.msg == 0 {
+			var h [5]byte // compressed flag and message length
+			if _, err := io.ReadFull(c.br, h[:]); err != nil {
+				return 0, err
+			}
+			if h[0] != 0 {
+				return 0, errProtocol
+			}
+			c.msg = int(binary.BigEndian.Uint32(h[1:]))
+			continue
+		}
+		// a field of the message: only data, field 1 of type bytes, is expected
+		tag, err := c.uvarint()
+		if err != nil {
+			return 0, err
+		}
+		n, err := c.uvarint()
+		if err != nil {
+			return 0, err
+		}
+		if tag != 1<<3|2 || n > uint64(c.msg) {
+			return 0, errProtocol
+		}
+		c.hunk = int(n)
+		c.msg -= c.hunk
+	}
+	if len(b) > c.hunk {
+		b = b[:c.hunk]
+	}
+	n, err := c.br.Read(b)
+	c.hunk -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// uvarint reads a varint of the current message.
+func (c *Conn) uvarint() (uint64, error) {
+	var x uint64
+	for s := uint(0); s < 64; s += 7 {
+		if c.msg == 0 {
+			return 0, errProtocol
+		}
+		b, err := c.br.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		c.msg--
+		x |= uint64(b&0x7f) << s
+		if b < 0x80 {
+			return x, nil
+		}
+	}
+	return 0, errProtocol
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var n int
+	for len(b) > 0 {
+		select {
+		case <-c.done:
+			return n, net.ErrClosed
+		default:
+		}
+		if c.closed {
+			return n, net.ErrClosed
+		}
+		p := b
+		if len(p) > maxHunkSize {
+			p = p[:maxHunkSize]
+		}
+		m := make([]byte, 5, 5+1+binary.MaxVarintLen64+len(p))
+		m = append(m, 1<<3|2)
+		m = m[:len(m)+binary.PutUvarint(m[len(m):cap(m)], uint64(len(p)))]
+		m = append(m, p...)
+		binary.BigEndian.PutUint32(m[1:], uint32(len(m)-5))
+		if _, err := c.w.Write(m); err != nil {
+			return n, err
+		}
+		if c.flush != nil {
+			c.flush()
+		}
+		n += len(p)
+		b = b[len(p):]
+	}
+	return n, nil
+}
+
+// Close ends the call. Blocked reads return.
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		if c.closeW != nil {
+			c.closeW()
+		}
+		c.r.Close()
+	})
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline sets the read deadline.
+func (c *Conn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+// SetReadDeadline sets the read deadline. Once it passes, reads fail and the call cannot
+// be read from any more, even after extending the deadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	if c.expire != nil {
+		c.expire.Stop()
+		c.expire = nil
+	}
+	if !t.IsZero() {
+		c.expire = time.AfterFunc(time.Until(t), func() {
+			atomic.StoreInt32(&c.late, 1)
+			c.r.Close()
+		})
+	}
+	return nil
+}
+
+// SetWriteDeadline does nothing, as writes of calls cannot be interrupted.
+func (c *Conn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,51 @@
+package gun
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEcho(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsCall(r, "Echo") {
+			http.NotFound(w, r)
+			return
+		}
+		c, err := Accept(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		go func() {
+			io.Copy(c, c)
+			c.Close()
+		}()
+		Serve(c, w, r)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	if _, err := Dial(srv.Client(), srv.URL+Path("Other"), ""); err == nil {
+		t.Fatal("called an unknown service")
+	}
+	c, err := Dial(srv.Client(), srv.URL+Path("Echo"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	b := make([]byte, 3*maxHunkSize+100)
+	rand.Read(b)
+	go c.Write(b)
+	got := make([]byte, len(b))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Error("echoed data differs")
+	}
+}
@@ -0,0 +1,164 @@
+// Package icmptun tunnels a stream in ICMP echo requests and replies, for networks letting
+// nothing but ping through. The client sends data in echo requests to the server, which
+// answers with data in echo replies of the same identifier and sequence number. As only the
+// client can send, it polls the server while waiting for data, as implemented by the
+// pollconn package. Both ends need raw sockets, i.e. root or CAP_NET_RAW on Linux, and
+// only IPv4 is supported.
+//
+// The data of echo requests and replies is
+//
+//	[magic, 3 bytes][direction][payload]
+//
+// where the direction tells replies of the server from those of its kernel, which echoes
+// requests unless net.ipv4.icmp_echo_ignore_all is set. The server tells sessions apart by
+// the address of the client and the identifier of the echo requests, which the client
+// picks at random for each session; the sequence number matches replies to requests.
+package icmptun
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/pollconn"
+)
+
+const (
+	typeEchoReply   = 0
+	typeEchoRequest = 8
+
+	echoHeader = 8 // type, code, checksum, identifier, sequence number
+	tunHeader  = 4 // magic and direction
+	dirUp      = 'u'
+	dirDown    = 'd'
+
+	maxData        = 1400 - 20 - echoHeader - tunHeader - pollconn.Header // keeping packets below 1400 bytes
+	requestTimeout = time.Second                                          // before a request is sent again
+)
+
+var magic = []byte("sst")
+
+var errNotTunnel = errors.New("icmptun: not a tunnel message")
+
+// marshal returns the ICMP echo message of type typ carrying payload in direction dir.
+func marshal(typ byte, id, seq uint16, dir byte, payload []byte) []byte {
+	b := make([]byte, echoHeader, echoHeader+tunHeader+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint16(b[4:], id)
+	binary.BigEndian.PutUint16(b[6:], seq)
+	b = append(b, magic...)
+	b = append(b, dir)
+	b = append(b, payload...)
+	binary.BigEndian.PutUint16(b[2:], checksum(b))
+	return b
+}
+
+// parse returns the payload of the tunnel message b of type typ in direction dir, along
+// with its identifier and sequence number.
+func parse(b []byte, typ, dir byte) (id, seq uint16, payload []byte, err error) {
+	if len(b) < echoHeader+tunHeader || b[0] != typ || b[1] != 0 ||
+		string(b[echoHeader:echoHeader+3]) != string(magic) || b[echoHeader+3] != dir {
+		return 0, 0, nil, errNotTunnel
+	}
+	return binary.BigEndian.Uint16(b[4:]), binary.BigEndian.Uint16(b[6:]), b[echoHeader+tunHeader:], nil
+}
+
+// checksum returns the Internet checksum of b, whose checksum field is zero.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// Dial opens a session through pc, a raw ICMP socket, with the server at addr.
+func Dial(pc net.PacketConn, addr *net.IPAddr) net.Conn {
+	c := &carrier{pc: pc, raddr: addr, id: uint16(rand.Intn(1 << 16))}
+	return pollconn.Dial(c, maxData)
+}
+
+// carrier sends the payloads of a session in echo requests.
+type carrier struct {
+	pc    net.PacketConn
+	raddr *net.IPAddr
+	id    uint16
+	seq   uint16
+}
+
+// Exchange sends an echo request carrying payload and returns the payload of the reply.
+func (c *carrier) Exchange(payload []byte) ([]byte, error) {
+	c.seq++
+	if _, err := c.pc.WriteTo(marshal(typeEchoRequest, c.id, c.seq, dirUp, payload), c.raddr); err != nil {
+		return nil, err
+	}
+	c.pc.SetReadDeadline(time.Now().Add(requestTimeout))
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		if ip, ok := addr.(*net.IPAddr); !ok || !ip.IP.Equal(c.raddr.IP) {
+			continue
+		}
+		id, seq, resp, err := parse(buf[:n], typeEchoReply, dirDown)
+		if err == nil && id == c.id && seq == c.seq {
+			return append([]byte(nil), resp...), nil
+		}
+	}
+}
+
+func (c *carrier) Close() error         { return c.pc.Close() }
+func (c *carrier) LocalAddr() net.Addr  { return c.pc.LocalAddr() }
+func (c *carrier) RemoteAddr() net.Addr { return c.raddr }
+
+// Listener accepts the sessions of clients from echo requests.
+type Listener struct {
+	pc     net.PacketConn
+	server *pollconn.Server
+}
+
+// Listen serves the sessions of clients from the echo requests arriving at pc, a raw ICMP
+// socket.
+func Listen(pc net.PacketConn) *Listener {
+	l := &Listener{pc: pc, server: pollconn.NewServer(pc.LocalAddr())}
+	go l.serve()
+	return l
+}
+
+// Accept waits for and returns the next session.
+func (l *Listener) Accept() (net.Conn, error) { return l.server.Accept() }
+
+// Close closes the listener and pc, failing all sessions.
+func (l *Listener) Close() error { return l.pc.Close() }
+
+// Addr returns the address of pc.
+func (l *Listener) Addr() net.Addr { return l.pc.LocalAddr() }
+
+func (l *Listener) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.server.Close(err)
+			return
+		}
+		id, seq, payload, err := parse(buf[:n], typeEchoRequest, dirUp)
+		if err != nil || len(payload) < pollconn.Header {
+			continue // pings and replies are left to the kernel
+		}
+		key := addr.String() + "/" + strconv.Itoa(int(id))
+		resp := l.server.Handle(key, payload, maxData, addr)
+		l.pc.WriteTo(marshal(typeEchoReply, id, seq, dirDown, resp), addr)
+	}
+}
@@ -0,0 +1,61 @@
+package icmptun
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestMessage(t *testing.T) {
+	payload := make([]byte, 101)
+	rand.Read(payload)
+	b := marshal(typeEchoRequest, 7, 9, dirUp, payload)
+	if checksum(b) != 0 {
+		t.Fatal("checksum does not verify")
+	}
+	id, seq, got, err := parse(b, typeEchoRequest, dirUp)
+	if err != nil || id != 7 || seq != 9 || !bytes.Equal(got, payload) {
+		t.Fatalf("parse = %d, %d, %v", id, seq, err)
+	}
+	if _, _, _, err := parse(b, typeEchoReply, dirDown); err == nil {
+		t.Fatal("parse took an echo request for a reply")
+	}
+}
+
+func TestSession(t *testing.T) {
+	spc, err := net.ListenPacket("ip4:icmp", "127.0.0.1")
+	if err != nil {
+		t.Skipf("raw sockets unavailable: %v", err)
+	}
+	l := Listen(spc)
+	defer l.Close()
+	cpc, err := net.ListenPacket("ip4:icmp", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Dial(cpc, &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	up := make([]byte, 5000)
+	rand.Read(up)
+	go c.Write(up)
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(up))
+	if _, err := io.ReadFull(s, got); err != nil || !bytes.Equal(got, up) {
+		t.Fatalf("server read: %v", err)
+	}
+
+	down := make([]byte, 20000)
+	rand.Read(down)
+	s.Write(down)
+	s.Close()
+	if got, err := ioutil.ReadAll(c); err != nil || !bytes.Equal(got, down) {
+		t.Fatalf("client read %d bytes: %v", len(got), err)
+	}
+	c.Close()
+}
@@ -0,0 +1,162 @@
+// Package ipfix exports bidirectional flow records to an IPFIX collector (RFC 7011) over UDP.
+package ipfix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// Record is a bidirectional flow record. Octets counts bytes from source to
+// destination and ReverseOctets bytes from destination to source.
+type Record struct {
+	SrcIP         net.IP
+	SrcPort       uint16
+	DstIP         net.IP
+	DstPort       uint16
+	Protocol      uint8 // IANA protocol number, e.g. 6 for TCP and 17 for UDP
+	Octets        uint64
+	ReverseOctets uint64
+	Start, End    time.Time
+}
+
+const (
+	version         = 10
+	templateSetID   = 2
+	templateBase    = 256 // template IDs 256 to 259 for IPv4/IPv6 source and destination
+	reversePEN      = 29305
+	templateRefresh = time.Minute // templates are resent this often as UDP may lose them
+)
+
+// information elements as defined in the IANA IPFIX registry
+const (
+	ieOctetDeltaCount          = 1
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowStartMilliseconds    = 152
+	ieFlowEndMilliseconds      = 153
+	enterpriseBit              = 0x8000
+)
+
+// Exporter sends records to a collector, one IPFIX message per record.
+type Exporter struct {
+	sync.Mutex
+	conn         net.Conn
+	domain       uint32
+	seq          uint32 // number of data records sent so far
+	lastTemplate time.Time
+	now          func() time.Time
+}
+
+// NewExporter returns an Exporter writing to conn, usually a connected UDP socket,
+// with the given observation domain ID.
+func NewExporter(conn net.Conn, domain uint32) *Exporter {
+	return &Exporter{conn: conn, domain: domain, now: time.Now}
+}
+
+// Export sends r to the collector, preceded by the templates if they are due.
+func (e *Exporter) Export(r Record) error {
+	e.Lock()
+	defer e.Unlock()
+
+	now := e.now()
+	var msg bytes.Buffer
+	msg.Write(make([]byte, 16)) // message header, filled in below
+	if now.Sub(e.lastTemplate) >= templateRefresh {
+		writeTemplates(&msg)
+		e.lastTemplate = now
+	}
+	writeData(&msg, r)
+
+	b := msg.Bytes()
+	binary.BigEndian.PutUint16(b[0:], version)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint32(b[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(b[8:], e.seq)
+	binary.BigEndian.PutUint32(b[12:], e.domain)
+	if _, err := e.conn.Write(b); err != nil {
+		e.lastTemplate = time.Time{} // resend templates with the next message
+		return err
+	}
+	e.seq++
+	return nil
+}
+
+func templateID(r Record) uint16 {
+	id := uint16(templateBase)
+	if r.SrcIP.To4() == nil {
+		id |= 1
+	}
+	if r.DstIP.To4() == nil {
+		id |= 2
+	}
+	return id
+}
+
+func writeTemplates(w *bytes.Buffer) {
+	var set bytes.Buffer
+	for id := uint16(templateBase); id < templateBase+4; id++ {
+		src, dst := uint16(ieSourceIPv4Address), uint16(ieDestinationIPv4Address)
+		srcLen, dstLen := uint16(net.IPv4len), uint16(net.IPv4len)
+		if id&1 != 0 {
+			src, srcLen = ieSourceIPv6Address, net.IPv6len
+		}
+		if id&2 != 0 {
+			dst, dstLen = ieDestinationIPv6Address, net.IPv6len
+		}
+		fields := [][2]uint16{
+			{src, srcLen},
+			{ieSourceTransportPort, 2},
+			{dst, dstLen},
+			{ieDestinationTransportPort, 2},
+			{ieProtocolIdentifier, 1},
+			{ieOctetDeltaCount, 8},
+			{ieOctetDeltaCount | enterpriseBit, 8}, // reverseOctetDeltaCount (RFC 5103)
+			{ieFlowStartMilliseconds, 8},
+			{ieFlowEndMilliseconds, 8},
+		}
+		binary.Write(&set, binary.BigEndian, [2]uint16{id, uint16(len(fields))})
+		for _, f := range fields {
+			binary.Write(&set, binary.BigEndian, f)
+			if f[0]&enterpriseBit != 0 {
+				binary.Write(&set, binary.BigEndian, uint32(reversePEN))
+			}
+		}
+	}
+	binary.Write(w, binary.BigEndian, [2]uint16{templateSetID, uint16(4 + set.Len())})
+	w.Write(set.Bytes())
+}
+
+func writeData(w *bytes.Buffer, r Record) {
+	var rec bytes.Buffer
+	if ip := r.SrcIP.To4(); ip != nil {
+		rec.Write(ip)
+	} else {
+		rec.Write(r.SrcIP.To16())
+	}
+	binary.Write(&rec, binary.BigEndian, r.SrcPort)
+	if ip := r.DstIP.To4(); ip != nil {
+		rec.Write(ip)
+	} else {
+		rec.Write(r.DstIP.To16())
+	}
+	binary.Write(&rec, binary.BigEndian, r.DstPort)
+	rec.WriteByte(r.Protocol)
+	binary.Write(&rec, binary.BigEndian, r.Octets)
+	binary.Write(&rec, binary.BigEndian, r.ReverseOctets)
+	binary.Write(&rec, binary.BigEndian, uint64(r.Start.UnixNano()/int64(time.Millisecond)))
+	binary.Write(&rec, binary.BigEndian, uint64(r.End.UnixNano()/int64(time.Millisecond)))
+	for rec.Len()%4 != 0 { // pad the set to 4 bytes, shorter than a record as RFC 7011 asks
+		rec.WriteByte(0)
+	}
+
+	binary.Write(w, binary.BigEndian, [2]uint16{templateID(r), uint16(4 + rec.Len())})
+	w.Write(rec.Bytes())
+}
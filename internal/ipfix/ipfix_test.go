@@ -0,0 +1,123 @@
+package ipfix
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureConn records the messages written to it, failing writes while fail is set.
+type captureConn struct {
+	net.Conn
+	msgs [][]byte
+	fail bool
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	if c.fail {
+		return 0, errors.New("write failed")
+	}
+	c.msgs = append(c.msgs, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// templates is the template set, of the templates for IPv4 and IPv6 sources and destinations.
+const templates = `
+0002 00b4
+0100 0009 0008 0004 0007 0002 000c 0004 000b 0002 0004 0001 0001 0008 8001 0008 00007279 0098 0008 0099 0008
+0101 0009 001b 0010 0007 0002 000c 0004 000b 0002 0004 0001 0001 0008 8001 0008 00007279 0098 0008 0099 0008
+0102 0009 0008 0004 0007 0002 001c 0010 000b 0002 0004 0001 0001 0008 8001 0008 00007279 0098 0008 0099 0008
+0103 0009 001b 0010 0007 0002 001c 0010 000b 0002 0004 0001 0001 0008 8001 0008 00007279 0098 0008 0099 0008
+`
+
+func TestExport(t *testing.T) {
+	c := &captureConn{}
+	e := NewExporter(c, 7)
+	now := time.Unix(1600000100, 0)
+	e.now = func() time.Time { return now }
+
+	r4 := Record{
+		SrcIP: net.ParseIP("192.0.2.1"), SrcPort: 1234,
+		DstIP: net.ParseIP("198.51.100.2"), DstPort: 443,
+		Protocol: 6, Octets: 100, ReverseOctets: 2000,
+		Start: time.Unix(1600000000, 500e6), End: time.Unix(1600000060, 250e6),
+	}
+	// 45 bytes of record padded to 48
+	data4 := `
+0100 0034
+c0000201 04d2 c6336402 01bb 06 0000000000000064 00000000000007d0 00000174876e81f4 00000174876f6b5a
+000000
+`
+	r6 := r4
+	r6.SrcIP = net.ParseIP("2001:db8::1")
+	// 57 bytes of record padded to 60
+	data6 := `
+0101 0040
+20010db8000000000000000000000001 04d2 c6336402 01bb 06 0000000000000064 00000000000007d0 00000174876e81f4 00000174876f6b5a
+000000
+`
+
+	for _, r := range []Record{r4, r6, r4} {
+		if err := e.Export(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.fail = true
+	if err := e.Export(r4); err == nil {
+		t.Fatal("Export succeeded on a failing conn")
+	}
+	c.fail = false
+	if err := e.Export(r4); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		// templates first, with sequence number 0
+		"000a 00f8 5f5e1064 00000000 00000007" + templates + data4,
+		// templates only once a minute, sequence numbers counting records sent
+		"000a 0050 5f5e1064 00000001 00000007" + data6,
+		"000a 0044 5f5e1064 00000002 00000007" + data4,
+		// templates again after a failed write, which counts no record
+		"000a 00f8 5f5e1064 00000003 00000007" + templates + data4,
+	}
+	if len(c.msgs) != len(want) {
+		t.Fatalf("%d messages written, want %d", len(c.msgs), len(want))
+	}
+	for i, w := range want {
+		if w := unhex(t, w); !bytes.Equal(c.msgs[i], w) {
+			t.Errorf("message %d:\n got %x\nwant %x", i, c.msgs[i], w)
+		}
+	}
+}
+
+func TestTemplateRefresh(t *testing.T) {
+	c := &captureConn{}
+	e := NewExporter(c, 0)
+	now := time.Unix(1600000100, 0)
+	e.now = func() time.Time { return now }
+	r := Record{SrcIP: net.IPv4(192, 0, 2, 1), DstIP: net.IPv4(198, 51, 100, 2)}
+
+	for _, d := range []time.Duration{0, templateRefresh - time.Second, templateRefresh} {
+		now = time.Unix(1600000100, 0).Add(d)
+		if err := e.Export(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, hasTemplates := range []bool{true, false, true} {
+		if got := bytes.Contains(c.msgs[i], unhex(t, templates)); got != hasTemplates {
+			t.Errorf("message %d carries templates: %v, want %v", i, got, hasTemplates)
+		}
+	}
+}
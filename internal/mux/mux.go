@@ -0,0 +1,626 @@
+// Package mux multiplexes streams over a single connection, so that many proxied
+// connections can share one encrypted connection to the server.
+//
+// The connection carries frames of an 8-byte header followed by data:
+//
+//	[command][reserved][length of data, uint16][stream ID, uint32]
+//
+// with integers big-endian. The client opens streams with odd IDs, the server with even
+// ones. A stream starts with a SYN frame, carries data in PSH frames, and ends in each
+// direction with a FIN frame, after which the sender neither sends nor reads any more data.
+// Each side may send up to initialWindow bytes of a stream the other has not read yet, and
+// WND frames return the window as data is read, with the number of bytes read as data. A side
+// with a larger receive window grants the difference in a WND frame as the stream opens.
+// CTL frames with stream ID 0 carry control messages of the session itself, which peers
+// not expecting them ignore, as they ignore all frames of streams that do not exist.
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	cmdSYN = iota // open a stream
+	cmdPSH        // data of a stream
+	cmdFIN        // end of a stream from the sender
+	cmdWND        // window update
+	cmdCTL        // control message of the session
+)
+
+const (
+	headerSize    = 8
+	maxFrameSize  = 16 << 10
+	initialWindow = 256 << 10
+)
+
+// ErrClosed is returned by operations on a closed session.
+var ErrClosed = errors.New("mux: session closed")
+
+var errProtocol = errors.New("mux: protocol error")
+
+// Config tunes a session. A nil *Config uses the defaults of the zero value.
+type Config struct {
+	// MaxStreams limits the streams the peer may have open at once. Streams it opens
+	// beyond are ended right away. 0 means no limit.
+	MaxStreams int
+	// Window is how much data of a stream the peer may send before it is read: at least,
+	// and by default, 256 KiB. Larger windows speed up bulk transfers over long round trips
+	// at the cost of memory for streams not read fast enough.
+	Window int
+	// ReadBuffer is the size of the buffer frames are read from the connection with, which
+	// saves reads of the connection for many small frames. 0 reads frames unbuffered.
+	ReadBuffer int
+}
+
+// Session is a connection carrying multiplexed streams.
+type Session struct {
+	conn       net.Conn
+	r          io.Reader // of frames from conn
+	wmu        sync.Mutex
+	wbuf       []byte
+	window     int // receive window of streams
+	maxStreams int
+
+	// frames recvLoop sends, written by ctrlLoop so that recvLoop never blocks on conn
+	cmu      sync.Mutex
+	ctrlWND  map[uint32]int // window returned per stream
+	ctrlFIN  []uint32       // streams refused
+	ctrlSent chan struct{}  // signaled on queueing, with capacity 1
+
+	mu          sync.Mutex
+	streams     map[uint32]*Stream
+	peerStreams int // open streams opened by the peer
+	nextID      uint32
+	idle        time.Time // since when the session has no streams
+	control     func([]byte)
+
+	accepts chan *Stream
+	die     chan struct{}
+	dieOnce sync.Once
+	err     error // set before die is closed
+}
+
+// Client returns the client side of a session over c, tuned by config if not nil.
+func Client(c net.Conn, config *Config) *Session { return newSession(c, 1, config) }
+
+// Server returns the server side of a session over c, tuned by config if not nil.
+func Server(c net.Conn, config *Config) *Session { return newSession(c, 2, config) }
+
+func newSession(c net.Conn, firstID uint32, config *Config) *Session {
+	if config == nil {
+		config = &Config{}
+	}
+	s := &Session{
+		conn:       c,
+		r:          c,
+		wbuf:       make([]byte, headerSize+maxFrameSize),
+		window:     initialWindow,
+		maxStreams: config.MaxStreams,
+		streams:    make(map[uint32]*Stream),
+		nextID:     firstID,
+		idle:       time.Now(),
+		ctrlWND:    make(map[uint32]int),
+		ctrlSent:   make(chan struct{}, 1),
+		accepts:    make(chan *Stream, 16),
+		die:        make(chan struct{}),
+	}
+	if config.Window > initialWindow {
+		s.window = config.Window
+	}
+	if config.ReadBuffer > 0 {
+		s.r = bufio.NewReaderSize(c, config.ReadBuffer)
+	}
+	go s.recvLoop()
+	go s.ctrlLoop()
+	return s
+}
+
+// Open opens a new stream.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	st := newStream(s, s.nextID)
+	s.nextID += 2
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(cmdSYN, st.id, nil); err != nil {
+		return nil, err
+	}
+	if err := s.grantWindow(st.id); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for and returns the next stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.die:
+		return nil, s.err
+	}
+}
+
+// OnControl sets f to be called with the control messages the peer sends. It is called
+// from the loop receiving frames, so it must not block.
+func (s *Session) OnControl(f func([]byte)) {
+	s.mu.Lock()
+	s.control = f
+	s.mu.Unlock()
+}
+
+// WriteControl sends the control message b to the peer.
+func (s *Session) WriteControl(b []byte) error {
+	if len(b) > maxFrameSize {
+		return errors.New("mux: control message too large")
+	}
+	return s.writeFrame(cmdCTL, 0, b)
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Idle returns how long the session has had no streams, or 0 if it has some.
+func (s *Session) Idle() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.streams) > 0 {
+		return 0
+	}
+	return time.Since(s.idle)
+}
+
+// IsClosed reports whether the session is closed.
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done returns a channel closed once the session is closed.
+func (s *Session) Done() <-chan struct{} { return s.die }
+
+// Close closes the session and the underlying connection, failing all streams.
+func (s *Session) Close() error {
+	s.close(ErrClosed)
+	return nil
+}
+
+func (s *Session) close(err error) {
+	s.dieOnce.Do(func() {
+		s.err = err
+		close(s.die)
+		s.conn.Close()
+	})
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.streams[id]; ok {
+		delete(s.streams, id)
+		if id%2 != s.nextID%2 {
+			s.peerStreams--
+		}
+		if len(s.streams) == 0 {
+			s.idle = time.Now()
+		}
+	}
+}
+
+func (s *Session) writeFrame(cmd byte, id uint32, data []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.IsClosed() {
+		return s.err
+	}
+	buf := s.wbuf[:headerSize+len(data)]
+	buf[0], buf[1] = cmd, 0
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(data)))
+	binary.BigEndian.PutUint32(buf[4:], id)
+	copy(buf[headerSize:], data)
+	if _, err := s.conn.Write(buf); err != nil {
+		s.close(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	hdr := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(s.r, hdr); err != nil {
+			s.close(err)
+			return
+		}
+		cmd, id := hdr[0], binary.BigEndian.Uint32(hdr[4:])
+		data := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+		if _, err := io.ReadFull(s.r, data); err != nil {
+			s.close(err)
+			return
+		}
+
+		s.mu.Lock()
+		if cmd == cmdCTL && id == 0 {
+			f := s.control
+			s.mu.Unlock()
+			if f != nil {
+				f(data)
+			}
+			continue
+		}
+		st := s.streams[id]
+		if cmd == cmdSYN {
+			if st != nil || id%2 == s.nextID%2 {
+				s.mu.Unlock()
+				s.close(errProtocol)
+				return
+			}
+			if s.maxStreams > 0 && s.peerStreams >= s.maxStreams {
+				s.mu.Unlock()
+				s.queueFIN(id)
+				continue
+			}
+			st = newStream(s, id)
+			s.streams[id] = st
+			s.peerStreams++
+			s.mu.Unlock()
+			if s.window > initialWindow {
+				s.queueWindow(id, s.window-initialWindow)
+			}
+			select {
+			case s.accepts <- st:
+			case <-s.die:
+				return
+			}
+			continue
+		}
+		s.mu.Unlock()
+		if st == nil { // closed on both sides
+			continue
+		}
+
+		var err error
+		switch cmd {
+		case cmdPSH:
+			err = st.pushData(data)
+		case cmdFIN:
+			st.pushFIN()
+		case cmdWND:
+			if len(data) != 4 {
+				err = errProtocol
+			} else {
+				st.addWindow(int(binary.BigEndian.Uint32(data)))
+			}
+		default:
+			err = errProtocol
+		}
+		if err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+// queueFIN has ctrlLoop end stream id, refused as the peer opened it.
+func (s *Session) queueFIN(id uint32) {
+	s.cmu.Lock()
+	s.ctrlFIN = append(s.ctrlFIN, id)
+	s.cmu.Unlock()
+	signal(s.ctrlSent)
+}
+
+// queueWindow has ctrlLoop return n bytes of the window of stream id, adding to any
+// window queued before.
+func (s *Session) queueWindow(id uint32, n int) {
+	s.cmu.Lock()
+	s.ctrlWND[id] += n
+	s.cmu.Unlock()
+	signal(s.ctrlSent)
+}
+
+// ctrlLoop writes the frames queued by recvLoop, which would deadlock writing them itself
+// if the peer, as busy writing, did not read until it could write again.
+func (s *Session) ctrlLoop() {
+	for {
+		select {
+		case <-s.ctrlSent:
+		case <-s.die:
+			return
+		}
+		s.cmu.Lock()
+		fins, wnds := s.ctrlFIN, s.ctrlWND
+		s.ctrlFIN, s.ctrlWND = nil, make(map[uint32]int)
+		s.cmu.Unlock()
+		for _, id := range fins {
+			if s.writeFrame(cmdFIN, id, nil) != nil {
+				return
+			}
+		}
+		for id, n := range wnds {
+			if s.writeWindow(id, n) != nil {
+				return
+			}
+		}
+	}
+}
+
+// Stream is a multiplexed connection within a session.
+type Stream struct {
+	s  *Session
+	id uint32
+
+	mu       sync.Mutex
+	buf      []byte // received data not read yet
+	consumed int    // bytes read since the last window update
+	window   int    // bytes the peer can still take
+	finRecv  bool
+	closed   bool
+
+	readable, writable chan struct{} // signaled on changes, with capacity 1
+	done               chan struct{} // closed by Close
+	rd, wd             deadline
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		s:        s,
+		id:       id,
+		window:   initialWindow,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		rd:       makeDeadline(),
+		wd:       makeDeadline(),
+	}
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) pushData(data []byte) error {
+	st.mu.Lock()
+	if st.closed { // nobody reads any more: return the window right away
+		st.mu.Unlock()
+		if len(data) > 0 {
+			st.s.queueWindow(st.id, len(data))
+		}
+		return nil
+	}
+	if len(st.buf)+len(data) > st.s.window {
+		st.mu.Unlock()
+		return errProtocol
+	}
+	st.buf = append(st.buf, data...)
+	st.mu.Unlock()
+	signal(st.readable)
+	return nil
+}
+
+func (st *Stream) pushFIN() {
+	st.mu.Lock()
+	st.finRecv = true
+	closed := st.closed
+	st.mu.Unlock()
+	signal(st.readable)
+	if closed {
+		st.s.remove(st.id)
+	}
+}
+
+func (st *Stream) addWindow(n int) {
+	st.mu.Lock()
+	st.window += n
+	st.mu.Unlock()
+	signal(st.writable)
+}
+
+// grantWindow grants the peer the part of the receive window of stream id beyond the
+// initialWindow it starts with.
+func (s *Session) grantWindow(id uint32) error {
+	if s.window == initialWindow {
+		return nil
+	}
+	return s.writeWindow(id, s.window-initialWindow)
+}
+
+func (s *Session) writeWindow(id uint32, n int) error {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n))
+	return s.writeFrame(cmdWND, id, b[:])
+}
+
+// Read reads data of the stream. It returns io.EOF once the peer has closed the stream.
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.buf) > 0 {
+			n := copy(b, st.buf)
+			st.buf = st.buf[n:]
+			st.consumed += n
+			update := 0
+			if st.consumed >= st.s.window/2 || len(st.buf) == 0 && st.consumed >= maxFrameSize {
+				update, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+			if update > 0 {
+				st.s.writeWindow(st.id, update)
+			}
+			return n, nil
+		}
+		fin, closed := st.finRecv, st.closed
+		st.mu.Unlock()
+		if closed {
+			return 0, io.ErrClosedPipe
+		}
+		if fin {
+			return 0, io.EOF
+		}
+
+		select {
+		case <-st.readable:
+		case <-st.rd.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-st.done:
+		case <-st.s.die:
+			return 0, st.s.err
+		}
+	}
+}
+
+// Write writes b as data of the stream, waiting for the peer to read earlier data if needed.
+func (st *Stream) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		// take the window under the same lock as checking it, for concurrent writes
+		st.mu.Lock()
+		closed, k := st.closed, len(b)
+		if k > st.window {
+			k = st.window
+		}
+		if k > maxFrameSize {
+			k = maxFrameSize
+		}
+		if !closed {
+			st.window -= k
+		}
+		st.mu.Unlock()
+		if closed {
+			return n, io.ErrClosedPipe
+		}
+		if k == 0 {
+			select {
+			case <-st.writable:
+				continue
+			case <-st.wd.wait():
+				return n, os.ErrDeadlineExceeded
+			case <-st.done:
+				continue
+			case <-st.s.die:
+				return n, st.s.err
+			}
+		}
+
+		if err := st.s.writeFrame(cmdPSH, st.id, b[:k]); err != nil {
+			return n, err
+		}
+		n += k
+		b = b[k:]
+	}
+	return n, nil
+}
+
+// Close ends the stream in both directions: the peer reads io.EOF, and data it still
+// sends is discarded.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.buf = nil
+	fin := st.finRecv
+	close(st.done)
+	st.mu.Unlock()
+
+	err := st.s.writeFrame(cmdFIN, st.id, nil)
+	if fin || err != nil {
+		st.s.remove(st.id)
+	}
+	return err
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return st.s.conn.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr { return st.s.conn.RemoteAddr() }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.rd.set(t)
+	st.wd.set(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.rd.set(t)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.wd.set(t)
+	return nil
+}
+
+// deadline is a channel closed once a deadline passes, as in net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline { return deadline{cancel: make(chan struct{})} }
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() { close(d.cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,224 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func pair() (*Session, *Session) {
+	a, b := net.Pipe()
+	return Client(a, nil), Server(b, nil)
+}
+
+func TestStreams(t *testing.T) {
+	client, server := pair()
+	defer client.Close()
+	defer server.Close()
+
+	// echo every stream
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			msg := make([]byte, 1<<20) // more than the window
+			rand.Read(msg)
+			go func() {
+				st.Write(msg)
+			}()
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(st, got); err != nil || !bytes.Equal(got, msg) {
+				t.Errorf("echo: %v", err)
+			}
+			st.Close()
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(time.Second)
+	for client.NumStreams() > 0 || server.NumStreams() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("streams left open: client %d, server %d", client.NumStreams(), server.NumStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEOFAndDeadline(t *testing.T) {
+	client, server := pair()
+	defer client.Close()
+	defer server.Close()
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sst, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sst.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := sst.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read past deadline: %v", err)
+	}
+	sst.SetReadDeadline(time.Time{})
+
+	st.Write([]byte("hello"))
+	st.Close()
+	got, err := ioutil.ReadAll(sst)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("ReadAll = %q, %v", got, err)
+	}
+
+	// a slow writer blocks once the window is full, until its deadline
+	st2, _ := client.Open()
+	st2.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := st2.Write(make([]byte, 2*initialWindow)); !errors.Is(err, os.ErrDeadlineExceeded) || n != initialWindow {
+		t.Fatalf("Write beyond window = %d, %v", n, err)
+	}
+
+	server.Close()
+	if _, err := st2.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Read after session close succeeded")
+	}
+}
+
+func TestControl(t *testing.T) {
+	client, server := pair()
+	defer client.Close()
+	defer server.Close()
+
+	got := make(chan []byte, 1)
+	client.OnControl(func(b []byte) { got <- b })
+	if err := server.WriteControl([]byte("hint")); err != nil {
+		t.Fatal(err)
+	}
+	if b := <-got; string(b) != "hint" {
+		t.Fatalf("control message = %q", b)
+	}
+
+	// sessions without a handler ignore control messages
+	if err := client.WriteControl([]byte("hint")); err != nil {
+		t.Fatal(err)
+	}
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	a, b := net.Pipe()
+	client := Client(a, nil)
+	server := Server(b, &Config{MaxStreams: 1, Window: 4 * initialWindow, ReadBuffer: 4096})
+	defer client.Close()
+	defer server.Close()
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the larger window of the server lets the client write more before it is read
+	st.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := st.Write(make([]byte, 8*initialWindow)); !errors.Is(err, os.ErrDeadlineExceeded) || n != 4*initialWindow {
+		t.Fatalf("Write beyond window = %d, %v", n, err)
+	}
+
+	// streams beyond MaxStreams are ended right away
+	st2, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st2.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read of stream beyond MaxStreams: %v", err)
+	}
+}
+
+func TestRecvLoopDoesNotWrite(t *testing.T) {
+	a, b := net.Pipe()
+	server := Server(b, &Config{MaxStreams: 1, Window: 2 * initialWindow})
+	defer server.Close()
+	defer a.Close()
+
+	// a peer writing streams without reading: the frames the server sends in return must
+	// not keep it from reading on
+	a.SetWriteDeadline(time.Now().Add(time.Second))
+	hdr := make([]byte, headerSize)
+	for id := uint32(1); id < 200; id += 2 {
+		hdr[0] = cmdSYN
+		binary.BigEndian.PutUint32(hdr[4:], id)
+		if _, err := a.Write(hdr); err != nil {
+			t.Fatalf("write SYN %d: %v", id, err)
+		}
+	}
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	client, server := pair()
+	defer client.Close()
+	defer server.Close()
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is read, so writes together take no more than the window
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+			st.Write(make([]byte, initialWindow/2))
+		}()
+	}
+	wg.Wait()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.window != 0 {
+		t.Fatalf("window after writes = %d, want 0", st.window)
+	}
+}
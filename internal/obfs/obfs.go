@@ -0,0 +1,408 @@
+// Package obfs implements the HTTP and TLS obfuscation of simple-obfs, which disguise a
+// stream as a WebSocket upgrade or a resumed TLS 1.2 session. Neither hides anything from
+// an active prober: they only fool passive classification by the first bytes.
+package obfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var errProtocol = errors.New("obfs: protocol error")
+
+// HTTPClient returns a connection over c that sends a WebSocket upgrade request for host
+// with its first write and skips the response before its first read.
+func HTTPClient(c net.Conn, host string) net.Conn {
+	return &httpConn{Conn: c, br: bufio.NewReader(c), host: host, client: true}
+}
+
+// HTTPServer returns a connection over c that skips the upgrade request of an HTTPClient
+// before its first read and sends a response with its first write.
+func HTTPServer(c net.Conn) net.Conn {
+	return &httpConn{Conn: c, br: bufio.NewReader(c)}
+}
+
+type httpConn struct {
+	net.Conn
+	br     *bufio.Reader
+	host   string
+	client bool
+
+	rmu  sync.Mutex
+	read bool // whether the header of the peer has been read
+	rerr error
+	key  string // Sec-WebSocket-Key of the request, on servers
+
+	wmu   sync.Mutex
+	wrote bool
+}
+
+// NetConn returns the underlying connection.
+func (c *httpConn) NetConn() net.Conn { return c.Conn }
+
+func (c *httpConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if !c.read {
+		c.read = true
+		c.rerr = c.readHeader()
+	}
+	if c.rerr != nil {
+		return 0, c.rerr
+	}
+	return c.br.Read(b)
+}
+
+func (c *httpConn) readHeader() error {
+	if c.client {
+		resp, err := http.ReadResponse(c.br, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			return fmt.Errorf("obfs: unexpected response %s", resp.Status)
+		}
+		return nil
+	}
+	req, err := http.ReadRequest(c.br)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return errProtocol
+	}
+	c.wmu.Lock()
+	c.key = req.Header.Get("Sec-WebSocket-Key")
+	c.wmu.Unlock()
+	// the body announced by Content-Length is the start of the stream: leave it in br
+	return nil
+}
+
+func (c *httpConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wrote {
+		return c.Conn.Write(b)
+	}
+	c.wrote = true
+	var buf bytes.Buffer
+	if c.client {
+		var nonce [16]byte
+		rand.Read(nonce[:])
+		fmt.Fprintf(&buf, "GET / HTTP/1.1\r\nHost: %s\r\nUser-Agent: curl/7.%d.%d\r\n", c.host, mrand.Intn(51), mrand.Intn(2))
+		fmt.Fprintf(&buf, "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\n", base64.StdEncoding.EncodeToString(nonce[:]))
+		fmt.Fprintf(&buf, "Content-Length: %d\r\n\r\n", len(b))
+	} else {
+		h := sha1.New()
+		h.Write([]byte(c.key + acceptGUID))
+		fmt.Fprintf(&buf, "HTTP/1.1 101 Switching Protocols\r\nServer: nginx/1.%d.%d\r\nDate: %s\r\n", mrand.Intn(11), mrand.Intn(12), time.Now().UTC().Format(http.TimeFormat))
+		fmt.Fprintf(&buf, "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	}
+	buf.Write(b)
+	if _, err := c.Conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+const (
+	recordChangeCipherSpec = 0x14
+	recordAlert            = 0x15
+	recordHandshake        = 0x16
+	recordAppData          = 0x17
+
+	headerSize    = 5
+	maxPayload    = 1 << 14
+	maxRecordSize = headerSize + maxPayload + 2048
+
+	extServerName    = 0x0000
+	extSessionTicket = 0x0023
+)
+
+// cipherSuites are the cipher suites offered in client hellos.
+var cipherSuites = []byte{
+	0xc0, 0x2c, 0xc0, 0x30, 0x00, 0x9f, 0xcc, 0xa9, 0xcc, 0xa8, 0xcc, 0xaa, 0xc0, 0x2b, 0xc0, 0x2f,
+	0x00, 0x9e, 0xc0, 0x24, 0xc0, 0x28, 0x00, 0x6b, 0xc0, 0x23, 0xc0, 0x27, 0x00, 0x67, 0xc0, 0x0a,
+	0xc0, 0x14, 0x00, 0x39, 0xc0, 0x09, 0xc0, 0x13, 0x00, 0x33, 0x00, 0x9d, 0x00, 0x9c, 0x00, 0x3d,
+	0x00, 0x3c, 0x00, 0x35, 0x00, 0x2f, 0x00, 0xff,
+}
+
+// clientExtensions are the extensions of client hellos after session ticket and server name:
+// EC point formats, supported groups, signature algorithms, encrypt-then-MAC and extended
+// master secret.
+var clientExtensions = []byte{
+	0x00, 0x0b, 0x00, 0x04, 0x03, 0x00, 0x01, 0x02,
+	0x00, 0x0a, 0x00, 0x0a, 0x00, 0x08, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x19, 0x00, 0x18,
+	0x00, 0x0d, 0x00, 0x20, 0x00, 0x1e,
+	0x06, 0x01, 0x06, 0x02, 0x06, 0x03, 0x05, 0x01, 0x05, 0x02, 0x05, 0x03, 0x04, 0x01, 0x04, 0x02,
+	0x04, 0x03, 0x03, 0x01, 0x03, 0x02, 0x03, 0x03, 0x02, 0x01, 0x02, 0x02, 0x02, 0x03,
+	0x00, 0x16, 0x00, 0x00,
+	0x00, 0x17, 0x00, 0x00,
+}
+
+// serverExtensions are the extensions of server hellos: renegotiation info, extended master
+// secret and EC point formats.
+var serverExtensions = []byte{
+	0xff, 0x01, 0x00, 0x01, 0x00,
+	0x00, 0x17, 0x00, 0x00,
+	0x00, 0x0b, 0x00, 0x02, 0x01, 0x00,
+}
+
+// TLSClient returns a connection over c that sends a TLS client hello for host with its
+// first write, carrying the data in the session ticket, and TLS application data records
+// afterwards.
+func TLSClient(c net.Conn, host string) net.Conn {
+	return &tlsConn{Conn: c, br: bufio.NewReader(c), host: host, client: true}
+}
+
+// TLSServer returns a connection over c that takes the data of a TLSClient from the
+// session ticket of its client hello and answers with a server hello with its first write.
+func TLSServer(c net.Conn) net.Conn {
+	return &tlsConn{Conn: c, br: bufio.NewReader(c)}
+}
+
+type tlsConn struct {
+	net.Conn
+	br     *bufio.Reader
+	host   string
+	client bool
+
+	rmu       sync.Mutex
+	hello     bool   // whether the hello of the peer has been read
+	pending   []byte // data of the client hello not yet read, on servers
+	remaining int    // payload bytes of the current record not yet read
+
+	wmu       sync.Mutex
+	wrote     bool
+	sessionID []byte // of the client hello, on servers
+}
+
+// NetConn returns the underlying connection.
+func (c *tlsConn) NetConn() net.Conn { return c.Conn }
+
+func (c *tlsConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	for c.remaining == 0 {
+		var hdr [headerSize]byte
+		if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint16(hdr[3:]))
+		if n > maxRecordSize-headerSize {
+			return 0, errProtocol
+		}
+		switch {
+		case !c.hello:
+			if hdr[0] != recordHandshake {
+				return 0, errProtocol
+			}
+			c.hello = true
+			rec := make([]byte, n)
+			if _, err := io.ReadFull(c.br, rec); err != nil {
+				return 0, err
+			}
+			if c.client {
+				continue
+			}
+			sessionID, ticket, err := parseClientHello(rec)
+			if err != nil {
+				return 0, err
+			}
+			c.wmu.Lock()
+			c.sessionID = sessionID
+			c.wmu.Unlock()
+			if len(ticket) > 0 {
+				n := copy(b, ticket)
+				c.pending = ticket[n:]
+				return n, nil
+			}
+		case hdr[0] == recordHandshake || hdr[0] == recordAppData:
+			c.remaining = n
+		case hdr[0] == recordChangeCipherSpec:
+			if _, err := c.br.Discard(n); err != nil {
+				return 0, err
+			}
+		case hdr[0] == recordAlert:
+			return 0, io.EOF
+		default:
+			return 0, errProtocol
+		}
+	}
+	if len(b) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	c.remaining -= n
+	return n, err
+}
+
+// parseClientHello returns the session ID and session ticket of the client hello in the
+// handshake record payload rec.
+func parseClientHello(rec []byte) (sessionID, ticket []byte, err error) {
+	// handshake type and length, version, random
+	if len(rec) < 4+2+32+1 || rec[0] != 1 {
+		return nil, nil, errProtocol
+	}
+	p := rec[4+2+32:]
+	next := func(lenSize int) []byte {
+		if len(p) < lenSize {
+			p = nil
+			return nil
+		}
+		n := 0
+		for _, b := range p[:lenSize] {
+			n = n<<8 | int(b)
+		}
+		if len(p) < lenSize+n {
+			p = nil
+			return nil
+		}
+		v := p[lenSize : lenSize+n]
+		p = p[lenSize+n:]
+		return v
+	}
+	sessionID = next(1)
+	next(2) // cipher suites
+	next(1) // compression methods
+	exts := next(2)
+	if p == nil {
+		return nil, nil, errProtocol
+	}
+	for p = exts; len(p) >= 4; {
+		typ := binary.BigEndian.Uint16(p)
+		p = p[2:]
+		data := next(2)
+		if p == nil {
+			return nil, nil, errProtocol
+		}
+		if typ == extSessionTicket {
+			return sessionID, data, nil
+		}
+	}
+	return sessionID, nil, nil
+}
+
+func (c *tlsConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var buf []byte
+	rest := b
+	if !c.wrote {
+		c.wrote = true
+		if c.client {
+			buf, rest = c.clientHello(rest)
+		} else {
+			buf = c.serverHello()
+			n := len(rest)
+			if n > maxPayload {
+				n = maxPayload
+			}
+			buf = appendRecord(buf, recordHandshake, rest[:n])
+			rest = rest[n:]
+		}
+	}
+	for len(rest) > 0 {
+		n := len(rest)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		buf = appendRecord(buf, recordAppData, rest[:n])
+		rest = rest[n:]
+	}
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func appendRecord(buf []byte, typ byte, payload []byte) []byte {
+	buf = append(buf, typ, 0x03, 0x03, byte(len(payload)>>8), byte(len(payload)))
+	return append(buf, payload...)
+}
+
+// random returns the random of a hello: the time followed by random bytes.
+func random() []byte {
+	r := make([]byte, 32)
+	binary.BigEndian.PutUint32(r, uint32(time.Now().Unix()))
+	rand.Read(r[4:])
+	return r
+}
+
+// clientHello returns the record of a client hello carrying as much of b as fits into its
+// session ticket, and the rest of b.
+func (c *tlsConn) clientHello(b []byte) ([]byte, []byte) {
+	sessionID := make([]byte, 32)
+	rand.Read(sessionID)
+	name := []byte(c.host)
+	fixed := 4 + 2 + 32 + 1 + len(sessionID) + 2 + len(cipherSuites) + 2 + 2 + 4 + 9 + len(name) + len(clientExtensions)
+	n := len(b)
+	if n > maxPayload-fixed {
+		n = maxPayload - fixed
+	}
+	ticket, rest := b[:n], b[n:]
+
+	var ext []byte
+	ext = append(ext, extSessionTicket>>8, extSessionTicket&0xff, byte(len(ticket)>>8), byte(len(ticket)))
+	ext = append(ext, ticket...)
+	ext = append(ext, extServerName>>8, extServerName&0xff, byte((len(name)+5)>>8), byte(len(name)+5),
+		byte((len(name)+3)>>8), byte(len(name)+3), 0, byte(len(name)>>8), byte(len(name)))
+	ext = append(ext, name...)
+	ext = append(ext, clientExtensions...)
+
+	var body []byte
+	body = append(body, 0x03, 0x03)
+	body = append(body, random()...)
+	body = append(body, byte(len(sessionID)))
+	body = append(body, sessionID...)
+	body = append(body, byte(len(cipherSuites)>>8), byte(len(cipherSuites)))
+	body = append(body, cipherSuites...)
+	body = append(body, 1, 0) // null compression
+	body = append(body, byte(len(ext)>>8), byte(len(ext)))
+	body = append(body, ext...)
+
+	hs := append([]byte{1, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+	rec := []byte{recordHandshake, 0x03, 0x01, byte(len(hs) >> 8), byte(len(hs))}
+	return append(rec, hs...), rest
+}
+
+// serverHello returns the records of a server hello and a change cipher spec.
+func (c *tlsConn) serverHello() []byte {
+	sessionID := c.sessionID
+	if sessionID == nil {
+		sessionID = make([]byte, 32)
+		rand.Read(sessionID)
+	}
+	var body []byte
+	body = append(body, 0x03, 0x03)
+	body = append(body, random()...)
+	body = append(body, byte(len(sessionID)))
+	body = append(body, sessionID...)
+	body = append(body, 0xcc, 0xa8, 0) // ECDHE-RSA-CHACHA20-POLY1305, null compression
+	body = append(body, byte(len(serverExtensions)>>8), byte(len(serverExtensions)))
+	body = append(body, serverExtensions...)
+
+	hs := append([]byte{2, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+	buf := appendRecord(nil, recordHandshake, hs)
+	return appendRecord(buf, recordChangeCipherSpec, []byte{1})
+}
@@ -0,0 +1,50 @@
+package obfs
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func testConn(t *testing.T, client, server func(net.Conn) net.Conn) {
+	cc, sc := net.Pipe()
+	c, s := client(cc), server(sc)
+	defer c.Close()
+	defer s.Close()
+
+	for _, size := range []int{1, 100, maxPayload, 3*maxPayload + 7} {
+		msg := make([]byte, size)
+		rand.Read(msg)
+		go c.Write(msg)
+		got := make([]byte, size)
+		if _, err := io.ReadFull(s, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("server read %d bytes: %v", size, err)
+		}
+		go s.Write(msg)
+		if _, err := io.ReadFull(c, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("client read %d bytes: %v", size, err)
+		}
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	testConn(t, func(c net.Conn) net.Conn { return HTTPClient(c, "example.com") }, HTTPServer)
+}
+
+func TestTLS(t *testing.T) {
+	testConn(t, func(c net.Conn) net.Conn { return TLSClient(c, "example.com") }, TLSServer)
+}
+
+func TestParseClientHello(t *testing.T) {
+	c := &tlsConn{host: "example.com", client: true}
+	rec, rest := c.clientHello([]byte("ticket"))
+	if len(rest) != 0 {
+		t.Fatalf("%d bytes left", len(rest))
+	}
+	sessionID, ticket, err := parseClientHello(rec[headerSize:])
+	if err != nil || len(sessionID) != 32 || string(ticket) != "ticket" {
+		t.Fatalf("got session ID %x and ticket %q: %v", sessionID, ticket, err)
+	}
+}
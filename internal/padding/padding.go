@@ -0,0 +1,164 @@
+// Package padding implements a layer beneath the cipher that hides the sizes and timing of
+// writes from traffic analysis. The stream is carried in frames of a few configured sizes:
+//
+//	[length of data, uint16][length of padding, uint16][data][padding]
+//
+// with integers big-endian and random padding. Data is split into frames of the largest
+// size and the rest padded to the smallest size it fits, and frames without data are sent
+// when the connection is idle. Both ends need the same configuration. The headers are only
+// hidden if the connection is encrypted below, e.g. by a TLS transport.
+package padding
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	headerSize = 4
+	maxFrame   = 16 << 10
+)
+
+var errProtocol = errors.New("padding: protocol error")
+
+// Config configures the padding layer.
+type Config struct {
+	// Sizes are the sizes frames are padded to, in bytes including the header.
+	Sizes []int
+	// Idle is how long a connection may go without writes before a frame without data
+	// is sent, randomly up to half as long again. 0 sends no such frames.
+	Idle time.Duration
+}
+
+// Validate checks that the sizes of c fit at least a byte of data and at most 16 KiB, and
+// sorts them.
+func (c *Config) Validate() error {
+	if len(c.Sizes) == 0 {
+		return errors.New("padding: no frame sizes")
+	}
+	sort.Ints(c.Sizes)
+	if c.Sizes[0] <= headerSize || c.Sizes[len(c.Sizes)-1] > maxFrame {
+		return errors.New("padding: frame sizes must be between 5 and 16384 bytes")
+	}
+	return nil
+}
+
+// Conn is a connection carried in padded frames.
+type Conn struct {
+	net.Conn
+	config *Config
+	buf    []byte // data read but not returned yet
+
+	wmu       sync.Mutex
+	lastWrite time.Time
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New returns a connection over c padded as configured by config, which has been validated.
+func New(c net.Conn, config *Config) *Conn {
+	pc := &Conn{Conn: c, config: config, lastWrite: time.Now(), done: make(chan struct{})}
+	if config.Idle > 0 {
+		go pc.idle()
+	}
+	return pc
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn { return c.Conn }
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for len(c.buf) == 0 {
+		var hdr [headerSize]byte
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		n, pad := int(binary.BigEndian.Uint16(hdr[:])), int(binary.BigEndian.Uint16(hdr[2:]))
+		if headerSize+n+pad > maxFrame {
+			return 0, errProtocol
+		}
+		frame := make([]byte, n+pad)
+		if _, err := io.ReadFull(c.Conn, frame); err != nil {
+			return 0, err
+		}
+		c.buf = frame[:n]
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.lastWrite = time.Now()
+	sizes := c.config.Sizes
+	n := 0
+	for len(b) > 0 {
+		k := len(b)
+		if max := sizes[len(sizes)-1] - headerSize; k > max {
+			k = max
+		}
+		if err := c.writeFrame(b[:k], c.size(k)); err != nil {
+			return n, err
+		}
+		b = b[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// size returns the smallest frame size fitting n bytes of data.
+func (c *Conn) size(n int) int {
+	for _, s := range c.config.Sizes {
+		if s >= headerSize+n {
+			return s
+		}
+	}
+	return c.config.Sizes[len(c.config.Sizes)-1]
+}
+
+func (c *Conn) writeFrame(data []byte, size int) error {
+	pad := size - headerSize - len(data)
+	frame := make([]byte, size)
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	binary.BigEndian.PutUint16(frame[2:], uint16(pad))
+	copy(frame[headerSize:], data)
+	rand.Read(frame[headerSize+len(data):])
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// idle sends a frame without data of a random size whenever the connection was idle.
+func (c *Conn) idle() {
+	for {
+		d := c.config.Idle + time.Duration(mrand.Int63n(int64(c.config.Idle/2)+1))
+		select {
+		case <-time.After(d):
+		case <-c.done:
+			return
+		}
+		c.wmu.Lock()
+		var err error
+		if time.Since(c.lastWrite) >= c.config.Idle {
+			err = c.writeFrame(nil, c.config.Sizes[mrand.Intn(len(c.config.Sizes))])
+			c.lastWrite = time.Now()
+		}
+		c.wmu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
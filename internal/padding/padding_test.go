@@ -0,0 +1,66 @@
+package padding
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConn(t *testing.T) {
+	config := &Config{Sizes: []int{1400, 64, 512}, Idle: 10 * time.Millisecond}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cc, sc := net.Pipe()
+	c, s := New(cc, config), New(sc, config)
+	defer c.Close()
+	defer s.Close()
+
+	time.Sleep(50 * time.Millisecond) // frames without data are skipped
+	for _, size := range []int{1, 100, 1396, 3*1396 + 7} {
+		msg := make([]byte, size)
+		rand.Read(msg)
+		go c.Write(msg)
+		got := make([]byte, size)
+		if _, err := io.ReadFull(s, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("server read %d bytes: %v", size, err)
+		}
+		go s.Write(msg)
+		if _, err := io.ReadFull(c, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("client read %d bytes: %v", size, err)
+		}
+	}
+}
+
+func TestFrameSizes(t *testing.T) {
+	config := &Config{Sizes: []int{64, 512, 1400}}
+	cc, sc := net.Pipe()
+	c := New(cc, config)
+	defer c.Close()
+	defer sc.Close()
+
+	go c.Write(make([]byte, 1500))
+	for _, want := range []int{1400, 512} {
+		var hdr [headerSize]byte
+		if _, err := io.ReadFull(sc, hdr[:]); err != nil {
+			t.Fatal(err)
+		}
+		n, pad := int(hdr[0])<<8|int(hdr[1]), int(hdr[2])<<8|int(hdr[3])
+		if headerSize+n+pad != want {
+			t.Fatalf("frame of %d bytes, want %d", headerSize+n+pad, want)
+		}
+		io.CopyN(ioutil.Discard, sc, int64(n+pad))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, sizes := range [][]int{nil, {4, 100}, {100, 20000}} {
+		if err := (&Config{Sizes: sizes}).Validate(); err == nil {
+			t.Errorf("Validate accepted %v", sizes)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Package policy signs and verifies revocation policies: lists of revoked key IDs that an
+// organization signs with Ed25519 and publishes for its clients to check.
+package policy
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+)
+
+// ErrSignature is returned by Verify for policies not signed with the given key.
+var ErrSignature = errors.New("policy: invalid signature")
+
+// Policy lists the revoked key IDs as of Issued.
+type Policy struct {
+	Issued  int64    `json:"issued"` // Unix time, so that clients can reject older policies
+	Revoked []string `json:"revoked"`
+}
+
+// IsRevoked reports whether the key ID id is revoked.
+func (p *Policy) IsRevoked(id string) bool {
+	for _, r := range p.Revoked {
+		if r == id {
+			return true
+		}
+	}
+	return false
+}
+
+// envelope is the published form of a policy: its JSON encoding and the signature of it,
+// both base64 encoded.
+type envelope struct {
+	Policy    []byte `json:"policy"`
+	Signature []byte `json:"signature"`
+}
+
+// Sign returns the published form of p signed with key.
+func Sign(key ed25519.PrivateKey, p *Policy) ([]byte, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope{b, ed25519.Sign(key, b)})
+}
+
+// Verify returns the policy published as b if it is signed with the private key of key.
+func Verify(key ed25519.PublicKey, b []byte) (*Policy, error) {
+	var e envelope
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, e.Policy, e.Signature) {
+		return nil, ErrSignature
+	}
+	var p Policy
+	if err := json.Unmarshal(e.Policy, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
@@ -0,0 +1,32 @@
+package policy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestSignVerify(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	b, err := Sign(priv, &Policy{Issued: 1700000000, Revoked: []string{"laptop-1", "phone-2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Verify(pub, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Issued != 1700000000 || !p.IsRevoked("phone-2") || p.IsRevoked("laptop-2") {
+		t.Errorf("got %+v", p)
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	if _, err := Verify(other, b); err != ErrSignature {
+		t.Errorf("verified with another key: %v", err)
+	}
+	i := bytes.Index(b, []byte(`"signature"`)) - 4 // a byte of the encoded policy
+	b[i] ^= 1
+	if _, err := Verify(pub, b); err == nil {
+		t.Error("verified a tampered policy")
+	}
+}
@@ -0,0 +1,500 @@
+// Package pollconn carries a stream over a channel of requests and responses that only the
+// client can send on, such as DNS queries or ICMP echo requests. The client sends data in
+// requests and the server answers with data in responses, so the client polls the server
+// while waiting for data. Carriers such as the dnstt package frame the requests and tell
+// the sessions of clients apart; the payload of requests and responses alike is
+//
+//	[flags][offset of data, uint32][offset of data to receive, uint32][data]
+//
+// with integers big-endian. Offsets count the bytes sent in each direction, so that lost
+// requests and responses are simply sent again: each side sends from the offset the other
+// has received. A side sets flagFIN once it has closed and sent all data. The server answers
+// requests of sessions it does not know with flagRST.
+package pollconn
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Header is the size of the header of payloads.
+const Header = 9
+
+const (
+	flagFIN = 1 << iota
+	flagRST
+)
+
+const (
+	window         = 64 << 10 // data buffered in either direction at most
+	maxFailures    = 15       // requests in a row without response before a client gives up
+	pollMin        = 50 * time.Millisecond
+	pollMax        = time.Second
+	sessionTimeout = 2 * time.Minute // without requests before a server drops a session
+	acceptBacklog  = 16
+)
+
+var (
+	errReset   = errors.New("pollconn: session reset by server")
+	errTimeout = errors.New("pollconn: session timed out")
+)
+
+// stream holds the buffers of one end of a session.
+type stream struct {
+	laddr, raddr net.Addr
+
+	mu     sync.Mutex
+	send   []byte // written, from offset sent
+	sent   uint32 // of data the peer has received
+	recv   []byte // received, not read yet
+	recvd  uint32 // offset of data received
+	closed bool   // by Close
+	eof    bool   // by the peer
+	err    error
+
+	readable, writable chan struct{} // signaled on changes, with capacity 1
+	wake               chan struct{} // signaled on writes and reads, with capacity 1
+	done               chan struct{} // closed by Close
+	rd, wd             deadline
+}
+
+func newStream(laddr, raddr net.Addr) *stream {
+	return &stream{
+		laddr:    laddr,
+		raddr:    raddr,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		rd:       makeDeadline(),
+		wd:       makeDeadline(),
+	}
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// receive takes data at offset off from the peer, as far as it is new and fits. Once the
+// stream is closed, data is discarded as it is received.
+func (s *stream) receive(off uint32, data []byte) {
+	if off > s.recvd || off+uint32(len(data)) <= s.recvd {
+		return
+	}
+	data = data[s.recvd-off:]
+	if s.closed {
+		s.recvd += uint32(len(data))
+		return
+	}
+	if room := window - len(s.recv); len(data) > room {
+		data = data[:room]
+	}
+	s.recv = append(s.recv, data...)
+	s.recvd += uint32(len(data))
+	signal(s.readable)
+}
+
+// acknowledge drops the data before offset off, which the peer has received.
+func (s *stream) acknowledge(off uint32) {
+	if n := off - s.sent; off > s.sent && int(n) <= len(s.send) {
+		s.send = s.send[n:]
+		s.sent = off
+		signal(s.writable)
+	}
+}
+
+// payload returns the next payload to send, with up to maxData bytes of data.
+func (s *stream) payload(maxData int) []byte {
+	if maxData < 0 {
+		maxData = 0
+	}
+	data := s.send
+	if len(data) > maxData {
+		data = data[:maxData]
+	}
+	p := make([]byte, Header, Header+len(data))
+	if s.closed && len(data) == len(s.send) {
+		p[0] = flagFIN
+	}
+	binary.BigEndian.PutUint32(p[1:], s.sent)
+	binary.BigEndian.PutUint32(p[5:], s.recvd)
+	return append(p, data...)
+}
+
+// take processes the payload p from the peer, which has at least Header bytes.
+func (s *stream) take(p []byte) {
+	off, data := binary.BigEndian.Uint32(p[1:]), p[Header:]
+	s.acknowledge(binary.BigEndian.Uint32(p[5:]))
+	s.receive(off, data)
+	if p[0]&flagFIN != 0 && off+uint32(len(data)) == s.recvd {
+		s.eof = true
+		signal(s.readable)
+	}
+}
+
+// fail ends the stream with err.
+func (s *stream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	signal(s.readable)
+	signal(s.writable)
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if len(s.recv) > 0 {
+			n := copy(b, s.recv)
+			s.recv = s.recv[n:]
+			s.mu.Unlock()
+			signal(s.wake)
+			return n, nil
+		}
+		closed, eof, err := s.closed, s.eof, s.err
+		s.mu.Unlock()
+		switch {
+		case closed:
+			return 0, net.ErrClosed
+		case eof:
+			return 0, io.EOF
+		case err != nil:
+			return 0, err
+		}
+		select {
+		case <-s.readable:
+		case <-s.rd.wait():
+			return 0, timeoutError{}
+		case <-s.done:
+		}
+	}
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		s.mu.Lock()
+		if s.closed || s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			if err == nil {
+				err = net.ErrClosed
+			}
+			return n, err
+		}
+		k := window - len(s.send)
+		if k > len(b) {
+			k = len(b)
+		}
+		s.send = append(s.send, b[:k]...)
+		s.mu.Unlock()
+		b = b[k:]
+		n += k
+		if k > 0 {
+			signal(s.wake)
+			continue
+		}
+		select {
+		case <-s.writable:
+		case <-s.wd.wait():
+			return n, timeoutError{}
+		case <-s.done:
+		}
+	}
+	return n, nil
+}
+
+// Close closes the stream. Data written is still sent, before the peer reads io.EOF.
+func (s *stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.recv = nil
+	close(s.done)
+	signal(s.wake)
+	return nil
+}
+
+func (s *stream) LocalAddr() net.Addr  { return s.laddr }
+func (s *stream) RemoteAddr() net.Addr { return s.raddr }
+
+func (s *stream) SetDeadline(t time.Time) error {
+	s.rd.set(t)
+	s.wd.set(t)
+	return nil
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	s.rd.set(t)
+	return nil
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	s.wd.set(t)
+	return nil
+}
+
+// A Carrier sends the requests of a client session to the server.
+type Carrier interface {
+	// Exchange sends a request with payload p and returns the payload of the response, or
+	// an error if none arrived in time.
+	Exchange(p []byte) ([]byte, error)
+	// Close is called once the session has ended.
+	Close() error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// Dial opens a session through carrier, sending up to maxData bytes of data per request.
+func Dial(carrier Carrier, maxData int) net.Conn {
+	c := &clientConn{
+		stream:  newStream(carrier.LocalAddr(), carrier.RemoteAddr()),
+		carrier: carrier,
+		maxData: maxData,
+	}
+	go c.loop()
+	return c
+}
+
+// clientConn is the client end of a session.
+type clientConn struct {
+	*stream
+	carrier Carrier
+	maxData int
+}
+
+// loop sends the requests of the session until it ends.
+func (c *clientConn) loop() {
+	defer c.carrier.Close()
+	poll, failures := pollMin, 0
+	for {
+		c.mu.Lock()
+		req := c.payload(c.maxData)
+		last := c.closed && len(c.send) == 0
+		c.mu.Unlock()
+
+		resp, err := c.carrier.Exchange(req)
+		if err != nil {
+			if failures++; failures >= maxFailures {
+				c.fail(err)
+				return
+			}
+			continue
+		}
+		failures = 0
+		if len(resp) < Header {
+			continue
+		}
+		if resp[0]&flagRST != 0 {
+			c.fail(errReset)
+			return
+		}
+		if last {
+			return // the server has all data
+		}
+
+		c.mu.Lock()
+		sent, recvd := c.sent, c.recvd
+		c.take(resp)
+		progress := c.sent != sent || c.recvd != recvd || len(c.send) > 0 || c.closed
+		idle := c.eof || len(c.recv) >= window // nothing to poll for
+		c.mu.Unlock()
+
+		if progress {
+			poll = pollMin
+			continue
+		}
+		wait := poll
+		if idle {
+			wait = pollMax
+		} else if poll *= 2; poll > pollMax {
+			poll = pollMax
+		}
+		select {
+		case <-c.wake:
+			poll = pollMin
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Server serves the sessions of clients from the requests handed to it by a carrier.
+type Server struct {
+	laddr net.Addr
+
+	mu       sync.Mutex
+	sessions map[string]*serverConn
+	accepts  chan net.Conn
+	done     chan struct{}
+	err      error // set before done is closed
+}
+
+// NewServer returns a server whose sessions have the local address laddr.
+func NewServer(laddr net.Addr) *Server {
+	s := &Server{
+		laddr:    laddr,
+		sessions: make(map[string]*serverConn),
+		accepts:  make(chan net.Conn, acceptBacklog),
+		done:     make(chan struct{}),
+	}
+	go s.expire()
+	return s
+}
+
+// Accept waits for and returns the next session.
+func (s *Server) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accepts:
+		return c, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// Close fails all sessions with err, which Accept returns from then on.
+func (s *Server) Close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	for _, c := range s.sessions {
+		go c.fail(err)
+	}
+	s.err = err
+	close(s.done)
+}
+
+// Handle takes the payload p of a request of the session identified by key, from a client
+// at addr, and returns the payload of the response with up to maxData bytes of data. p must
+// have at least Header bytes.
+func (s *Server) Handle(key string, p []byte, maxData int, addr net.Addr) []byte {
+	s.mu.Lock()
+	c := s.sessions[key]
+	if c == nil {
+		fresh := binary.BigEndian.Uint32(p[1:]) == 0 && binary.BigEndian.Uint32(p[5:]) == 0 && p[0]&flagFIN == 0
+		if !fresh || s.err != nil || len(s.accepts) == cap(s.accepts) {
+			s.mu.Unlock()
+			resp := make([]byte, Header)
+			resp[0] = flagRST
+			return resp
+		}
+		c = &serverConn{stream: newStream(s.laddr, addr)}
+		s.sessions[key] = c
+		s.accepts <- c
+	}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.lastSeen = time.Now()
+	c.take(p)
+	resp := c.payload(maxData)
+	finished := c.eof && c.closed && len(c.send) == 0
+	c.mu.Unlock()
+
+	if finished {
+		s.mu.Lock()
+		delete(s.sessions, key)
+		s.mu.Unlock()
+	}
+	return resp
+}
+
+// expire drops the sessions without requests for sessionTimeout.
+func (s *Server) expire() {
+	for {
+		select {
+		case <-time.After(sessionTimeout / 4):
+		case <-s.done:
+			return
+		}
+		s.mu.Lock()
+		for key, c := range s.sessions {
+			c.mu.Lock()
+			idle := time.Since(c.lastSeen) > sessionTimeout
+			c.mu.Unlock()
+			if idle {
+				delete(s.sessions, key)
+				go c.fail(errTimeout)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// serverConn is the server end of a session.
+type serverConn struct {
+	*stream
+	lastSeen time.Time // of the last request, guarded by mu of stream
+}
+
+// timeoutError is returned by operations past their deadline.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// deadline is a channel closed once a deadline passes, as in net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline { return deadline{cancel: make(chan struct{})} }
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() { close(d.cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
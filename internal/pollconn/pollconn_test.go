@@ -0,0 +1,75 @@
+package pollconn
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// lossyCarrier hands requests to a server in memory, losing some requests and responses.
+type lossyCarrier struct {
+	server *Server
+	key    string
+	addr   net.Addr
+}
+
+func (c *lossyCarrier) Exchange(p []byte) ([]byte, error) {
+	if rand.Intn(5) == 0 {
+		return nil, errors.New("request lost")
+	}
+	resp := c.server.Handle(c.key, append([]byte(nil), p...), 300, c.addr)
+	if rand.Intn(5) == 0 {
+		return nil, errors.New("response lost")
+	}
+	return resp, nil
+}
+
+func (c *lossyCarrier) Close() error         { return nil }
+func (c *lossyCarrier) LocalAddr() net.Addr  { return c.addr }
+func (c *lossyCarrier) RemoteAddr() net.Addr { return c.addr }
+
+func TestLossySession(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	server := NewServer(addr)
+	defer server.Close(io.EOF)
+	c := Dial(&lossyCarrier{server: server, key: "a", addr: addr}, 100)
+
+	up := make([]byte, 3000)
+	rand.Read(up)
+	go c.Write(up)
+	s, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(up))
+	if _, err := io.ReadFull(s, got); err != nil || !bytes.Equal(got, up) {
+		t.Fatalf("server read: %v", err)
+	}
+
+	down := make([]byte, 10000)
+	rand.Read(down)
+	s.Write(down)
+	s.Close()
+	if got, err := ioutil.ReadAll(c); err != nil || !bytes.Equal(got, down) {
+		t.Fatalf("client read %d bytes: %v", len(got), err)
+	}
+	c.Close()
+}
+
+func TestReset(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	server := NewServer(addr)
+	p := make([]byte, Header)
+	p[1] = 1 // not the start of a session
+	if resp := server.Handle("b", p, 100, addr); resp[0]&flagRST == 0 {
+		t.Fatal("unknown session not reset")
+	}
+	server.Close(io.EOF)
+	if _, err := server.Accept(); err != io.EOF {
+		t.Fatalf("Accept after Close = %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+// +build go1.24
+
+package pqkex
+
+import (
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"crypto/rand"
+	"io"
+)
+
+// Client runs the exchange as the client over rw and returns the session key.
+func Client(rw io.ReadWriter) ([]byte, error) {
+	x, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	hello := append(x.PublicKey().Bytes(), dk.EncapsulationKey().Bytes()...)
+	if _, err := rw.Write(hello); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, serverSize)
+	if _, err := io.ReadFull(rw, reply); err != nil {
+		return nil, err
+	}
+
+	peer, err := ecdh.X25519().NewPublicKey(reply[:x25519Size])
+	if err != nil {
+		return nil, errKey
+	}
+	xSecret, err := x.ECDH(peer)
+	if err != nil {
+		return nil, errKey
+	}
+	kemSecret, err := dk.Decapsulate(reply[x25519Size:])
+	if err != nil {
+		return nil, errKey
+	}
+	return sessionKey(xSecret, kemSecret, hello, reply), nil
+}
+
+// Server runs the exchange as the server over rw and returns the session key.
+func Server(rw io.ReadWriter) ([]byte, error) {
+	hello := make([]byte, clientSize)
+	if _, err := io.ReadFull(rw, hello); err != nil {
+		return nil, err
+	}
+	peer, err := ecdh.X25519().NewPublicKey(hello[:x25519Size])
+	if err != nil {
+		return nil, errKey
+	}
+	ek, err := mlkem.NewEncapsulationKey768(hello[x25519Size:])
+	if err != nil {
+		return nil, errKey
+	}
+
+	x, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	xSecret, err := x.ECDH(peer)
+	if err != nil {
+		return nil, errKey
+	}
+	kemSecret, ciphertext := ek.Encapsulate()
+	reply := append(x.PublicKey().Bytes(), ciphertext...)
+	if _, err := rw.Write(reply); err != nil {
+		return nil, err
+	}
+	return sessionKey(xSecret, kemSecret, hello, reply), nil
+}
@@ -0,0 +1,11 @@
+// +build !go1.24
+
+package pqkex
+
+import "io"
+
+// Client runs the exchange as the client over rw and returns the session key.
+func Client(rw io.ReadWriter) ([]byte, error) { return nil, ErrUnsupported }
+
+// Server runs the exchange as the server over rw and returns the session key.
+func Server(rw io.ReadWriter) ([]byte, error) { return nil, ErrUnsupported }
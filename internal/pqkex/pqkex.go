@@ -0,0 +1,53 @@
+// Package pqkex implements a hybrid key agreement of X25519 and ML-KEM-768, the standardized
+// Kyber, run over an already encrypted connection to derive a session key that is not
+// derivable from the key of that connection, nor from recorded traffic unless both X25519
+// and ML-KEM are broken. The client sends
+//
+//	[X25519 public key, 32 bytes][ML-KEM-768 encapsulation key, 1184 bytes]
+//
+// and the server answers with
+//
+//	[X25519 public key, 32 bytes][ML-KEM-768 ciphertext, 1088 bytes]
+//
+// The session key is derived with HKDF-SHA256 from both shared secrets, bound to the
+// messages exchanged. The exchange is not authenticated itself, relying on the connection
+// below for that.
+//
+// It needs Go 1.24 or later, with earlier versions failing with ErrUnsupported.
+package pqkex
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// KeySize is the size of session keys.
+	KeySize = 32
+
+	x25519Size     = 32
+	encapKeySize   = 1184
+	ciphertextSize = 1088
+	clientSize     = x25519Size + encapKeySize
+	serverSize     = x25519Size + ciphertextSize
+)
+
+// ErrUnsupported is returned when built with a Go version without ML-KEM.
+var ErrUnsupported = errors.New("pqkex: needs Go 1.24 or later")
+
+var errKey = errors.New("pqkex: invalid key share")
+
+// sessionKey derives the session key from the shared secrets and the messages exchanged.
+func sessionKey(x25519Secret, kemSecret, client, server []byte) []byte {
+	h := sha256.New()
+	h.Write(client)
+	h.Write(server)
+	info := append([]byte("go-shadowsocks2 pqkex "), h.Sum(nil)...)
+	key := make([]byte, KeySize)
+	r := hkdf.New(sha256.New, append(append([]byte(nil), x25519Secret...), kemSecret...), nil, info)
+	io.ReadFull(r, key)
+	return key
+}
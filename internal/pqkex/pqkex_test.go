@@ -0,0 +1,45 @@
+// +build go1.24
+
+package pqkex
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestExchange(t *testing.T) {
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+
+	done := make(chan []byte)
+	go func() {
+		key, err := Server(sc)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- key
+	}()
+	key, err := Client(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skey := <-done; !bytes.Equal(key, skey) {
+		t.Fatalf("keys differ: %x and %x", key, skey)
+	}
+	if len(key) != KeySize {
+		t.Fatalf("key of %d bytes", len(key))
+	}
+}
+
+func TestInvalidShare(t *testing.T) {
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+
+	go cc.Write(bytes.Repeat([]byte{0xff}, clientSize)) // not a valid encapsulation key
+	if _, err := Server(sc); err != errKey {
+		t.Fatalf("got %v, want %v", err, errKey)
+	}
+}
@@ -0,0 +1,242 @@
+// Package relay implements the copy loops shared by all proxy modes, reporting
+// relayed flows to registered hooks for stats and access control.
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Direction of relayed data.
+type Direction int
+
+const (
+	Up   Direction = iota // from client to target
+	Down                  // from target to client
+)
+
+// Flow describes a relayed TCP connection or UDP session.
+type Flow struct {
+	up, down int64 // first for 64-bit alignment of atomic access
+
+	ID      string   // session ID used to correlate logs
+	Network string   // "tcp" or "udp"
+	Source  net.Addr // address of the client
+	Target  string   // address of the target (the first one for UDP)
+	Remote  net.Addr // address the target side is connected to: the target on servers, the server on clients
+	Start   time.Time
+}
+
+// NewFlow returns a Flow of session id from source to target started now.
+func NewFlow(id, network string, source net.Addr, target string) *Flow {
+	return &Flow{ID: id, Network: network, Source: source, Target: target, Start: time.Now()}
+}
+
+// Bytes returns the number of bytes relayed up and down so far. For TCP flows the
+// counts are only updated during the flow if an OnData hook is registered.
+func (f *Flow) Bytes() (up, down int64) {
+	return atomic.LoadInt64(&f.up), atomic.LoadInt64(&f.down)
+}
+
+func (f *Flow) add(dir Direction, n int64) {
+	if dir == Up {
+		atomic.AddInt64(&f.up, n)
+	} else {
+		atomic.AddInt64(&f.down, n)
+	}
+}
+
+// Hooks are called over the life of every flow, in the order they were registered. Any of
+// them may be nil.
+//
+// OnOpen may refuse the flow by returning an error, e.g. for access control: the flow is
+// then not relayed and closes with the error, without calling the OnOpen hooks after it.
+// OnData is called with every n bytes read in direction dir before they are written on. It
+// may block to slow the flow down, e.g. for rate limiting, or return an error to abort the
+// flow, dropping the bytes. OnClose is called once for every flow, refused or not.
+type Hooks struct {
+	OnOpen  func(f *Flow) error
+	OnData  func(f *Flow, dir Direction, n int) error
+	OnClose func(f *Flow, err error)
+}
+
+var (
+	hooks  []Hooks
+	onData bool  // whether any OnData hook is registered
+	active int64 // number of open flows
+)
+
+// Active returns the number of flows being relayed.
+func Active() int64 {
+	return atomic.LoadInt64(&active)
+}
+
+// Register adds h to the hooks called for every flow. It must be called before any flow is relayed.
+func Register(h Hooks) {
+	hooks = append(hooks, h)
+	if h.OnData != nil {
+		onData = true
+	}
+}
+
+// open opens f, or closes it right away with the error of the OnOpen hook refusing it.
+func (f *Flow) open() error {
+	atomic.AddInt64(&active, 1)
+	for _, h := range hooks {
+		if h.OnOpen != nil {
+			if err := h.OnOpen(f); err != nil {
+				f.close(err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *Flow) data(dir Direction, n int) error {
+	f.add(dir, int64(n))
+	for _, h := range hooks {
+		if h.OnData != nil {
+			if err := h.OnData(f, dir, n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *Flow) close(err error) {
+	atomic.AddInt64(&active, -1)
+	for _, h := range hooks {
+		if h.OnClose != nil {
+			h.OnClose(f, err)
+		}
+	}
+}
+
+// TCP copies between the client side left and the target side right bidirectionally
+// as flow f, and returns the first error other than a deadline exceeded, or the error of
+// the hook refusing the flow. Once one side ends its direction, the other is closed for
+// writing if it supports half-close, and has a few seconds left to end the other, unless
+// the direction ended in an error.
+func TCP(left, right net.Conn, f *Flow) error {
+	if f.Remote == nil {
+		f.Remote = right.RemoteAddr()
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	var err, err1 error
+	var wg sync.WaitGroup
+	var wait = 5 * time.Second
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err1 = copyFlow(right, left, f, Up)
+		if err1 == nil {
+			closeWrite(right)
+			right.SetReadDeadline(time.Now().Add(wait)) // unblock read on right
+		} else {
+			right.SetReadDeadline(time.Now()) // the flow failed, end the other direction too
+		}
+	}()
+	err = copyFlow(left, right, f, Down)
+	if err == nil {
+		closeWrite(left)
+		left.SetReadDeadline(time.Now().Add(wait)) // unblock read on left
+	} else {
+		left.SetReadDeadline(time.Now())
+	}
+	wg.Wait()
+	if err1 != nil && !errors.Is(err1, os.ErrDeadlineExceeded) { // requires Go 1.15+
+		err = err1
+	} else if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		err = nil
+	}
+	f.close(err)
+	return err
+}
+
+// copyFlow copies from src to dst in direction dir of flow f. Without OnData hooks
+// io.Copy is used as is to keep its ReaderFrom/WriterTo fast paths.
+func copyFlow(dst io.Writer, src io.Reader, f *Flow, dir Direction) error {
+	if !onData {
+		n, err := io.Copy(dst, src)
+		f.add(dir, n)
+		return err
+	}
+	_, err := io.Copy(dst, &flowReader{src, f, dir})
+	return err
+}
+
+// closeWrite half-closes c if it supports it, so that its peer reads EOF.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// flowReader reports every read to the hooks of its flow.
+type flowReader struct {
+	io.Reader
+	f   *Flow
+	dir Direction
+}
+
+func (r *flowReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		if err := r.f.data(r.dir, n); err != nil {
+			return 0, err
+		}
+	}
+	return n, err
+}
+
+type packetConn struct {
+	net.PacketConn
+	f    *Flow
+	once sync.Once
+}
+
+// PacketConn opens flow f and wraps pc so that packets written to it are reported as
+// sent up and packets read from it as received down. Closing it closes the flow. If a hook
+// refuses the flow, pc is closed and the error returned.
+func PacketConn(pc net.PacketConn, f *Flow) (net.PacketConn, error) {
+	if err := f.open(); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return &packetConn{PacketConn: pc, f: f}, nil
+}
+
+// WriteTo reports b to the OnData hooks before sending it, and drops it if one fails.
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > 0 {
+		if err := c.f.data(Up, len(b)); err != nil {
+			return 0, err
+		}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if n > 0 && err == nil {
+		if err := c.f.data(Down, n); err != nil {
+			return 0, addr, err
+		}
+	}
+	return n, addr, err
+}
+
+func (c *packetConn) Close() error {
+	err := c.PacketConn.Close()
+	c.once.Do(func() { c.f.close(nil) })
+	return err
+}
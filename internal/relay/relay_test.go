@@ -0,0 +1,249 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// register replaces the hooks registered by earlier tests with hs.
+func register(t *testing.T, hs ...Hooks) {
+	hooks, onData = nil, false
+	for _, h := range hs {
+		Register(h)
+	}
+	t.Cleanup(func() { hooks, onData = nil, false })
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// relayTCP relays between a client and a target through TCP in the background, returning
+// the ends of the client and the target and the error of TCP once it returns.
+func relayTCP(t *testing.T, f *Flow) (client, target *net.TCPConn, done <-chan error) {
+	client, left := tcpPair(t)
+	right, target := tcpPair(t)
+	ch := make(chan error, 1)
+	go func() { ch <- TCP(left, right, f) }()
+	return client, target, ch
+}
+
+func wait(t *testing.T, done <-chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("relay did not return")
+		return nil
+	}
+}
+
+func TestTCPHalfClose(t *testing.T) {
+	register(t)
+	client, target, done := relayTCP(t, NewFlow("1", "tcp", nil, "target"))
+
+	// the target answers once it reads the whole request, as the client half-closed
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	client.CloseWrite()
+	req, err := ioutil.ReadAll(target)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("target read %q, %v", req, err)
+	}
+	if _, err := target.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+	resp, err := ioutil.ReadAll(client)
+	if err != nil || string(resp) != "response" {
+		t.Fatalf("client read %q, %v", resp, err)
+	}
+	if err := wait(t, done); err != nil {
+		t.Fatalf("TCP = %v", err)
+	}
+}
+
+func TestTCPErrors(t *testing.T) {
+	errRefused, errAborted := errors.New("refused"), errors.New("aborted")
+
+	// a refused flow is not relayed and closes with the error
+	var closed error
+	register(t, Hooks{
+		OnOpen:  func(*Flow) error { return errRefused },
+		OnClose: func(_ *Flow, err error) { closed = err },
+	})
+	client, _, done := relayTCP(t, NewFlow("1", "tcp", nil, "target"))
+	if err := wait(t, done); err != errRefused || closed != errRefused {
+		t.Fatalf("refused flow: TCP = %v, closed with %v", err, closed)
+	}
+	client.Close()
+	if Active() != 0 {
+		t.Fatalf("%d flows active after refusal", Active())
+	}
+
+	// a failing OnData hook aborts the flow, dropping the data
+	register(t, Hooks{
+		OnData:  func(*Flow, Direction, int) error { return errAborted },
+		OnClose: func(_ *Flow, err error) { closed = err },
+	})
+	client, target, done := relayTCP(t, NewFlow("2", "tcp", nil, "target"))
+	client.Write([]byte("request"))
+	target.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := target.Read(make([]byte, 16)); n > 0 {
+		t.Fatalf("target read %d bytes of an aborted flow, %v", n, err)
+	}
+	if err := wait(t, done); !errors.Is(err, errAborted) || !errors.Is(closed, errAborted) {
+		t.Fatalf("aborted flow: TCP = %v, closed with %v", err, closed)
+	}
+}
+
+func TestTCPHooks(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	var up, down int
+	record := func(name string) Hooks {
+		return Hooks{
+			OnOpen: func(f *Flow) error {
+				mu.Lock()
+				defer mu.Unlock()
+				events = append(events, name+" open")
+				return nil
+			},
+			OnData: func(f *Flow, dir Direction, n int) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if name == "a" {
+					if dir == Up {
+						up += n
+					} else {
+						down += n
+					}
+				}
+				return nil
+			},
+			OnClose: func(f *Flow, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				events = append(events, name+" close")
+			},
+		}
+	}
+	register(t, record("a"), record("b"))
+
+	f := NewFlow("1", "tcp", nil, "target")
+	client, target, done := relayTCP(t, f)
+	client.Write(make([]byte, 1000))
+	client.CloseWrite()
+	io.Copy(ioutil.Discard, target)
+	target.Write(make([]byte, 3000))
+	target.Close()
+	io.Copy(ioutil.Discard, client)
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := fmt.Sprint(events), "[a open b open a close b close]"; got != want {
+		t.Errorf("hooks called as %s, want %s", got, want)
+	}
+	if fu, fd := f.Bytes(); up != 1000 || down != 3000 || fu != 1000 || fd != 3000 {
+		t.Errorf("OnData counted %d up and %d down, Bytes %d and %d, want 1000 and 3000", up, down, fu, fd)
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	var closes int
+	var up, down int
+	register(t, Hooks{
+		OnData: func(_ *Flow, dir Direction, n int) error {
+			if dir == Up {
+				up += n
+			} else {
+				down += n
+			}
+			return nil
+		},
+		OnClose: func(*Flow, error) { closes++ },
+	})
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewFlow("1", "udp", nil, peer.LocalAddr().String())
+	pc, err := PacketConn(raw, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pc.WriteTo(make([]byte, 100), peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, addr, err := peer.ReadFrom(buf)
+	if err != nil || n != 100 {
+		t.Fatalf("peer read %d bytes, %v", n, err)
+	}
+	peer.WriteTo(make([]byte, 300), addr)
+	if n, _, err := pc.ReadFrom(buf); err != nil || n != 300 {
+		t.Fatalf("read %d bytes, %v", n, err)
+	}
+
+	// a session timing out reads nothing and closes once
+	pc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, _, err := pc.ReadFrom(buf); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past deadline = %d, %v", n, err)
+	}
+	pc.Close()
+	pc.Close()
+	if up != 100 || down != 300 || closes != 1 {
+		t.Fatalf("counted %d up, %d down and %d closes, want 100, 300 and 1", up, down, closes)
+	}
+	if fu, fd := f.Bytes(); fu != 100 || fd != 300 {
+		t.Fatalf("Bytes = %d, %d, want 100, 300", fu, fd)
+	}
+
+	// a refused session closes its socket
+	errRefused := errors.New("refused")
+	register(t, Hooks{OnOpen: func(*Flow) error { return errRefused }})
+	raw, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PacketConn(raw, NewFlow("2", "udp", nil, "")); err != errRefused {
+		t.Fatalf("PacketConn of a refused flow = %v", err)
+	}
+	if _, err := raw.WriteTo([]byte{0}, peer.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("socket of a refused flow still open: %v", err)
+	}
+}
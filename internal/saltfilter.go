@@ -5,6 +5,8 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Those suggest value are all set according to
@@ -70,9 +72,18 @@ func getSaltFilterSingleton() *BloomRing {
 	return saltfilter
 }
 
-// TestSalt returns true if salt is repeated
+// Received salts recorded and replays found since the last call of SaltStats.
+var saltsRecorded, saltReplays uint64
+
+// TestSalt returns true if salt is repeated, without adding it. Receivers test salts before
+// authenticating what comes with them, and add them with AddReceivedSalt only afterwards,
+// so that unauthenticated garbage cannot rotate the filter or claim the salts of others.
 func TestSalt(b []byte) bool {
-	return getSaltFilterSingleton().Test(b)
+	if getSaltFilterSingleton().Test(b) {
+		atomic.AddUint64(&saltReplays, 1)
+		return true
+	}
+	return false
 }
 
 // AddSalt salt to filter
@@ -80,6 +91,21 @@ func AddSalt(b []byte) {
 	getSaltFilterSingleton().Add(b)
 }
 
-func CheckSalt(b []byte) bool {
-	return getSaltFilterSingleton().Test(b)
+// AddReceivedSalt adds a received salt once the first record or packet with it is
+// authenticated. It returns true if the salt was added meanwhile, by a replay racing it.
+func AddReceivedSalt(b []byte) bool {
+	if getSaltFilterSingleton().Check(b) {
+		atomic.AddUint64(&saltReplays, 1)
+		return true
+	}
+	atomic.AddUint64(&saltsRecorded, 1)
+	return false
+}
+
+// SaltStats returns the number of received salts recorded and of replays found since the
+// last call, and the window of the filter, how far back it remembers salts, with whether it
+// forgot older ones. The window is 0 if the filter is disabled.
+func SaltStats() (recorded, replays uint64, window time.Duration, forgot bool) {
+	window, forgot = getSaltFilterSingleton().Window()
+	return atomic.SwapUint64(&saltsRecorded, 0), atomic.SwapUint64(&saltReplays, 0), window, forgot
 }
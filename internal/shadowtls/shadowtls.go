@@ -0,0 +1,317 @@
+// Package shadowtls hides a stream behind a real TLS handshake in the style of ShadowTLS:
+// the server relays the handshake of the client with a decoy TLS server, so that observers
+// and active probers see the certificate of the decoy, and only then carries the stream in
+// TLS application data records. Clients authenticate with a tag derived from a shared key
+// and the random of the server hello of the decoy in their first record. Connections of
+// anyone else stay relayed to the decoy.
+package shadowtls
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	recordHandshake = 0x16
+	recordAppData   = 0x17
+
+	headerSize    = 5
+	maxPayload    = 1 << 14
+	maxRecordSize = headerSize + maxPayload + 2048 // TLS 1.2 allows this much ciphertext
+
+	tagSize = 8
+
+	// appRecords is the number of application data records of a client the server checks
+	// for the tag before relaying the connection to the decoy for good. A TLS 1.3 client
+	// sends its Finished in the first one.
+	appRecords = 3
+)
+
+// ErrNotClient is returned by Server for connections relayed to the decoy.
+var ErrNotClient = errors.New("shadowtls: not a client, relayed to the decoy")
+
+var errProtocol = errors.New("shadowtls: protocol error")
+
+// tag returns the tag of the records from the client (dir 'C') or server (dir 'S') of the
+// connection whose server hello has random.
+func tag(key, random []byte, dir byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(random)
+	h.Write([]byte{dir})
+	return h.Sum(nil)[:tagSize]
+}
+
+// serverRandom returns the random of the server hello in the record rec, or nil if rec
+// does not start with a server hello.
+func serverRandom(rec []byte) []byte {
+	// record header, handshake type and length, legacy version, random
+	if len(rec) < headerSize+4+2+32 || rec[0] != recordHandshake || rec[headerSize] != 2 {
+		return nil
+	}
+	return append([]byte{}, rec[headerSize+6:headerSize+6+32]...)
+}
+
+// readRecord reads a whole TLS record into buf, which has to hold maxRecordSize bytes.
+func readRecord(r io.Reader, buf []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, buf[:headerSize]); err != nil {
+		return nil, err
+	}
+	n := headerSize + int(binary.BigEndian.Uint16(buf[3:]))
+	if n > maxRecordSize {
+		return nil, errProtocol
+	}
+	if _, err := io.ReadFull(r, buf[headerSize:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Client performs a TLS handshake with config through c, which the server relays to the
+// decoy, and returns the connection carrying the stream. config has to verify the
+// certificate of the decoy.
+func Client(c net.Conn, config *tls.Config, key []byte) (net.Conn, error) {
+	hr := &handshakeReader{r: c}
+	if err := tls.Client(handshakeConn{c, hr}, config).Handshake(); err != nil {
+		return nil, err
+	}
+	if hr.random == nil {
+		return nil, errProtocol
+	}
+	return newConn(c, tag(key, hr.random, 'S'), tag(key, hr.random, 'C'), nil), nil
+}
+
+// handshakeReader reads no further than the end of the current record, so that the TLS
+// client does not buffer anything following the handshake, and keeps the server random.
+type handshakeReader struct {
+	r      io.Reader
+	hdr    [headerSize]byte
+	off    int    // of the current record read
+	size   int    // of the current record, once its header is read
+	hello  []byte // leading bytes of the first record
+	random []byte
+}
+
+func (h *handshakeReader) Read(b []byte) (int, error) {
+	if h.off < headerSize {
+		if len(b) > headerSize-h.off {
+			b = b[:headerSize-h.off]
+		}
+	} else if len(b) > h.size-h.off {
+		b = b[:h.size-h.off]
+	}
+	n, err := h.r.Read(b)
+	if h.random == nil && len(h.hello) < headerSize+6+32 { // the first record is the server hello
+		h.hello = append(h.hello, b[:n]...)
+		if len(h.hello) >= headerSize+6+32 {
+			h.random = serverRandom(h.hello)
+		}
+	}
+	if h.off < headerSize {
+		copy(h.hdr[h.off:], b[:n])
+		if h.off+n == headerSize {
+			h.size = headerSize + int(binary.BigEndian.Uint16(h.hdr[3:]))
+		}
+	}
+	h.off += n
+	if h.off == h.size {
+		h.off = 0
+	}
+	return n, err
+}
+
+// handshakeConn is the connection the TLS client of Client handshakes on.
+type handshakeConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c handshakeConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// Server relays the TLS handshake of the client on c with the decoy at addr until the
+// client authenticates with key, and returns the connection carrying the stream. Anyone
+// else stays relayed to the decoy until done, and Server returns ErrNotClient.
+func Server(c net.Conn, decoy string, key []byte) (net.Conn, error) {
+	d, err := net.DialTimeout("tcp", decoy, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var switched bool
+	var random []byte
+	down := make(chan struct{})
+	go func() { // decoy to client
+		defer close(down)
+		buf := make([]byte, maxRecordSize)
+		for {
+			rec, err := readRecord(d, buf)
+			if err != nil {
+				break
+			}
+			mu.Lock()
+			if switched {
+				mu.Unlock()
+				return
+			}
+			if random == nil {
+				random = serverRandom(rec)
+			}
+			_, err = c.Write(rec)
+			mu.Unlock()
+			if err != nil {
+				break
+			}
+		}
+		mu.Lock()
+		if !switched {
+			c.Close()
+		}
+		mu.Unlock()
+	}()
+
+	br := bufio.NewReader(c)
+	buf := make([]byte, maxRecordSize)
+	for n := 0; n < appRecords; {
+		rec, err := readRecord(br, buf)
+		if err != nil {
+			d.Close()
+			<-down
+			if errors.Is(err, net.ErrClosed) { // by the decoy closing its side
+				err = ErrNotClient
+			}
+			return nil, err
+		}
+		if rec[0] == recordAppData {
+			n++
+			mu.Lock()
+			if random != nil && len(rec) >= headerSize+tagSize && hmac.Equal(rec[headerSize:headerSize+tagSize], tag(key, random, 'C')) {
+				switched = true
+				mu.Unlock()
+				d.Close()
+				<-down
+				return newConn(&bufConn{c, br}, nil, tag(key, random, 'S'), append([]byte{}, rec[headerSize+tagSize:]...)), nil
+			}
+			mu.Unlock()
+		}
+		if _, err := d.Write(rec); err != nil {
+			d.Close()
+			<-down
+			return nil, err
+		}
+	}
+	io.Copy(d, br)
+	d.Close()
+	<-down
+	return nil, ErrNotClient
+}
+
+// bufConn is a connection read through a buffered reader.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// Conn carries a stream in TLS application data records.
+type Conn struct {
+	net.Conn
+	raw     net.Conn // to unwrap a bufConn
+	rtag    []byte   // expected at the start of the first record, nil once read
+	pending []byte   // unread payload of the first record
+	left    int      // unread payload of the current record
+	hdr     [headerSize]byte
+
+	wmu  sync.Mutex
+	wtag []byte // to prefix the first record with, nil once written
+	wbuf []byte
+}
+
+func newConn(c net.Conn, rtag, wtag, pending []byte) *Conn {
+	raw := c
+	if bc, ok := c.(*bufConn); ok {
+		raw = bc.Conn
+	}
+	return &Conn{Conn: c, raw: raw, rtag: rtag, wtag: wtag, pending: pending}
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn { return c.raw }
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	for c.left == 0 {
+		if _, err := io.ReadFull(c.Conn, c.hdr[:]); err != nil {
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint16(c.hdr[3:]))
+		if c.rtag == nil {
+			if c.hdr[0] != recordAppData || size > maxPayload {
+				return 0, errProtocol
+			}
+			c.left = size
+			continue
+		}
+		// skip what the decoy sent before the server took over, e.g. session tickets
+		if size > maxRecordSize-headerSize {
+			return 0, errProtocol
+		}
+		rec := make([]byte, size)
+		if _, err := io.ReadFull(c.Conn, rec); err != nil {
+			return 0, err
+		}
+		if c.hdr[0] == recordAppData && size >= tagSize && hmac.Equal(rec[:tagSize], c.rtag) {
+			c.rtag = nil
+			if c.pending = rec[tagSize:]; len(c.pending) > 0 {
+				return c.Read(b)
+			}
+		}
+	}
+	if len(b) > c.left {
+		b = b[:c.left]
+	}
+	n, err := c.Conn.Read(b)
+	c.left -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wbuf == nil {
+		c.wbuf = make([]byte, headerSize+maxPayload)
+	}
+	var n int
+	for len(b) > 0 || c.wtag != nil {
+		rec := append(c.wbuf[:0], recordAppData, 3, 3, 0, 0)
+		rec = append(rec, c.wtag...)
+		m := maxPayload - len(c.wtag)
+		if m > len(b) {
+			m = len(b)
+		}
+		rec = append(rec, b[:m]...)
+		binary.BigEndian.PutUint16(rec[3:], uint16(len(rec)-headerSize))
+		if _, err := c.Conn.Write(rec); err != nil {
+			return n, err
+		}
+		c.wtag = nil
+		n += m
+		b = b[m:]
+	}
+	return n, nil
+}
@@ -0,0 +1,89 @@
+package shadowtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShadowTLS(t *testing.T) {
+	decoy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "decoy")
+	}))
+	defer decoy.Close()
+	key := []byte("secret")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				sc, err := Server(c, decoy.Listener.Addr().String(), key)
+				if err != nil {
+					return
+				}
+				io.Copy(sc, sc)
+			}()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(decoy.Certificate())
+	config := &tls.Config{ServerName: "example.com", RootCAs: roots}
+
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		config.MaxVersion = version
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc, err := Client(c, config, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 3*maxPayload+100)
+		rand.Read(b)
+		go sc.Write(b)
+		got := make([]byte, len(b))
+		if _, err := io.ReadFull(sc, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, b) {
+			t.Errorf("TLS %x: echoed data differs", version)
+		}
+		sc.Close()
+	}
+
+	// others get the decoy
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: config,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", l.Addr().String())
+		},
+	}}
+	resp, err := client.Get("https://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "decoy" {
+		t.Errorf("got %q from the decoy", body)
+	}
+}
@@ -0,0 +1,290 @@
+// Package websocket implements as much of the WebSocket protocol (RFC 6455) as needed to
+// carry a byte stream in binary messages, e.g. through HTTP reverse proxies and CDNs.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// maxControlSize is the maximum payload size of control frames.
+const maxControlSize = 125
+
+var errProtocol = errors.New("websocket: protocol error")
+
+// Conn is a WebSocket connection, which reads and writes the payload of binary messages.
+type Conn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool // whether to mask written frames
+
+	// Read state of the current frame.
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+	eof       bool
+
+	wmu sync.Mutex
+	buf []byte
+}
+
+func newConn(c net.Conn, br *bufio.Reader, client bool) *Conn {
+	return &Conn{Conn: c, br: br, client: client}
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn { return c.Conn }
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Client performs the opening handshake of a WebSocket connection to path on host over c.
+func Client(c net.Conn, host, path string) (*Conn, error) {
+	var nonce [16]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket: handshake failed with status %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, errors.New("websocket: handshake failed with a bad Sec-WebSocket-Accept")
+	}
+	return newConn(c, br, true), nil
+}
+
+// IsUpgrade reports whether r requests to open a WebSocket connection.
+func IsUpgrade(r *http.Request) bool {
+	return r.Method == http.MethodGet && headerContains(r.Header, "Connection", "upgrade") &&
+		headerContains(r.Header, "Upgrade", "websocket") && r.Header.Get("Sec-WebSocket-Key") != ""
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrade completes the opening handshake of the WebSocket connection requested by r and
+// takes over its connection. It replies with an error if r is no such request.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if !IsUpgrade(r) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil, errors.New("websocket: not an upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Upgrade Required", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, errors.New("websocket: connection cannot be taken over")
+	}
+	c, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"
+	if _, err := c.Write([]byte(resp)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return newConn(c, brw.Reader, false), nil
+}
+
+// Read reads the payload of binary messages, answering control frames on the way.
+// It returns io.EOF once the peer has closed the connection.
+func (c *Conn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	c.remaining -= int64(n)
+	if c.masked {
+		c.unmask(b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) unmask(b []byte) {
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// nextFrame reads the header of the next frame, handling control frames entirely.
+func (c *Conn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	op := hdr[0] & 0xF
+	size := int64(hdr[1] & 0x7F)
+	switch size {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		size = int64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		size = int64(binary.BigEndian.Uint64(b[:]))
+		if size < 0 {
+			return errProtocol
+		}
+	}
+	c.masked = hdr[1]&0x80 != 0
+	c.maskPos = 0
+	if c.masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case opBinary, opContinuation:
+		c.remaining = size
+		return nil
+	case opClose, opPing, opPong:
+		if size > maxControlSize {
+			return errProtocol
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		if c.masked {
+			c.unmask(payload)
+		}
+		switch op {
+		case opClose:
+			c.eof = true
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(opClose, payload)
+		case opPing:
+			return c.writeFrame(opPong, payload)
+		}
+		return nil
+	}
+	return errProtocol
+}
+
+// Write writes b as a binary message.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Conn) writeFrame(op byte, b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	size := 2 + 8 + 4 + len(b)
+	if cap(c.buf) < size {
+		c.buf = make([]byte, size)
+	}
+	buf := c.buf[:2]
+	buf[0] = 0x80 | op // FIN
+	switch n := len(b); {
+	case n <= 125:
+		buf[1] = byte(n)
+	case n <= 0xFFFF:
+		buf[1] = 126
+		buf = append(buf, byte(n>>8), byte(n))
+	default:
+		buf[1] = 127
+		buf = buf[:10]
+		binary.BigEndian.PutUint64(buf[2:], uint64(n))
+	}
+	if c.client {
+		buf[1] |= 0x80
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		buf = append(buf, mask[:]...)
+		start := len(buf)
+		buf = append(buf, b...)
+		for i := range buf[start:] {
+			buf[start+i] ^= mask[i&3]
+		}
+	} else {
+		buf = append(buf, b...)
+	}
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// Close sends a close frame and closes the underlying connection.
+func (c *Conn) Close() error {
+	c.writeFrame(opClose, []byte{0x03, 0xE8}) // normal closure
+	return c.Conn.Close()
+}
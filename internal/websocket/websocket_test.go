@@ -0,0 +1,80 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConn(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- c
+	}))
+	defer srv.Close()
+
+	nc, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(nc, "example.com", "/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-conns
+
+	for _, size := range []int{1, 125, 126, 65535, 65536, 200000} {
+		msg := make([]byte, size)
+		rand.Read(msg)
+		go client.Write(msg)
+		got := make([]byte, size)
+		if _, err := io.ReadFull(server, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("server read %d bytes: %v", size, err)
+		}
+		go server.Write(msg)
+		if _, err := io.ReadFull(client, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("client read %d bytes: %v", size, err)
+		}
+	}
+
+	// a ping is answered between messages
+	go func() {
+		client.writeFrame(opPing, []byte("ping"))
+		client.Write([]byte("data"))
+	}()
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(server, got); err != nil || string(got) != "data" {
+		t.Fatalf("server read %q: %v", got, err)
+	}
+	go client.Close()
+	if _, err := server.Read(got); err != io.EOF {
+		t.Fatalf("server read after close: %v", err)
+	}
+}
+
+func TestUpgradeRejects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := Upgrade(w, r); err == nil {
+			t.Error("Upgrade of a plain request succeeded")
+		}
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || strings.Contains(resp.Header.Get("Upgrade"), "websocket") {
+		t.Errorf("plain request status = %s", resp.Status)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/ipfix"
+	"github.com/shadowsocks/go-shadowsocks2/internal/relay"
+)
+
+// exportIPFIX exports every finished flow as an IPFIX record to collector. Flows
+// from the client to the remote address are recorded with the reverse direction
+// as reverseOctetDeltaCount.
+func exportIPFIX(collector string) error {
+	c, err := net.Dial("udp", collector)
+	if err != nil {
+		return err
+	}
+	e := ipfix.NewExporter(c, 0)
+	relay.Register(relay.Hooks{
+		OnClose: func(f *relay.Flow, _ error) {
+			srcIP, srcPort := ipPort(f.Source)
+			dstIP, dstPort := ipPort(f.Remote)
+			if srcIP == nil || dstIP == nil {
+				return
+			}
+			r := ipfix.Record{
+				SrcIP:    srcIP,
+				SrcPort:  srcPort,
+				DstIP:    dstIP,
+				DstPort:  dstPort,
+				Protocol: 6,
+				Start:    f.Start,
+				End:      time.Now(),
+			}
+			if f.Network == "udp" {
+				r.Protocol = 17
+			}
+			up, down := f.Bytes()
+			r.Octets, r.ReverseOctets = uint64(up), uint64(down)
+			if err := e.Export(r); err != nil {
+				logf("[%s] IPFIX export error: %v", f.ID, err)
+			}
+		},
+	})
+	return nil
+}
+
+// ipPort returns the IP and port of a TCP or UDP address, or a nil IP otherwise.
+func ipPort(a net.Addr) (net.IP, uint16) {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP, uint16(a.Port)
+	case *net.UDPAddr:
+		return a.IP, uint16(a.Port)
+	}
+	return nil, 0
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+)
+
+// keygen implements the keygen subcommand which prints a random key of the size required
+// by a cipher, optionally with client and server command lines using it.
+func keygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	cipher := fs.String("cipher", "AEAD_CHACHA20_POLY1305", cipherUsage)
+	addr := fs.String("addr", "", "server address (host:port) to print client and server command lines for")
+	master := fs.String("key", "", "base64-encoded master key to derive the key of -device from")
+	device := fs.String("device", "", "derive the key of this device ID from -key instead of generating a random key")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s keygen [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	size, err := core.KeySize(*cipher)
+	if errors.Is(err, core.ErrCipherNotSupported) {
+		return fmt.Errorf("unknown cipher %s", *cipher)
+	} else if err != nil {
+		return err
+	}
+
+	key := make([]byte, size)
+	if *device != "" {
+		m, err := decodeKey(*master)
+		if err != nil {
+			return err
+		}
+		if len(m) == 0 {
+			return fmt.Errorf("-device requires a master key given by -key")
+		}
+		key = core.DeriveKey(m, *device, size)
+	} else if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	// Shadowsocks 2022 keys are standard base64 as SIP022 and other implementations take them
+	enc := base64.URLEncoding
+	if strings.HasPrefix(strings.ToLower(*cipher), "2022-") {
+		enc = base64.StdEncoding
+	}
+	k := enc.EncodeToString(key)
+	fmt.Println(k)
+
+	if *addr != "" {
+		_, port, err := net.SplitHostPort(*addr)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("server: %s -s 'ss://%s@:%s' -key %s\n", os.Args[0], *cipher, port, k)
+		fmt.Printf("client: %s -c 'ss://%s@%s' -key %s\n", os.Args[0], *cipher, *addr, k)
+	}
+	return nil
+}
+
+// decodeKey decodes a key given in URL-safe base64, or in standard base64 as keys of
+// Shadowsocks 2022 ciphers are.
+func decodeKey(s string) ([]byte, error) {
+	k, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		if k, err2 := base64.StdEncoding.DecodeString(s); err2 == nil {
+			return k, nil
+		}
+	}
+	return k, err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// connLimit caps the connections a listener handles at once. Connections beyond the cap wait
+// for a slot for up to wait, with at most as many waiting as handled, and are closed when
+// none frees in time, so that connection storms cost small devices neither memory nor
+// connections to the server beyond the cap. A nil connLimit admits every connection.
+type connLimit struct {
+	slots   chan struct{}
+	wait    time.Duration
+	waiting int32
+}
+
+// newConnLimit returns the limit of -max-conns for a new listener, or nil without one.
+func newConnLimit() *connLimit {
+	if config.MaxConns <= 0 {
+		return nil
+	}
+	return &connLimit{slots: make(chan struct{}, config.MaxConns), wait: config.MaxConnsWait}
+}
+
+// Acquire takes a slot, waiting for one if all are taken, and reports whether it got one.
+// Slots taken must be given back with Release.
+func (l *connLimit) Acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
+	if atomic.AddInt32(&l.waiting, 1) > int32(cap(l.slots)) {
+		atomic.AddInt32(&l.waiting, -1)
+		return false
+	}
+	defer atomic.AddInt32(&l.waiting, -1)
+	t := time.NewTimer(l.wait)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// Release gives back a slot taken with Acquire.
+func (l *connLimit) Release() {
+	if l != nil {
+		<-l.slots
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// listenFDsEnv passes the listening sockets inherited on upgrade to the new process. It
+// holds the comma-separated keys of the sockets, which are open at file descriptors 3 onwards,
+// followed by the pipe to report on once all are listened on again.
+const listenFDsEnv = "GO_SHADOWSOCKS2_LISTEN_FDS"
+
+// fileListener is a listening socket that can be handed over to a new process.
+type fileListener interface {
+	File() (*os.File, error)
+	Close() error
+}
+
+// listeners holds the sockets opened by listen and listenPacket.
+var listeners struct {
+	sync.Mutex
+	keys []string
+	list []fileListener
+}
+
+// inherited returns the socket of key passed down by the process upgraded from, or nil.
+func inherited(key string) *os.File {
+	for i, k := range strings.Split(os.Getenv(listenFDsEnv), ",") {
+		if k == key {
+			return os.NewFile(uintptr(3+i), key)
+		}
+	}
+	return nil
+}
+
+// takeover tracks the inherited sockets not listened on again yet, reporting to the process
+// upgraded from on pipe once there are none left.
+var takeover struct {
+	sync.Mutex
+	left map[string]bool
+	pipe *os.File
+}
+
+func init() {
+	env, ok := os.LookupEnv(listenFDsEnv)
+	if !ok {
+		return
+	}
+	var keys []string
+	if env != "" {
+		keys = strings.Split(env, ",")
+	}
+	takeover.left = make(map[string]bool)
+	for _, k := range keys {
+		takeover.left[k] = true
+	}
+	takeover.pipe = os.NewFile(uintptr(3+len(keys)), "takeover")
+	tookOver("")
+}
+
+// tookOver records that the inherited socket of key is listened on again, so that the
+// process upgraded from stops listening once this one listens on every socket it did,
+// rather than on a guess of how long starting takes.
+func tookOver(key string) {
+	takeover.Lock()
+	defer takeover.Unlock()
+	delete(takeover.left, key)
+	if takeover.pipe == nil || len(takeover.left) > 0 {
+		return
+	}
+	if _, err := takeover.pipe.WriteString("READY\n"); err != nil {
+		logf("failed to report taking over listeners: %v", err)
+	}
+	takeover.pipe.Close()
+	takeover.pipe = nil
+}
+
+func register(key string, l fileListener) {
+	listeners.Lock()
+	defer listeners.Unlock()
+	listeners.keys = append(listeners.keys, key)
+	listeners.list = append(listeners.list, l)
+}
+
+// unixScheme prefixes TCP listen addresses that are unix domain sockets instead, e.g.
+// unix:///run/ss/socks.sock, or unix://@name for a socket in the abstract namespace on Linux.
+const unixScheme = "unix://"
+
+// isUnixAddr reports whether the listen address addr is a unix domain socket.
+func isUnixAddr(addr string) bool { return strings.HasPrefix(addr, unixScheme) }
+
+// listen is net.Listen on the network variant selected by -listen-stack, or on a unix
+// domain socket for unix:// addresses of network "tcp", reusing the socket inherited from
+// the process upgraded from if there is one. It must be called once by every front-end
+// counted in starting.
+func listen(network, addr string) (net.Listener, error) {
+	if network == "tcp" && isUnixAddr(addr) {
+		network, addr = "unix", strings.TrimPrefix(addr, unixScheme)
+	} else {
+		network = listenNetwork(network, addr)
+	}
+	key := network + " " + addr
+	var l net.Listener
+	var err error
+	if f := inherited(key); f != nil {
+		l, err = net.FileListener(f)
+		f.Close()
+		if err == nil {
+			defer tookOver(key)
+		}
+	} else if network == "unix" {
+		l, err = listenUnix(addr)
+	} else if config.TFO {
+		lc := net.ListenConfig{Control: tfoControl(setListenTFO, &tfoFailed.listen)}
+		l, err = lc.Listen(context.Background(), network, addr)
+	} else {
+		l, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ul, ok := l.(*net.UnixListener); ok && !strings.HasPrefix(addr, "@") {
+		// keep the socket file for the process upgraded to, removing it on exit instead
+		ul.SetUnlinkOnClose(false)
+		atExit(func() { os.Remove(addr) })
+	}
+	if fl, ok := l.(fileListener); ok {
+		register(key, fl)
+	}
+	starting.Done()
+	return l, nil
+}
+
+// listenUnix listens on the unix domain socket at path, replacing a socket file left behind
+// by a process no longer listening on it, and sets the mode of the file to -unix-mode.
+func listenUnix(path string) (net.Listener, error) {
+	if strings.HasPrefix(path, "@") {
+		return net.Listen("unix", path)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if config.UnixMode != 0 {
+		if err := os.Chmod(path, config.UnixMode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// listenPacket is the net.ListenPacket counterpart of listen.
+func listenPacket(network, addr string) (net.PacketConn, error) {
+	network = listenNetwork(network, addr)
+	key := network + " " + addr
+	var c net.PacketConn
+	var err error
+	if f := inherited(key); f != nil {
+		c, err = net.FilePacketConn(f)
+		f.Close()
+		if err == nil {
+			defer tookOver(key)
+		}
+	} else {
+		c, err = net.ListenPacket(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fl, ok := c.(fileListener); ok {
+		register(key, fl)
+	}
+	starting.Done()
+	return c, nil
+}
+
+// listenNetwork returns the network ("tcp" or "udp" as given, or its IPv4/IPv6-only variant)
+// to listen on addr with according to -listen-stack, which only applies to wildcard
+// addresses: without a host, 0.0.0.0 or ::. Go binds IPv6-only sockets with IPV6_V6ONLY set
+// and dual-stack sockets with it cleared regardless of the platform default. Networks of
+// IP protocols such as "ip4:icmp" and specific addresses are returned as given.
+func listenNetwork(network, addr string) string {
+	if network != "tcp" && network != "udp" {
+		return network
+	}
+	if host, _, err := net.SplitHostPort(addr); err != nil || host != "" && !isUnspecified(host) {
+		return network
+	}
+	switch config.ListenStack {
+	case "ipv4":
+		return network + "4"
+	case "ipv6":
+		return network + "6"
+	}
+	return network
+}
+
+func isUnspecified(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
@@ -0,0 +1,44 @@
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixWithStack(t *testing.T) {
+	defer func(stack string) { config.ListenStack = stack }(config.ListenStack)
+	for _, stack := range []string{"dual", "ipv4", "ipv6"} {
+		config.ListenStack = stack
+		path := filepath.Join(t.TempDir(), "socks.sock")
+		starting.Add(1)
+		l, err := listen("tcp", unixScheme+path)
+		if err != nil {
+			t.Fatalf("-listen-stack %s: %v", stack, err)
+		}
+		if _, ok := l.(*net.UnixListener); !ok {
+			t.Errorf("-listen-stack %s: listening on %T, want a unix domain socket", stack, l)
+		}
+		l.Close()
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	defer func(stack string) { config.ListenStack = stack }(config.ListenStack)
+	config.ListenStack = "ipv4"
+	for _, tt := range []struct{ network, addr, want string }{
+		{"tcp", ":1080", "tcp4"},
+		{"udp", "0.0.0.0:1080", "udp4"},
+		{"tcp", "[::]:1080", "tcp4"},
+		{"tcp", "[::1]:1080", "tcp"},
+		{"tcp", "127.0.0.1:1080", "tcp"},
+		{"tcp", "localhost:1080", "tcp"},
+		{"ip4:icmp", "0.0.0.0", "ip4:icmp"},
+	} {
+		if got := listenNetwork(tt.network, tt.addr); got != tt.want {
+			t.Errorf("listenNetwork(%q, %q) = %q, want %q", tt.network, tt.addr, got, tt.want)
+		}
+	}
+}
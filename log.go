@@ -1,15 +1,45 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-var logger = log.New(os.Stderr, "", log.Lshortfile|log.LstdFlags)
+var logger = log.New(redactWriter{os.Stderr}, "", log.Lshortfile|log.LstdFlags)
+
+// verbose is non-zero while verbose logging is on. It starts as -verbose and can be
+// toggled at runtime with SIGUSR1.
+var verbose int32
+
+func setVerbose(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&verbose, v)
+}
+
+// toggleVerbose switches verbose logging on or off and returns whether it is now on.
+func toggleVerbose() bool {
+	for {
+		v := atomic.LoadInt32(&verbose)
+		if atomic.CompareAndSwapInt32(&verbose, v, 1-v) {
+			return v == 0
+		}
+	}
+}
 
 func logf(f string, v ...interface{}) {
-	if config.Verbose {
+	if atomic.LoadInt32(&verbose) != 0 {
 		logger.Output(2, fmt.Sprintf(f, v...))
 	}
 }
@@ -19,7 +49,7 @@ type logHelper struct {
 }
 
 func (l *logHelper) Write(p []byte) (n int, err error) {
-	if config.Verbose {
+	if atomic.LoadInt32(&verbose) != 0 {
 		logger.Printf("%s%s\n", l.prefix, p)
 		return len(p), nil
 	}
@@ -29,3 +59,91 @@ func (l *logHelper) Write(p []byte) (n int, err error) {
 func newLogHelper(prefix string) *logHelper {
 	return &logHelper{prefix}
 }
+
+// newSessionID returns a random ID identifying a connection or UDP session in logs from accept to close.
+func newSessionID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// secrets holds strings such as passwords and keys that must never appear in logs.
+var secrets struct {
+	sync.RWMutex
+	list []string
+}
+
+// addSecret registers s to be replaced by its fingerprint in all log output.
+func addSecret(s string) {
+	if s == "" {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	secrets.list = append(secrets.list, s)
+}
+
+// matches the user info part of ss:// URLs, which carries the password
+var ssUserInfo = regexp.MustCompile(`ss://[^@/\s]+@`)
+
+// redact replaces registered secrets and the user info of ss:// URLs in s with fingerprints.
+// Secrets are only replaced as whole words, so that a short password does not mangle every
+// word containing it.
+func redact(s string) string {
+	s = ssUserInfo.ReplaceAllStringFunc(s, func(m string) string {
+		return "ss://" + fingerprint(m[len("ss://"):len(m)-1]) + "@"
+	})
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for _, secret := range secrets.list {
+		s = replaceWord(s, secret, fingerprint(secret))
+	}
+	return s
+}
+
+// replaceWord replaces the occurrences of old in s not adjoining a word character with new,
+// at its ends that are word characters themselves, as \b in regular expressions.
+func replaceWord(s, old, new string) string {
+	var b strings.Builder
+	last := 0
+	for i := 0; i < len(s); {
+		j := strings.Index(s[i:], old)
+		if j < 0 {
+			break
+		}
+		i += j
+		end := i + len(old)
+		if (i == 0 || !isWordByte(old[0]) || !isWordByte(s[i-1])) &&
+			(end == len(s) || !isWordByte(old[len(old)-1]) || !isWordByte(s[end])) {
+			b.WriteString(s[last:i])
+			b.WriteString(new)
+			last, i = end, end
+		} else {
+			i++
+		}
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// isWordByte reports whether c is part of a word: an ASCII letter, digit or underscore, or a
+// byte of a non-ASCII UTF-8 character.
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c >= 0x80
+}
+
+// fingerprint identifies s in logs without revealing it.
+func fingerprint(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "[redacted:" + hex.EncodeToString(sum[:4]) + "]"
+}
+
+// redactWriter redacts secrets from everything written to the embedded io.Writer.
+type redactWriter struct{ io.Writer }
+
+func (w redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.Writer, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	addSecret("pw")
+	addSecret("ab+c/d==")
+	defer func() { secrets.list = nil }()
+
+	pw, key := fingerprint("pw"), fingerprint("ab+c/d==")
+	for _, tt := range []struct{ in, want string }{
+		{"pw", pw},
+		{"password pw: pw.", "password " + pw + ": " + pw + "."},
+		{"-password pw -key ab+c/d==", "-password " + pw + " -key " + key},
+		{"upw pw_ pwd 2pw", "upw pw_ pwd 2pw"},
+		{"key=ab+c/d==x", "key=" + key + "x"},
+		{"xab+c/d==", "xab+c/d=="},
+		{"ss://AEAD_AES_128_GCM:secret@host:8488", "ss://" + fingerprint("AEAD_AES_128_GCM:secret") + "@host:8488"},
+		{"pwpw pw", "pwpw " + pw},
+	} {
+		if got := redact(tt.in); got != tt.want {
+			t.Errorf("redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const (
+	mirrorTimeout = 10 * time.Second // how long the mirror may take to respond
+	mirrorReport  = 10 * time.Minute // how often the comparison is logged
+)
+
+// mirrorer replays the first request of flows to a second server alongside the server in
+// use, discarding its responses, and compares how often and how fast both respond. It is
+// meant for validating a new server or transport with real traffic before switching to it.
+type mirrorer struct {
+	server string
+	shadow func(net.Conn) net.Conn
+	link   transport
+
+	sync.Mutex
+	primary, mirror mirrorStats
+}
+
+// mirrorStats counts the responses of a server to mirrored requests.
+type mirrorStats struct {
+	ok, failed int
+	latency    time.Duration // total time to the first byte of the ok responses
+}
+
+func (s *mirrorStats) add(d time.Duration, ok bool) {
+	if ok {
+		s.ok++
+		s.latency += d
+	} else {
+		s.failed++
+	}
+}
+
+func (s mirrorStats) String() string {
+	var avg time.Duration
+	if s.ok > 0 {
+		avg = s.latency / time.Duration(s.ok)
+	}
+	return fmt.Sprintf("%d ok, %d failed, %v to first byte on average", s.ok, s.failed, avg.Round(time.Millisecond))
+}
+
+// mirrors is nil unless mirroring is enabled with -mirror.
+var mirrors *mirrorer
+
+// startMirror enables mirroring to the server at the ss:// URL server over the transport
+// described by link. The cipher and password default to those of the server in use.
+func startMirror(server, link, cipher, password string, key []byte) error {
+	addr, c, p, err := parseURL(server)
+	if err != nil {
+		return err
+	}
+	if c != "" {
+		cipher, password, key = c, p, nil
+		addSecret(p)
+	}
+	ciph, err := core.PickCipher(cipher, key, password)
+	if err != nil {
+		return err
+	}
+	t, err := parseTransport(link)
+	if err != nil {
+		return err
+	}
+	mirrors = &mirrorer{server: addr, shadow: ciph.StreamConn, link: t}
+	go mirrors.report()
+	logf("mirroring flows to %s", addr)
+	return nil
+}
+
+func (m *mirrorer) report() {
+	for range time.Tick(mirrorReport) {
+		m.Lock()
+		primary, mirror := m.primary, m.mirror
+		m.primary, m.mirror = mirrorStats{}, mirrorStats{}
+		m.Unlock()
+		if primary.ok+primary.failed > 0 {
+			logger.Printf("mirrored flows in the last %v: server %s; mirror %s", mirrorReport, primary, mirror)
+		}
+	}
+}
+
+// Wrap returns c, the client side, and rc, the server side dialed at start, of a flow to
+// tgt, which replay the first request read from c to the mirror if it cannot change
+// anything at the target. Both servers are timed from dialing to the first byte of the
+// response.
+func (m *mirrorer) Wrap(c, rc net.Conn, start time.Time, id string, tgt socks.Addr) (net.Conn, net.Conn) {
+	f := &mirrorFlow{m: m, id: id, tgt: tgt, start: start, done: make(chan struct{})}
+	return &mirrorClientConn{Conn: c, f: f}, &mirrorServerConn{Conn: rc, f: f}
+}
+
+// mirrorable reports whether the request starting with b is safe to send twice: a TLS
+// client hello, whose handshake the mirror cannot complete, or an HTTP GET, HEAD or OPTIONS.
+func mirrorable(b []byte) bool {
+	if len(b) > 0 && b[0] == 0x16 {
+		return true
+	}
+	for _, m := range []string{"GET ", "HEAD ", "OPTIONS "} {
+		if bytes.HasPrefix(b, []byte(m)) {
+			return true
+		}
+	}
+	return false
+}
+
+// mirrorFlow tracks the first request of a flow and the responses to it.
+type mirrorFlow struct {
+	m     *mirrorer
+	id    string
+	tgt   socks.Addr
+	once  sync.Once
+	start time.Time     // when the server was dialed
+	done  chan struct{} // closed once the request is read, if it is mirrored
+}
+
+// request replays the first request b, if mirrorable, to the mirror.
+func (f *mirrorFlow) request(b []byte) {
+	f.once.Do(func() {
+		if !mirrorable(b) {
+			return
+		}
+		close(f.done)
+		go f.replay(append([]byte{}, b...))
+	})
+}
+
+// response records the time to the first byte of the response of the server.
+func (f *mirrorFlow) response(ok bool) {
+	select {
+	case <-f.done:
+	default:
+		return // not mirrored
+	}
+	d := time.Since(f.start)
+	f.m.Lock()
+	f.m.primary.add(d, ok)
+	f.m.Unlock()
+}
+
+func (f *mirrorFlow) replay(req []byte) {
+	d, err := f.m.roundTrip(f.tgt, req)
+	if err != nil {
+		logf("[%s] mirror of %s failed: %v", f.id, f.tgt, err)
+	} else {
+		logf("[%s] mirror of %s responded in %v", f.id, f.tgt, d.Round(time.Millisecond))
+	}
+	f.m.Lock()
+	f.m.mirror.add(d, err == nil)
+	f.m.Unlock()
+}
+
+// roundTrip sends req to tgt through the mirror and returns the time to the first byte of
+// the response, which is discarded.
+func (m *mirrorer) roundTrip(tgt socks.Addr, req []byte) (time.Duration, error) {
+	start := time.Now()
+	c, err := m.link.Dial(m.server)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	c.SetDeadline(start.Add(mirrorTimeout))
+	sc := m.shadow(c)
+	if _, err := sc.Write(append(append([]byte{}, tgt...), req...)); err != nil {
+		return 0, err
+	}
+	if _, err := sc.Read(make([]byte, 1)); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// mirrorClientConn hands the first request read from the client to its mirrorFlow.
+type mirrorClientConn struct {
+	net.Conn
+	f *mirrorFlow
+}
+
+func (c *mirrorClientConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.f.request(b[:n])
+	}
+	return n, err
+}
+
+// mirrorServerConn reports the first response read from the server to its mirrorFlow.
+type mirrorServerConn struct {
+	net.Conn
+	f    *mirrorFlow
+	once sync.Once
+}
+
+func (c *mirrorServerConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 || err != nil {
+		c.once.Do(func() { c.f.response(n > 0) })
+	}
+	return n, err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/mux"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// muxAddr is the target address by which clients open a mux session with the server.
+// Each stream of the session then starts with the target address of the stream.
+var muxAddr = socks.ParseAddr("mux.go-shadowsocks2.invalid:0")
+
+// muxConfig tunes the mux sessions of clients and servers, set with the -mux-* flags.
+var muxConfig = &mux.Config{}
+
+// muxIdleTimeout is how long a client keeps a mux session without streams.
+const muxIdleTimeout = 5 * time.Minute
+
+// muxPool shares encrypted connections to the server among proxied connections.
+type muxPool struct {
+	sync.Mutex
+	server   string
+	shadow   func(net.Conn) net.Conn
+	max      int // streams per session
+	sessions []*mux.Session
+}
+
+func newMuxPool(server string, shadow func(net.Conn) net.Conn, max int) *muxPool {
+	p := &muxPool{server: server, shadow: shadow, max: max}
+	go func() {
+		for range time.Tick(time.Minute) {
+			p.Lock()
+			for _, s := range p.sessions {
+				if s.Idle() > muxIdleTimeout {
+					s.Close()
+				}
+			}
+			p.Unlock()
+		}
+	}()
+	return p
+}
+
+// Dial opens a stream to tgt in a session with room for it.
+func (p *muxPool) Dial(tgt socks.Addr) (net.Conn, error) {
+	s, err := p.session()
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.Open()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := st.Write(tgt); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// session returns the first open session with fewer than max streams, or a new one.
+func (p *muxPool) session() (*mux.Session, error) {
+	if s := p.find(); s != nil {
+		return s, nil
+	}
+
+	// dialed without the lock, not to hold up streams opening in other sessions meanwhile;
+	// concurrent dials may each add a session
+	c, err := link.Dial(p.server)
+	if err != nil {
+		return nil, err
+	}
+	setLinkKeepAlive(c)
+	sc := p.shadow(c)
+	if _, err := sc.Write(muxAddr); err != nil {
+		c.Close()
+		return nil, err
+	}
+	s := mux.Client(sc, muxConfig)
+	if steer != nil {
+		s.OnControl(steer.Hint)
+	}
+	p.Lock()
+	p.sessions = append(p.sessions, s)
+	n := len(p.sessions)
+	p.Unlock()
+	logf("mux session %d to %s", n, p.server)
+	return s, nil
+}
+
+// find returns the first open session with fewer than max streams, dropping closed ones,
+// or nil if there is none.
+func (p *muxPool) find() *mux.Session {
+	p.Lock()
+	defer p.Unlock()
+	live := p.sessions[:0]
+	var found *mux.Session
+	for _, s := range p.sessions {
+		if s.IsClosed() {
+			continue
+		}
+		live = append(live, s)
+		if found == nil && s.NumStreams() < p.max {
+			found = s
+		}
+	}
+	p.sessions = live
+	return found
+}
+
+// isMux reports whether tgt requests a mux session.
+func isMux(tgt socks.Addr) bool { return bytes.Equal(tgt, muxAddr) }
+
+// serveMux relays the streams of the mux session on c from a client at from.
+func serveMux(id string, c net.Conn, from net.Addr) {
+	s := mux.Server(c, muxConfig)
+	defer s.Close()
+	logf("[%s] mux session from %v", id, from)
+	if advisor != nil {
+		go advisor.Advise(id, s)
+	}
+	for {
+		st, err := s.Accept()
+		if err != nil {
+			logf("[%s] mux session from %v ended: %v", id, from, err)
+			return
+		}
+		go func() {
+			defer st.Close()
+			sid := newSessionID()
+			tgt, err := socks.ReadAddr(st)
+			if err != nil {
+				logf("[%s] failed to get target address of mux stream: %v", sid, err)
+				return
+			}
+			tgt, _ = lookupHosts(tgt)
+			relayTarget(sid, st, from, tgt)
+		}()
+	}
+}
@@ -0,0 +1,51 @@
+// +build !router
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// pacServer serves a proxy auto-config file on addr at /proxy.pac and at /wpad.dat for
+// Web Proxy Auto-Discovery, directing browsers to the SOCKS proxy on socksAddr.
+func pacServer(addr, socksAddr string) {
+	socksHost, socksPort, err := net.SplitHostPort(socksAddr)
+	if err != nil {
+		logf("invalid SOCKS address %q: %v", socksAddr, err)
+		return
+	}
+
+	pac := func(w http.ResponseWriter, r *http.Request) {
+		host := socksHost
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			// the proxy is reachable on the address the client reached us at
+			host = r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = h
+			}
+		}
+		proxy := net.JoinHostPort(host, socksPort)
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		fmt.Fprintf(w, "function FindProxyForURL(url, host) {\n\treturn \"SOCKS5 %s; SOCKS %s\";\n}\n", proxy, proxy)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy.pac", pac)
+	mux.HandleFunc("/wpad.dat", pac)
+
+	l, err := listen("tcp", addr)
+	if err != nil {
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
+	logf("PAC/WPAD server %s -> SOCKS %s", addr, socksAddr)
+	if a, ok := l.Addr().(*net.TCPAddr); ok {
+		logf("for WPAD via DHCP, set option 252 to http://[this host]:%d/wpad.dat (dnsmasq: dhcp-option=252,\"http://[this host]:%d/wpad.dat\")",
+			a.Port, a.Port)
+	}
+	if err := http.Serve(l, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+		logf("PAC server error: %v", err)
+	}
+}
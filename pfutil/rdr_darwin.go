@@ -0,0 +1,55 @@
+package pfutil
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+)
+
+// Anchor holds the rules installed by InstallRdr. It is nested under com.apple
+// so that the stock /etc/pf.conf of macOS evaluates it without changes.
+const Anchor = "com.apple/go-shadowsocks2"
+
+var enableToken = regexp.MustCompile(`Token : (\d+)`)
+
+// InstallRdr enables pf and loads a rule into Anchor that redirects IPv4 TCP arriving
+// on iface, except to the addresses of iface itself, to ip and port, localhost if ip is
+// unspecified. It returns the reference token pf was enabled with, which must be passed
+// to UninstallRdr.
+func InstallRdr(iface string, ip net.IP, port int) (token string, err error) {
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	if ip.To4() == nil {
+		return "", fmt.Errorf("cannot redirect IPv4 TCP to %s", ip)
+	}
+	rule := fmt.Sprintf("rdr pass on %s inet proto tcp from any to ! (%s) -> %s port %d\n", iface, iface, ip, port)
+	cmd := exec.Command("pfctl", "-a", Anchor, "-f", "-")
+	cmd.Stdin = bytes.NewBufferString(rule)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("pfctl: %v: %s", err, out)
+	}
+
+	out, err := exec.Command("pfctl", "-E").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("pfctl: %v: %s", err, out)
+	}
+	m := enableToken.FindSubmatch(out)
+	if m == nil {
+		return "", fmt.Errorf("pfctl: no enable token in output: %s", out)
+	}
+	return string(m[1]), nil
+}
+
+// UninstallRdr flushes the rules in Anchor and releases the pf enable reference token.
+func UninstallRdr(token string) error {
+	if out, err := exec.Command("pfctl", "-a", Anchor, "-F", "all").CombinedOutput(); err != nil {
+		return fmt.Errorf("pfctl: %v: %s", err, out)
+	}
+	if out, err := exec.Command("pfctl", "-X", token).CombinedOutput(); err != nil {
+		return fmt.Errorf("pfctl: %v: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// +build !router
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/policy"
+)
+
+const policyInterval = time.Hour
+
+// policyCheck fetches a signed revocation policy every policyInterval and stops the client
+// if its key ID is revoked, or if no valid policy could be fetched for longer than grace.
+// With override, it only logs why it would stop.
+type policyCheck struct {
+	url      string
+	key      ed25519.PublicKey
+	keyID    string
+	grace    time.Duration
+	override bool
+
+	issued   int64     // of the last valid policy, so that older ones cannot be replayed
+	verified time.Time // when the last valid policy was fetched, or the client started
+}
+
+func newPolicyCheck(url, key, keyID string, grace time.Duration, override bool) (*policyCheck, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(k) != ed25519.PublicKeySize {
+		return nil, errors.New("-policy-key must be a base64-encoded Ed25519 public key")
+	}
+	return &policyCheck{url: url, key: k, keyID: keyID, grace: grace, override: override, verified: time.Now()}, nil
+}
+
+// Check fetches the policy and returns an error if the client has to stop.
+func (p *policyCheck) Check() error {
+	pol, err := p.fetch()
+	switch {
+	case err != nil:
+		logf("policy check failed: %v", err)
+		if time.Since(p.verified) > p.grace {
+			err = fmt.Errorf("no valid policy fetched for %v", p.grace)
+		} else {
+			err = nil
+		}
+	case pol.IsRevoked(p.keyID):
+		err = fmt.Errorf("key ID %s is revoked", p.keyID)
+	}
+	if err != nil && p.override {
+		log.Printf("ignoring by -policy-override: %v", err)
+		return nil
+	}
+	return err
+}
+
+// fetch fetches and verifies the policy.
+func (p *policyCheck) fetch() (*policy.Policy, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(p.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("policy server responded with %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	pol, err := policy.Verify(p.key, b)
+	if err != nil {
+		return nil, err
+	}
+	if pol.Issued < p.issued {
+		return nil, errors.New("policy is older than the last one fetched")
+	}
+	p.issued, p.verified = pol.Issued, time.Now()
+	return pol, nil
+}
+
+// Run checks the policy every policyInterval and sends sig to stop when the client has to stop.
+func (p *policyCheck) Run(stop chan<- os.Signal, sig os.Signal) {
+	for range time.Tick(policyInterval) {
+		if err := p.Check(); err != nil {
+			log.Printf("stopping: %v", err)
+			stop <- sig
+			return
+		}
+	}
+}
+
+// signPolicy implements the sign-policy subcommand which signs a JSON revocation policy
+// with the Ed25519 seed in $SHADOWSOCKS_POLICY_SEED, kept out of the command line.
+func signPolicy(args []string) error {
+	fs := flag.NewFlagSet("sign-policy", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: SHADOWSOCKS_POLICY_SEED=[seed] %s sign-policy [policy.json]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	seed, err := base64.URLEncoding.DecodeString(os.Getenv("SHADOWSOCKS_POLICY_SEED"))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return errors.New("SHADOWSOCKS_POLICY_SEED must be a base64url-encoded 32-byte seed, e.g. from -keygen 32")
+	}
+	b, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var pol policy.Policy
+	if err := json.Unmarshal(b, &pol); err != nil {
+		return err
+	}
+	if pol.Issued == 0 {
+		pol.Issued = time.Now().Unix()
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	if b, err = policy.Sign(key, &pol); err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	fmt.Fprintf(os.Stderr, "public key for -policy-key: %s\n", base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	return nil
+}
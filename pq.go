@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/internal/pqkex"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// pqAddr is the target address by which clients with -pq start the hybrid key exchange of
+// X25519 and ML-KEM with the server. The connection then continues in a stream encrypted
+// with the session key agreed on, starting with the actual target address.
+var pqAddr = socks.ParseAddr("pq.go-shadowsocks2.invalid:0")
+
+// isPQ reports whether tgt starts the hybrid key exchange.
+func isPQ(tgt socks.Addr) bool { return bytes.Equal(tgt, pqAddr) }
+
+// pqCipher runs the hybrid key exchange on the stream connections of a cipher.
+type pqCipher struct{ core.Cipher }
+
+func (c pqCipher) StreamConn(rc net.Conn) net.Conn { return &pqConn{Conn: c.Cipher.StreamConn(rc)} }
+
+// pqConn is a client connection of -pq. The key exchange runs on its first read or write.
+type pqConn struct {
+	net.Conn // shadowed with the static key
+	once     sync.Once
+	s        net.Conn // encrypted with the session key once exchanged
+	err      error
+}
+
+func (c *pqConn) exchange() {
+	if _, c.err = c.Conn.Write(pqAddr); c.err != nil {
+		return
+	}
+	var key []byte
+	if key, c.err = pqkex.Client(c.Conn); c.err != nil {
+		return
+	}
+	c.s, c.err = pqSession(c.Conn, key)
+}
+
+func (c *pqConn) Read(b []byte) (int, error) {
+	if c.once.Do(c.exchange); c.err != nil {
+		return 0, c.err
+	}
+	return c.s.Read(b)
+}
+
+func (c *pqConn) Write(b []byte) (int, error) {
+	if c.once.Do(c.exchange); c.err != nil {
+		return 0, c.err
+	}
+	return c.s.Write(b)
+}
+
+// pqServer runs the key exchange with the client on c, which sent pqAddr, and returns the
+// connection encrypted with the session key and the target address the client sent on it.
+func pqServer(c net.Conn) (net.Conn, socks.Addr, error) {
+	key, err := pqkex.Server(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c, err = pqSession(c, key); err != nil {
+		return nil, nil, err
+	}
+	tgt, err := socks.ReadAddr(c)
+	return c, tgt, err
+}
+
+// pqSession returns c encrypted with the session key.
+func pqSession(c net.Conn, key []byte) (net.Conn, error) {
+	ciph, err := shadowaead.Chacha20Poly1305(key)
+	if err != nil {
+		return nil, err
+	}
+	return shadowaead.NewConn(c, ciph), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	preconnectRetryMin = time.Second // after failing to dial, doubling up to preconnectRetryMax
+	preconnectRetryMax = 30 * time.Second
+)
+
+// linkPool keeps connections to the server dialed ahead over the transport, so that new flows
+// skip the handshakes of TCP and of the transport, e.g. TLS, WebSocket or a plugin. As nothing
+// is sent on them before they are used, connections waiting longer than idle are replaced
+// before servers or middleboxes drop them. Plain TCP connections are also checked for having
+// been closed by the server when taken.
+type linkPool struct {
+	server string
+	size   int
+	idle   time.Duration
+
+	mu    sync.Mutex
+	conns []pooledConn  // oldest first
+	taken chan struct{} // signaled when connections are taken, with capacity 1
+}
+
+type pooledConn struct {
+	net.Conn
+	dialed time.Time
+}
+
+// preconnect is set on clients with -preconnect and used by dialTarget.
+var preconnect *linkPool
+
+func newLinkPool(server string, size int, idle time.Duration) *linkPool {
+	p := &linkPool{server: server, size: size, idle: idle, taken: make(chan struct{}, 1)}
+	go p.fill()
+	return p
+}
+
+// Get returns a connection to the server from the pool, or dials one if the pool is empty.
+func (p *linkPool) Get() (net.Conn, error) {
+	for {
+		p.mu.Lock()
+		n := len(p.conns)
+		if n == 0 {
+			p.mu.Unlock()
+			break
+		}
+		c := p.conns[n-1]
+		p.conns = p.conns[:n-1]
+		p.mu.Unlock()
+		select {
+		case p.taken <- struct{}{}:
+		default:
+		}
+		if time.Since(c.dialed) < p.idle && isOpen(c.Conn) {
+			return c.Conn, nil
+		}
+		c.Close()
+	}
+	c, err := link.Dial(p.server)
+	if err == nil {
+		setLinkKeepAlive(c)
+	}
+	return c, err
+}
+
+// fill keeps the pool filled with size connections, replacing those waiting too long.
+func (p *linkPool) fill() {
+	retry := preconnectRetryMin
+	for {
+		p.expire()
+		p.mu.Lock()
+		missing := p.size - len(p.conns)
+		p.mu.Unlock()
+		if missing <= 0 {
+			select {
+			case <-p.taken:
+			case <-time.After(p.idle / 4):
+			}
+			continue
+		}
+
+		c, err := link.Dial(p.server)
+		if err != nil {
+			logf("failed to preconnect to %s: %v", p.server, err)
+			time.Sleep(retry)
+			if retry *= 2; retry > preconnectRetryMax {
+				retry = preconnectRetryMax
+			}
+			continue
+		}
+		retry = preconnectRetryMin
+		setLinkKeepAlive(c)
+		p.mu.Lock()
+		p.conns = append(p.conns, pooledConn{c, time.Now()})
+		p.mu.Unlock()
+	}
+}
+
+// expire closes the connections waiting for longer than idle.
+func (p *linkPool) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := 0
+	for i < len(p.conns) && time.Since(p.conns[i].dialed) >= p.idle {
+		p.conns[i].Close()
+		i++
+	}
+	p.conns = append(p.conns[:0], p.conns[i:]...)
+}
+
+// isOpen reports whether the plain TCP connection c has not been closed by the server, which
+// sends nothing first, by reading with a deadline already passed. Connections of other
+// transports are assumed open, as reading past a deadline may break them.
+func isOpen(c net.Conn) bool {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return true
+	}
+	tc.SetReadDeadline(time.Now())
+	_, err := tc.Read(make([]byte, 1))
+	tc.SetReadDeadline(time.Time{})
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,9 @@
+// +build !router
+
+package main
+
+// udpBufSize is the size of UDP packet buffers, fitting the largest datagrams.
+const udpBufSize = 64 * 1024
+
+// prunedFlags are the flags of subsystems left out of the build, none but in router builds.
+var prunedFlags []string
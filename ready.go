@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// starting counts the front-ends yet to bind their listener. It is incremented before
+// starting each front-end and decremented by listen or listenPacket once bound.
+var starting sync.WaitGroup
+
+// signalReady waits until all front-ends listen and, if server is given, a TCP connection
+// to it succeeds. It then writes the process ID to file and READY to the file descriptor
+// fd, if given, so that scripts starting the program can wait for it deterministically.
+func signalReady(file string, fd int, server string) {
+	starting.Wait()
+	for server != "" {
+		c, err := dialServer(server)
+		if err == nil {
+			c.Close()
+			break
+		}
+		logf("waiting for server %s: %v", server, err)
+		time.Sleep(time.Second)
+	}
+
+	if file != "" {
+		if err := ioutil.WriteFile(file, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+			logf("failed to write ready file: %v", err)
+		} else {
+			atExit(func() { os.Remove(file) })
+		}
+	}
+	// after an upgrade, the descriptors from 3 on are the inherited listeners
+	if _, upgraded := os.LookupEnv(listenFDsEnv); fd > 0 && !upgraded {
+		f := os.NewFile(uintptr(fd), "ready")
+		if _, err := f.WriteString("READY\n"); err != nil {
+			logf("failed to write to ready file descriptor: %v", err)
+		}
+		f.Close()
+	}
+	logf("ready")
+}
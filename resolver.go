@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/dnsmsg"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// tunnelResolver resolves names with DNS queries over TCP to a DNS server reached through
+// the shadowsocks server, so that lookups neither leak to nor depend on the local network.
+type tunnelResolver struct {
+	server string
+	shadow func(net.Conn) net.Conn
+	dns    socks.Addr
+}
+
+// resolver is set on clients and used for the SOCKS RESOLVE and RESOLVE_PTR commands.
+var resolver *tunnelResolver
+
+// Exchange sends the DNS message query and returns the response.
+func (r *tunnelResolver) Exchange(query []byte) ([]byte, error) {
+	c, err := dialTarget(r.server, r.shadow, r.dns)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	b := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(b, uint16(len(query)))
+	copy(b[2:], query)
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(b))
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (r *tunnelResolver) lookup(name string, qtype uint16) ([]dnsmsg.Answer, error) {
+	id := uint16(rand.Intn(1 << 16))
+	query, err := dnsmsg.Query(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.Exchange(query)
+	if err != nil {
+		return nil, err
+	}
+	return dnsmsg.Answers(resp, id)
+}
+
+// LookupIP returns an address of host, preferring IPv4.
+func (r *tunnelResolver) LookupIP(host string) (net.IP, error) {
+	for _, qtype := range []uint16{dnsmsg.TypeA, dnsmsg.TypeAAAA} {
+		answers, err := r.lookup(host, qtype)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range answers {
+			if a.Type == qtype {
+				return a.IP, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no address for %s", host)
+}
+
+// LookupAddr returns the name ip maps to.
+func (r *tunnelResolver) LookupAddr(ip net.IP) (string, error) {
+	answers, err := r.lookup(dnsmsg.ReverseName(ip), dnsmsg.TypePTR)
+	if err != nil {
+		return "", err
+	}
+	for _, a := range answers {
+		if a.Type == dnsmsg.TypePTR {
+			return strings.TrimSuffix(a.Name, "."), nil
+		}
+	}
+	return "", fmt.Errorf("no name for %s", ip)
+}
+
+// socksResolve answers a request of the Tor SOCKS extensions on c: RESOLVE for the
+// address of the name in addr or, if ptr is set, RESOLVE_PTR for the name of its IP.
+func socksResolve(c net.Conn, id string, addr socks.Addr, ptr bool) {
+	host, _, _ := net.SplitHostPort(addr.String())
+	var reply socks.Addr
+	var err error
+	if ptr {
+		var name string
+		if ip := net.ParseIP(host); ip == nil {
+			err = fmt.Errorf("not an IP address: %s", host)
+		} else if name, err = resolver.LookupAddr(ip); err == nil {
+			reply = socks.ParseAddr(net.JoinHostPort(name, "0"))
+		}
+	} else {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			if a, ok := lookupHosts(addr); ok {
+				h, _, _ := net.SplitHostPort(a.String())
+				ip = net.ParseIP(h)
+			} else {
+				ip, err = resolver.LookupIP(host)
+			}
+		}
+		if err == nil {
+			reply = socks.ParseAddr(net.JoinHostPort(ip.String(), "0"))
+		}
+	}
+
+	if err != nil || reply == nil {
+		logf("[%s] failed to resolve %s: %v", id, host, err)
+		socks.WriteReply(c, byte(socks.ErrHostUnreachable), socks.ParseAddr("0.0.0.0:0"))
+		return
+	}
+	resolved, _, _ := net.SplitHostPort(reply.String())
+	logf("[%s] resolved %s to %s", id, host, resolved)
+	socks.WriteReply(c, 0, reply)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/mux"
+	"github.com/shadowsocks/go-shadowsocks2/internal/relay"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// reverseAddr is the target address by which clients register a reverse tunnel with the
+// server. The client then sends the address for the server to listen on, and the server
+// replies with a status byte, 0 if listening. The connection then carries a mux session in
+// which the server opens a stream for each connection it accepts, starting with the address
+// of its source, and the client relays the stream to its local service.
+var reverseAddr = socks.ParseAddr("reverse.go-shadowsocks2.invalid:0")
+
+// reverseRetry is how long a client waits before registering a reverse tunnel again.
+const reverseRetry = 5 * time.Second
+
+var errReverseRefused = errors.New("reverse tunnel refused by server")
+
+// reversePorts are the ports servers listen on for clients, set with -reverse-ports.
+var reversePorts []portRange
+
+type portRange struct{ lo, hi int }
+
+// parsePortRanges parses comma-separated ports and port ranges such as "8080,9000-9100".
+func parsePortRanges(s string) ([]portRange, error) {
+	var ranges []portRange
+	for _, p := range strings.Split(s, ",") {
+		lo, hi := p, p
+		if i := strings.IndexByte(p, '-'); i >= 0 {
+			lo, hi = p[:i], p[i+1:]
+		}
+		l, err1 := strconv.Atoi(lo)
+		h, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || l < 1 || h > 65535 || l > h {
+			return nil, fmt.Errorf("invalid port range %q", p)
+		}
+		ranges = append(ranges, portRange{l, h})
+	}
+	return ranges, nil
+}
+
+// reversePortAllowed reports whether clients may register a reverse tunnel on port.
+func reversePortAllowed(port int) bool {
+	for _, r := range reversePorts {
+		if r.lo <= port && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// isReverse reports whether tgt requests a reverse tunnel.
+func isReverse(tgt socks.Addr) bool { return bytes.Equal(tgt, reverseAddr) }
+
+// reverseTun registers a reverse tunnel from remote on server to the local service at
+// target, and registers it again whenever it breaks.
+func reverseTun(remote, server, target string, shadow func(net.Conn) net.Conn) {
+	addr := socks.ParseAddr(remote)
+	if addr == nil {
+		logf("invalid remote address %q", remote)
+		return
+	}
+	for {
+		err := reverseSession(addr, server, target, shadow)
+		logf("reverse tunnel %s <-> %s ended: %v", remote, target, err)
+		time.Sleep(reverseRetry)
+	}
+}
+
+// reverseSession registers a reverse tunnel from addr on server to target and relays the
+// connections it carries until the session ends.
+func reverseSession(addr socks.Addr, server, target string, shadow func(net.Conn) net.Conn) error {
+	c, err := dialTarget(server, shadow, reverseAddr)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Write(addr); err != nil {
+		c.Close()
+		return err
+	}
+	var status [1]byte
+	if _, err := io.ReadFull(c, status[:]); err != nil {
+		c.Close()
+		return err
+	}
+	if status[0] != 0 {
+		c.Close()
+		return errReverseRefused
+	}
+	s := mux.Client(c, muxConfig)
+	defer s.Close()
+	logf("reverse tunnel %s <-> %s <-> %s", addr, server, target)
+	for {
+		st, err := s.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer st.Close()
+			id := newSessionID()
+			src, err := socks.ReadAddr(st)
+			if err != nil {
+				logf("[%s] failed to get source address of reverse stream: %v", id, err)
+				return
+			}
+			lc, err := net.Dial("tcp", target)
+			if err != nil {
+				logf("[%s] failed to connect to %s: %v", id, target, err)
+				return
+			}
+			defer lc.Close()
+			logf("[%s] reverse %s <-> %s", id, src, target)
+			if err := relay.TCP(st, lc, relay.NewFlow(id, "tcp", st.RemoteAddr(), target)); err != nil {
+				logf("[%s] relay error: %v", id, err)
+			}
+		}()
+	}
+}
+
+// serveReverse listens for the reverse tunnel the client at from registers on c, and
+// relays the connections accepted to the client until either ends.
+func serveReverse(id string, c net.Conn, from net.Addr) {
+	addr, err := socks.ReadAddr(c)
+	if err != nil {
+		logf("[%s] failed to get reverse tunnel address from %v: %v", id, from, err)
+		return
+	}
+	host, port, _ := net.SplitHostPort(addr.String())
+	p, _ := strconv.Atoi(port)
+	if !reversePortAllowed(p) {
+		logf("[%s] refused reverse tunnel on %s from %v: port not in -reverse-ports", id, addr, from)
+		c.Write([]byte{1})
+		return
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		logf("[%s] refused reverse tunnel on %s from %v: %v", id, addr, from, err)
+		c.Write([]byte{1})
+		return
+	}
+	defer l.Close()
+	if _, err := c.Write([]byte{0}); err != nil {
+		return
+	}
+	s := mux.Server(c, muxConfig)
+	defer s.Close()
+	logf("[%s] reverse tunnel %s <-> %v", id, l.Addr(), from)
+	go func() {
+		for {
+			st, err := s.Accept()
+			if err != nil {
+				l.Close()
+				return
+			}
+			st.Close() // clients open no streams
+		}
+	}()
+	for {
+		rc, err := l.Accept()
+		if err != nil {
+			logf("[%s] reverse tunnel %s <-> %v ended: %v", id, l.Addr(), from, err)
+			return
+		}
+		go func() {
+			defer rc.Close()
+			sid := newSessionID()
+			st, err := s.Open()
+			if err != nil {
+				return
+			}
+			defer st.Close()
+			if _, err := st.Write(socks.ParseAddr(rc.RemoteAddr().String())); err != nil {
+				return
+			}
+			logf("[%s] reverse %s <-> %v", sid, rc.RemoteAddr(), from)
+			if err := relay.TCP(rc, st, relay.NewFlow(sid, "tcp", rc.RemoteAddr(), from.String())); err != nil {
+				logf("[%s] relay error: %v", sid, err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,111 @@
+// +build router
+
+// Router builds, made with the router build tag, leave out the subsystems built on HTTP and
+// TLS and use smaller buffers, for routers with little flash and memory such as OpenWrt
+// devices with 32 MB of RAM. Build them stripped and without cgo, e.g. for MIPS:
+//
+//	CGO_ENABLED=0 GOOS=linux GOARCH=mipsle GOMIPS=softfloat go build -tags router -ldflags '-s -w'
+//
+// or with the router targets of the Makefile. Left out are the ws, wss, grpc and shadowtls
+// transports with their certificates, client certificates and ACME, -obfs, Trojan servers, HTTP upstream proxies,
+// SOCKS over TLS and WebSocket, DNS over HTTPS, PAC, pre-warming hints, decoy traffic,
+// revocation policies, -events and -diagnose. Their flags are rejected at startup.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// udpBufSize is the size of UDP packet buffers, fitting datagrams of up to 16 KiB, far
+// beyond the MTU of router links.
+const udpBufSize = 16 * 1024
+
+// prunedFlags are the flags of subsystems left out of the build.
+var prunedFlags = []string{
+	"socks-ws", "socks-ws-origins", "socks-cert", "socks-key", "socks-client-ca",
+	"doh", "doh-cert", "doh-key", "pac", "hints", "decoy", "decoy-budget",
+	"policy-url", "policy-key", "policy-grace", "policy-override", "diagnose", "events",
+	"transport-cert", "transport-key", "acme-cache", "transport-client-ca", "transport-crl",
+	"transport-client-cert", "transport-client-key", "obfs", "tls-fragment", "tls-fragment-delay",
+}
+
+var errPruned = errors.New("not available in router builds")
+
+func parseWebTransport(u *url.URL) (transport, error) {
+	switch u.Scheme {
+	case "ws", "wss", "grpc", "shadowtls":
+		return nil, fmt.Errorf("transport %s is %v", u.Scheme, errPruned)
+	}
+	return nil, fmt.Errorf("unsupported transport %q", u)
+}
+
+func setTransportTLS(t transport, certFile, keyFile, acmeCache string) error { return nil }
+
+func setTransportClientAuth(t transport, caFile, crlFile string) error { return errPruned }
+
+func setTransportClientCert(t transport, certFile, keyFile string) error { return errPruned }
+
+func parseObfs(t transport, s string) (transport, error) { return nil, errPruned }
+
+func (d *proxyDialer) connect(c net.Conn, addr string) error {
+	return fmt.Errorf("HTTP upstream proxies are %v", errPruned)
+}
+
+type trojanDialer struct{}
+
+func parseTrojanURL(s string) (string, *trojanDialer, error) {
+	return "", nil, fmt.Errorf("Trojan servers are %v", errPruned)
+}
+
+func (d *trojanDialer) Dial(tgt socks.Addr) (net.Conn, error) { return nil, errPruned }
+
+func loadSocksTLS(certFile, keyFile, caFile string) error { return errPruned }
+
+func withSocksTLS(l net.Listener) (net.Listener, bool) { return l, false }
+
+func socksWSLocal(addr, server string, origins []string, shadow func(net.Conn) net.Conn) {}
+
+func startDoH(addr, certFile, keyFile string) error { return errPruned }
+
+func pacServer(addr, socksAddr string) {}
+
+type warmPool struct{}
+
+// warm is always nil in router builds.
+var warm *warmPool
+
+func newWarmPool(server string, shadow func(net.Conn) net.Conn) *warmPool { return nil }
+
+func (p *warmPool) Take(tgt socks.Addr) net.Conn { return nil }
+
+func hintsServer(addr string) {}
+
+func decoyLocal(urls []string, server string, shadow func(net.Conn) net.Conn, budget int64) {}
+
+type policyCheck struct{}
+
+func newPolicyCheck(url, key, keyID string, grace time.Duration, override bool) (*policyCheck, error) {
+	return nil, errPruned
+}
+
+func (p *policyCheck) Check() error { return errPruned }
+
+func (p *policyCheck) Run(stop chan<- os.Signal, sig os.Signal) {}
+
+func signPolicy(args []string) error { return fmt.Errorf("sign-policy is %v", errPruned) }
+
+type eventHub struct{}
+
+func newEventHub() *eventHub { return nil }
+
+func (h *eventHub) serve(addr string) {}
+
+func diagnose(path, server string, shadow func(net.Conn) net.Conn) error { return errPruned }
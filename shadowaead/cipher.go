@@ -8,6 +8,7 @@ import (
 	"io"
 	"strconv"
 
+	"github.com/shadowsocks/go-shadowsocks2/internal/gcmsiv"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
 )
@@ -77,6 +78,17 @@ func AESGCM(psk []byte) (Cipher, error) {
 	return &metaCipher{psk: psk, makeAEAD: aesGCM}, nil
 }
 
+// AESGCMSIV creates a new Cipher with a pre-shared key, using AES-GCM-SIV, which resists
+// nonce reuse. len(psk) must be 16 or 32 to select AES-128/256-GCM-SIV.
+func AESGCMSIV(psk []byte) (Cipher, error) {
+	switch l := len(psk); l {
+	case 16, 32:
+	default:
+		return nil, aes.KeySizeError(l)
+	}
+	return &metaCipher{psk: psk, makeAEAD: gcmsiv.New}, nil
+}
+
 // Chacha20Poly1305 creates a new Cipher with a pre-shared key. len(psk)
 // must be 32.
 func Chacha20Poly1305(psk []byte) (Cipher, error) {
@@ -85,3 +97,12 @@ func Chacha20Poly1305(psk []byte) (Cipher, error) {
 	}
 	return &metaCipher{psk: psk, makeAEAD: chacha20poly1305.New}, nil
 }
+
+// XChacha20Poly1305 creates a new Cipher with a pre-shared key, using the 24-byte nonces of
+// XChaCha20-Poly1305. len(psk) must be 32.
+func XChacha20Poly1305(psk []byte) (Cipher, error) {
+	if len(psk) != chacha20poly1305.KeySize {
+		return nil, KeySizeError(chacha20poly1305.KeySize)
+	}
+	return &metaCipher{psk: psk, makeAEAD: chacha20poly1305.NewX}, nil
+}
@@ -50,7 +50,7 @@ func Unpack(dst, pkt []byte, ciph Cipher) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if internal.CheckSalt(salt) {
+	if internal.TestSalt(salt) {
 		return nil, ErrRepeatedSalt
 	}
 	if len(pkt) < saltSize+aead.Overhead() {
@@ -60,7 +60,14 @@ func Unpack(dst, pkt []byte, ciph Cipher) ([]byte, error) {
 		return nil, io.ErrShortBuffer
 	}
 	b, err := aead.Open(dst[:0], _zerononce[:aead.NonceSize()], pkt[saltSize:], nil)
-	return b, err
+	if err != nil {
+		return nil, err
+	}
+	// only authenticated packets are remembered, so that garbage cannot rotate the filter
+	if internal.AddReceivedSalt(salt) {
+		return nil, ErrRepeatedSalt
+	}
+	return b, nil
 }
 
 type packetConn struct {
@@ -0,0 +1,109 @@
+package shadowaead
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+)
+
+// readConn is a net.Conn reading from a byte slice.
+type readConn struct {
+	net.Conn
+	io.Reader
+}
+
+func (c readConn) Read(b []byte) (int, error) { return c.Reader.Read(b) }
+
+func newTestCipher(t *testing.T) Cipher {
+	ciph, err := AESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciph
+}
+
+func newSalt(t *testing.T, ciph Cipher) []byte {
+	salt := make([]byte, ciph.SaltSize())
+	if _, err := rand.Read(salt); err != nil {
+		t.Fatal(err)
+	}
+	return salt
+}
+
+// sealStream returns a stream starting with salt and carrying payload, as a client would
+// write it, without adding salt to the salt filter.
+func sealStream(t *testing.T, ciph Cipher, salt, payload []byte) []byte {
+	aead, err := ciph.Encrypter(salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	buf.Write(salt)
+	if _, err := newWriter(&buf, aead).Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readStream(ciph Cipher, stream []byte) ([]byte, error) {
+	c := NewConn(readConn{Reader: bytes.NewReader(stream)}, ciph)
+	b := make([]byte, 64)
+	n, err := c.Read(b)
+	return b[:n], err
+}
+
+func TestStreamSaltAddedAfterAuthentication(t *testing.T) {
+	ciph := newTestCipher(t)
+	salt := newSalt(t, ciph)
+	msg := []byte("GET / HTTP/1.1\r\n")
+
+	// garbage after a salt fails to authenticate and leaves the salt to the genuine client
+	garbage := append(append([]byte{}, salt...), make([]byte, 64)...)
+	if _, err := readStream(ciph, garbage); err == nil || err == ErrRepeatedSalt {
+		t.Fatalf("garbage: got %v, want an authentication error", err)
+	}
+
+	stream := sealStream(t, ciph, salt, msg)
+	b, err := readStream(ciph, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, msg) {
+		t.Fatalf("got %q, want %q", b, msg)
+	}
+
+	if _, err := readStream(ciph, stream); err != ErrRepeatedSalt {
+		t.Fatalf("replay: got %v, want %v", err, ErrRepeatedSalt)
+	}
+}
+
+func TestPacketSaltAddedAfterAuthentication(t *testing.T) {
+	ciph := newTestCipher(t)
+	salt := newSalt(t, ciph)
+	msg := []byte("query")
+	dst := make([]byte, 64)
+
+	garbage := append(append([]byte{}, salt...), make([]byte, 32)...)
+	if _, err := Unpack(dst, garbage, ciph); err == nil || err == ErrRepeatedSalt {
+		t.Fatalf("garbage: got %v, want an authentication error", err)
+	}
+
+	aead, err := ciph.Encrypter(salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := aead.Seal(append([]byte{}, salt...), _zerononce[:aead.NonceSize()], msg, nil)
+	b, err := Unpack(dst, pkt, ciph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, msg) {
+		t.Fatalf("got %q, want %q", b, msg)
+	}
+
+	if _, err := Unpack(dst, pkt, ciph); err != ErrRepeatedSalt {
+		t.Fatalf("replay: got %v, want %v", err, ErrRepeatedSalt)
+	}
+}
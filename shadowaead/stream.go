@@ -82,6 +82,7 @@ type reader struct {
 	nonce    []byte
 	buf      []byte
 	leftover []byte
+	salt     []byte // to add to the salt filter once the first record is authenticated
 }
 
 // NewReader wraps an io.Reader with AEAD decryption.
@@ -126,6 +127,13 @@ func (r *reader) read() (int, error) {
 		return 0, err
 	}
 
+	if r.salt != nil {
+		salt := r.salt
+		r.salt = nil
+		if internal.AddReceivedSalt(salt) {
+			return 0, ErrRepeatedSalt
+		}
+	}
 	return size, nil
 }
 
@@ -210,11 +218,12 @@ func (c *streamConn) initReader() error {
 		return err
 	}
 
-	if internal.CheckSalt(salt) {
+	if internal.TestSalt(salt) {
 		return ErrRepeatedSalt
 	}
 
 	c.r = newReader(c.Conn, aead)
+	c.r.salt = salt
 	return nil
 }
 
@@ -0,0 +1,166 @@
+package shadowaead2022
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/blake3"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ErrBadTimestamp means that a request or packet is too old or from too far in the future,
+// as with replays after their salt is forgotten or with a client whose clock is off.
+var ErrBadTimestamp = errors.New("timestamp out of range")
+
+// ErrRepeatedPacket means that a packet was received before.
+var ErrRepeatedPacket = errors.New("repeated packet detected")
+
+// maxTimeDiff is the maximum difference between the timestamp of a request or response and
+// the local time, accessed atomically.
+var maxTimeDiff = int64(30 * time.Second)
+
+// MaxTimeDiff returns the maximum difference between the timestamp of a request or response
+// and the local time, 30 seconds as SIP022 specifies unless set otherwise.
+func MaxTimeDiff() time.Duration { return time.Duration(atomic.LoadInt64(&maxTimeDiff)) }
+
+// SetMaxTimeDiff sets the maximum difference between timestamps and the local time. Widening
+// it lets peers with worse clocks connect, at the cost of remembering salts for longer.
+func SetMaxTimeDiff(d time.Duration) { atomic.StoreInt64(&maxTimeDiff, int64(d)) }
+
+// SkewError is the error of a timestamp out of range. It matches ErrBadTimestamp.
+type SkewError struct {
+	Skew time.Duration // how far the clock of the peer is ahead of the local clock
+}
+
+func (e *SkewError) Error() string {
+	return fmt.Sprintf("%v: clock of the peer is off by %v", ErrBadTimestamp, e.Skew)
+}
+
+func (e *SkewError) Is(target error) bool { return target == ErrBadTimestamp }
+
+// lastSkew is the skew of the last authenticated timestamp.
+var lastSkew struct {
+	sync.Mutex
+	skew time.Duration
+	ok   bool
+}
+
+// Skew returns how far the clock of the peer that sent the last authenticated timestamp, in
+// range or not, is ahead of the local clock, to the second, or false if none was received. On
+// clients, it is the skew of the server.
+func Skew() (time.Duration, bool) {
+	lastSkew.Lock()
+	defer lastSkew.Unlock()
+	return lastSkew.skew, lastSkew.ok
+}
+
+// Cipher is a Shadowsocks 2022 method with its pre-shared key.
+type Cipher struct {
+	psk     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	block   cipher.Block // encrypts the session and packet IDs of packets, nil with ChaCha20-Poly1305
+	xaead   cipher.AEAD  // seals packets with ChaCha20-Poly1305
+}
+
+// AESGCM creates a new Cipher with a pre-shared key. len(psk) must be
+// 16 or 32 to select 2022-blake3-aes-128-gcm or 2022-blake3-aes-256-gcm.
+func AESGCM(psk []byte) (*Cipher, error) {
+	switch l := len(psk); l {
+	case 16, 32:
+	default:
+		return nil, aes.KeySizeError(l)
+	}
+	blk, err := aes.NewCipher(psk)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{psk: psk, newAEAD: aesGCM, block: blk}, nil
+}
+
+// Chacha20Poly1305 creates a new Cipher with a pre-shared key for
+// 2022-blake3-chacha20-poly1305. len(psk) must be 32.
+func Chacha20Poly1305(psk []byte) (*Cipher, error) {
+	if len(psk) != chacha20poly1305.KeySize {
+		return nil, shadowaead.KeySizeError(chacha20poly1305.KeySize)
+	}
+	xaead, err := chacha20poly1305.NewX(psk)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{psk: psk, newAEAD: chacha20poly1305.New, xaead: xaead}, nil
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
+
+func (c *Cipher) KeySize() int  { return len(c.psk) }
+func (c *Cipher) SaltSize() int { return len(c.psk) }
+
+// sessionAEAD returns the AEAD with the subkey of a stream session with the given salt or
+// of a packet session with the given session ID.
+func (c *Cipher) sessionAEAD(salt []byte) (cipher.AEAD, error) {
+	material := make([]byte, 0, len(c.psk)+len(salt))
+	material = append(append(material, c.psk...), salt...)
+	subkey := make([]byte, len(c.psk))
+	blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", material)
+	return c.newAEAD(subkey)
+}
+
+func timestamp() []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Unix()))
+	return b
+}
+
+func checkTimestamp(b []byte) error {
+	skew := time.Until(time.Unix(int64(binary.BigEndian.Uint64(b)), 0)).Round(time.Second)
+	lastSkew.Lock()
+	lastSkew.skew, lastSkew.ok = skew, true
+	lastSkew.Unlock()
+	if max := MaxTimeDiff(); skew > max || skew < -max {
+		return &SkewError{skew}
+	}
+	return nil
+}
+
+// saltPool remembers salts for as long as requests using them have valid timestamps.
+type saltPool struct {
+	sync.Mutex
+	salts  map[string]time.Time
+	pruned time.Time
+}
+
+var salts = &saltPool{salts: make(map[string]time.Time)}
+
+// Add adds salt and reports whether it was not in the pool yet.
+func (p *saltPool) Add(salt []byte) bool {
+	ttl := 2 * MaxTimeDiff()
+	now := time.Now()
+	p.Lock()
+	defer p.Unlock()
+	if now.Sub(p.pruned) > ttl {
+		for s, t := range p.salts {
+			if now.Sub(t) > ttl {
+				delete(p.salts, s)
+			}
+		}
+		p.pruned = now
+	}
+	if t, ok := p.salts[string(salt)]; ok && now.Sub(t) <= ttl {
+		return false
+	}
+	p.salts[string(salt)] = now
+	return true
+}
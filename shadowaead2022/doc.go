@@ -0,0 +1,41 @@
+/*
+Package shadowaead2022 implements the Shadowsocks 2022 AEAD protocol (SIP022).
+
+It improves on the protocol of package shadowaead against active probing and replay.
+Keys are used as is instead of being derived from passwords, session subkeys are derived
+with BLAKE3 from the key and a random salt, and requests carry a timestamp that the server
+checks, so that salts only need to be remembered for a minute to reject every replay.
+
+A stream-oriented connection from client to server starts with a random salt followed by
+a fixed-length and a variable-length header, each sealed like a record:
+
+	[salt]
+	[type = 0][timestamp][length of variable-length header]
+	[target address][padding length][padding][initial payload]
+
+The server responds with its own salt and a fixed-length header followed by the first
+payload record:
+
+	[salt]
+	[type = 1][timestamp][request salt][length of first payload]
+	[first payload]
+
+Both directions then continue with records as in package shadowaead, except that payloads
+may be up to 0xFFFF bytes. Timestamps are Unix times in seconds, all integers big-endian.
+
+Packets belong to sessions identified by a random session ID and number their packets
+to reject replays. With AES, a packet consists of the session ID and packet ID encrypted
+with AES using the key, followed by the sealed main header and payload, with a subkey
+derived from the session ID. With ChaCha20-Poly1305, a packet consists of a random nonce
+followed by session ID, packet ID, main header and payload sealed with XChaCha20-Poly1305
+using the key. The main header of packets is
+
+	[type = 0][timestamp][padding length][padding][target address]
+
+from client to server, and
+
+	[type = 1][timestamp][client session ID][padding length][padding][source address]
+
+from server to client.
+*/
+package shadowaead2022
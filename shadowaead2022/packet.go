@@ -0,0 +1,313 @@
+package shadowaead2022
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+const (
+	// sessionTimeout is how long packet sessions are kept without packets in either direction.
+	sessionTimeout = 10 * time.Minute
+	// replayWindow is the number of packet IDs before the highest one received that are tracked.
+	replayWindow = 1024
+	// tagSize is the size of the authentication tag of all AEADs used.
+	tagSize = 16
+)
+
+var errNoSession = errors.New("no session with peer")
+
+// window tracks received packet IDs to reject repeated packets.
+type window struct {
+	last uint64
+	bits [replayWindow / 64]uint64
+}
+
+// Add adds id and reports whether it was not received before.
+func (w *window) Add(id uint64) bool {
+	if id > w.last {
+		if id-w.last >= replayWindow {
+			w.bits = [replayWindow / 64]uint64{}
+		} else {
+			for i := w.last + 1; i <= id; i++ {
+				w.bits[i%replayWindow/64] &^= 1 << (i % 64)
+			}
+		}
+		w.last = id
+	} else if w.last-id >= replayWindow {
+		return false
+	}
+	word, bit := id%replayWindow/64, uint64(1)<<(id%64)
+	if w.bits[word]&bit != 0 {
+		return false
+	}
+	w.bits[word] |= bit
+	return true
+}
+
+// session is a packet session of a peer.
+type session struct {
+	aead   cipher.AEAD // opens packets of the peer
+	window window
+	seen   time.Time
+
+	// Own session replying to a client session, only used by servers.
+	client   uint64
+	id       uint64
+	own      cipher.AEAD
+	packetID uint64
+}
+
+// packetConn takes the role given by the packets it receives: as the server of the clients
+// that send requests to it, as a client otherwise.
+type packetConn struct {
+	net.PacketConn
+	*Cipher
+	sync.Mutex
+	buf      []byte // write lock
+	id       uint64 // own session ID as a client
+	own      cipher.AEAD
+	packetID uint64
+	server   bool
+	sessions map[uint64]*session // by session ID of the peer
+	clients  map[string]*session // by address, only used by servers
+	pruned   time.Time
+}
+
+// NewPacketConn wraps a net.PacketConn with cipher
+func NewPacketConn(c net.PacketConn, ciph *Cipher) net.PacketConn {
+	const maxPacketSize = 64 * 1024
+	id, err := randomID()
+	if err != nil {
+		panic(err) // should never happen
+	}
+	own, err := ciph.packetAEAD(id)
+	if err != nil {
+		panic(err) // should never happen with a valid cipher
+	}
+	return &packetConn{
+		PacketConn: c,
+		Cipher:     ciph,
+		buf:        make([]byte, maxPacketSize),
+		id:         id,
+		own:        own,
+		sessions:   make(map[uint64]*session),
+		clients:    make(map[string]*session),
+	}
+}
+
+func randomID() (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+// packetAEAD returns the AEAD sealing the packets of the session with the given ID.
+func (c *Cipher) packetAEAD(id uint64) (cipher.AEAD, error) {
+	if c.block == nil {
+		return c.xaead, nil
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], id)
+	return c.sessionAEAD(b[:])
+}
+
+// prune removes sessions without packets for sessionTimeout. It must be called with c locked.
+func (c *packetConn) prune(now time.Time) {
+	if now.Sub(c.pruned) < sessionTimeout {
+		return
+	}
+	for id, s := range c.sessions {
+		if now.Sub(s.seen) > sessionTimeout {
+			delete(c.sessions, id)
+		}
+	}
+	for addr, s := range c.clients {
+		if now.Sub(s.seen) > sessionTimeout {
+			delete(c.clients, addr)
+		}
+	}
+	c.pruned = now
+}
+
+// WriteTo encrypts b and write to addr using the embedded PacketConn.
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	hdr := append([]byte{headerTypeRequest}, timestamp()...)
+	id, aead := c.id, c.own
+	var packetID uint64
+	if c.server {
+		s := c.clients[addr.String()]
+		if s == nil {
+			return 0, errNoSession
+		}
+		s.seen = time.Now()
+		hdr[0] = headerTypeResponse
+		hdr = append(hdr, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(hdr[9:], s.client)
+		id, aead, packetID = s.id, s.own, s.packetID
+		s.packetID++
+	} else {
+		packetID = c.packetID
+		c.packetID++
+	}
+	hdr = append(hdr, 0, 0) // no padding
+
+	var buf []byte
+	if c.block != nil {
+		if len(c.buf) < 16+len(hdr)+len(b)+aead.Overhead() {
+			return 0, io.ErrShortBuffer
+		}
+		binary.BigEndian.PutUint64(c.buf, id)
+		binary.BigEndian.PutUint64(c.buf[8:], packetID)
+		n := copy(c.buf[16:], hdr)
+		n += copy(c.buf[16+n:], b)
+		sealed := aead.Seal(c.buf[16:16], c.buf[4:16], c.buf[16:16+n], nil)
+		c.block.Encrypt(c.buf[:16], c.buf[:16])
+		buf = c.buf[:16+len(sealed)]
+	} else {
+		const nonceSize = 24
+		if len(c.buf) < nonceSize+16+len(hdr)+len(b)+aead.Overhead() {
+			return 0, io.ErrShortBuffer
+		}
+		if _, err := io.ReadFull(rand.Reader, c.buf[:nonceSize]); err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint64(c.buf[nonceSize:], id)
+		binary.BigEndian.PutUint64(c.buf[nonceSize+8:], packetID)
+		n := 16 + copy(c.buf[nonceSize+16:], hdr)
+		n += copy(c.buf[nonceSize+n:], b)
+		sealed := aead.Seal(c.buf[nonceSize:nonceSize], c.buf[:nonceSize], c.buf[nonceSize:nonceSize+n], nil)
+		buf = c.buf[:nonceSize+len(sealed)]
+	}
+	_, err := c.PacketConn.WriteTo(buf, addr)
+	return len(b), err
+}
+
+// ReadFrom reads from the embedded PacketConn and decrypts into b.
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	bb, err := c.open(b[:n], addr)
+	if err != nil {
+		return n, addr, err
+	}
+	copy(b, bb)
+	return len(bb), addr, err
+}
+
+// open decrypts pkt from addr in place and returns its target or source address and payload.
+func (c *packetConn) open(pkt []byte, addr net.Addr) ([]byte, error) {
+	var id, packetID uint64
+	var body []byte
+	c.Lock()
+	defer c.Unlock()
+	if c.block != nil {
+		if len(pkt) < 16+tagSize {
+			return nil, shadowaead.ErrShortPacket
+		}
+		var hdr [16]byte
+		c.block.Decrypt(hdr[:], pkt[:16])
+		id, packetID = binary.BigEndian.Uint64(hdr[:]), binary.BigEndian.Uint64(hdr[8:])
+		var aead cipher.AEAD
+		if s := c.sessions[id]; s != nil {
+			aead = s.aead
+		} else if a, err := c.packetAEAD(id); err != nil {
+			return nil, err
+		} else {
+			aead = a
+		}
+		b, err := aead.Open(pkt[16:16], hdr[4:16], pkt[16:], nil)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	} else {
+		const nonceSize = 24
+		if len(pkt) < nonceSize+16+tagSize {
+			return nil, shadowaead.ErrShortPacket
+		}
+		b, err := c.xaead.Open(pkt[nonceSize:nonceSize], pkt[:nonceSize], pkt[nonceSize:], nil)
+		if err != nil {
+			return nil, err
+		}
+		id, packetID = binary.BigEndian.Uint64(b), binary.BigEndian.Uint64(b[8:])
+		body = b[16:]
+	}
+
+	if len(body) < 1+8 {
+		return nil, shadowaead.ErrShortPacket
+	}
+	typ := body[0]
+	if err := checkTimestamp(body[1:9]); err != nil {
+		return nil, err
+	}
+	body = body[9:]
+	switch typ {
+	case headerTypeRequest:
+	case headerTypeResponse:
+		if c.server {
+			return nil, errBadHeaderType
+		}
+		if len(body) < 8 {
+			return nil, shadowaead.ErrShortPacket
+		}
+		if binary.BigEndian.Uint64(body) != c.id {
+			return nil, errNoSession
+		}
+		body = body[8:]
+	default:
+		return nil, errBadHeaderType
+	}
+	if len(body) < 2 {
+		return nil, shadowaead.ErrShortPacket
+	}
+	padding := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+padding {
+		return nil, errBadPadding
+	}
+	body = body[2+padding:]
+
+	now := time.Now()
+	c.prune(now)
+	s := c.sessions[id]
+	if s == nil {
+		aead, err := c.packetAEAD(id)
+		if err != nil {
+			return nil, err
+		}
+		s = &session{aead: aead}
+		if typ == headerTypeRequest {
+			if s.id, err = randomID(); err != nil {
+				return nil, err
+			}
+			if s.own, err = c.packetAEAD(s.id); err != nil {
+				return nil, err
+			}
+			s.client = id
+		}
+	}
+	if !s.window.Add(packetID) {
+		return nil, ErrRepeatedPacket
+	}
+	s.seen = now
+	c.sessions[id] = s
+	if typ == headerTypeRequest {
+		c.server = true
+		c.clients[addr.String()] = s
+	}
+	return body, nil
+}
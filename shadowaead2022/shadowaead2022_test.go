@@ -0,0 +1,182 @@
+package shadowaead2022
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func ciphers(t *testing.T) map[string]*Cipher {
+	m := make(map[string]*Cipher)
+	for name, size := range map[string]int{"aes-128-gcm": 16, "aes-256-gcm": 32, "chacha20-poly1305": 32} {
+		psk := make([]byte, size)
+		rand.Read(psk)
+		var c *Cipher
+		var err error
+		if name == "chacha20-poly1305" {
+			c, err = Chacha20Poly1305(psk)
+		} else {
+			c, err = AESGCM(psk)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[name] = c
+	}
+	return m
+}
+
+// recorder records what is written to the embedded net.Conn.
+type recorder struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.buf.Write(b)
+	return r.Conn.Write(b)
+}
+
+func TestStream(t *testing.T) {
+	tgt := socks.ParseAddr("example.com:443")
+	payload := make([]byte, 100000)
+	rand.Read(payload)
+
+	for name, ciph := range ciphers(t) {
+		cc, sc := net.Pipe()
+		rec := &recorder{Conn: cc}
+		client, server := NewConn(rec, ciph), NewConn(sc, ciph)
+		go func() {
+			client.Write(tgt)
+			client.Write(payload)
+		}()
+
+		addr, err := socks.ReadAddr(server)
+		if err != nil || !bytes.Equal(addr, tgt) {
+			t.Fatalf("%s: ReadAddr = %v, %v", name, addr, err)
+		}
+		got := make([]byte, len(payload))
+		if _, err := io.ReadFull(server, got); err != nil || !bytes.Equal(got, payload) {
+			t.Fatalf("%s: server read %v", name, err)
+		}
+
+		go server.Write(payload)
+		if _, err := io.ReadFull(client, got); err != nil || !bytes.Equal(got, payload) {
+			t.Fatalf("%s: client read %v", name, err)
+		}
+		cc.Close()
+		sc.Close()
+
+		// replay the request
+		cc, sc = net.Pipe()
+		go func() {
+			cc.Write(rec.buf.Bytes())
+			cc.Close()
+		}()
+		if _, err := socks.ReadAddr(NewConn(sc, ciph)); !errors.Is(err, shadowaead.ErrRepeatedSalt) {
+			t.Errorf("%s: replayed request error = %v", name, err)
+		}
+		sc.Close()
+	}
+}
+
+func TestPacket(t *testing.T) {
+	tgt := socks.ParseAddr("1.2.3.4:53")
+	msg := append(tgt, "hello"...)
+
+	for name, ciph := range ciphers(t) {
+		s, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, client := NewPacketConn(s, ciph), NewPacketConn(c, ciph)
+
+		buf := make([]byte, 2048)
+		if _, err := client.WriteTo(msg, s.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		n, addr, err := server.ReadFrom(buf)
+		if err != nil || !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("%s: server read %q, %v", name, buf[:n], err)
+		}
+		if _, err := server.WriteTo(msg, addr); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err = client.ReadFrom(buf)
+		if err != nil || !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("%s: client read %q, %v", name, buf[:n], err)
+		}
+
+		// replay the request
+		client.WriteTo(msg, s.LocalAddr())
+		n, addr, _ = s.ReadFrom(buf)
+		pkt := append([]byte{}, buf[:n]...)
+		if _, err := server.(*packetConn).open(pkt, addr); err != nil {
+			t.Fatalf("%s: open: %v", name, err)
+		}
+		if _, err := server.(*packetConn).open(buf[:n], addr); !errors.Is(err, ErrRepeatedPacket) {
+			t.Errorf("%s: replayed packet error = %v", name, err)
+		}
+		s.Close()
+		c.Close()
+	}
+}
+
+func TestWindow(t *testing.T) {
+	var w window
+	for _, c := range []struct {
+		id uint64
+		ok bool
+	}{
+		{0, true}, {0, false}, {2, true}, {1, true}, {1, false},
+		{replayWindow + 1, true}, {1, false}, {2, false}, {3, true}, {3, false},
+		{5000, true}, {5000 - replayWindow, false}, {5001 - replayWindow, true},
+	} {
+		if ok := w.Add(c.id); ok != c.ok {
+			t.Errorf("Add(%d) = %v, want %v", c.id, ok, c.ok)
+		}
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	at := func(d time.Duration) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(time.Now().Add(d).Unix()))
+		return b
+	}
+	defer SetMaxTimeDiff(MaxTimeDiff())
+
+	if err := checkTimestamp(at(-20 * time.Second)); err != nil {
+		t.Fatalf("timestamp 20s behind: %v", err)
+	}
+	if skew, ok := Skew(); !ok || skew < -21*time.Second || skew > -19*time.Second {
+		t.Errorf("Skew = %v, %v, want -20s", skew, ok)
+	}
+
+	// a rejected timestamp carries its skew, which is recorded all the same
+	err := checkTimestamp(at(45 * time.Second))
+	var se *SkewError
+	if !errors.Is(err, ErrBadTimestamp) || !errors.As(err, &se) || se.Skew < 44*time.Second || se.Skew > 46*time.Second {
+		t.Fatalf("timestamp 45s ahead: %v", err)
+	}
+	if skew, _ := Skew(); skew != se.Skew {
+		t.Errorf("Skew = %v, want %v", skew, se.Skew)
+	}
+
+	SetMaxTimeDiff(time.Minute)
+	if err := checkTimestamp(at(45 * time.Second)); err != nil {
+		t.Errorf("timestamp 45s ahead with a tolerance of a minute: %v", err)
+	}
+}
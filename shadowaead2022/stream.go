@@ -0,0 +1,404 @@
+package shadowaead2022
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const (
+	headerTypeRequest  = 0
+	headerTypeResponse = 1
+
+	// maxPayloadSize is the maximum size of payload in bytes.
+	maxPayloadSize = 0xFFFF
+	// maxPaddingSize is the maximum size of padding in requests.
+	maxPaddingSize = 900
+)
+
+var (
+	errBadHeaderType = errors.New("bad header type")
+	errBadPadding    = errors.New("bad padding")
+	errRequestSalt   = errors.New("response to another request")
+)
+
+type writer struct {
+	io.Writer
+	cipher.AEAD
+	nonce []byte
+	buf   []byte
+}
+
+func newWriter(w io.Writer, aead cipher.AEAD) *writer {
+	return &writer{
+		Writer: w,
+		AEAD:   aead,
+		buf:    make([]byte, 2+aead.Overhead()+maxPayloadSize+aead.Overhead()),
+		nonce:  make([]byte, aead.NonceSize()),
+	}
+}
+
+// seal appends the sealed b to dst.
+func (w *writer) seal(dst, b []byte) []byte {
+	dst = w.Seal(dst, w.nonce, b, nil)
+	increment(w.nonce)
+	return dst
+}
+
+// Write encrypts b and writes to the embedded io.Writer.
+func (w *writer) Write(b []byte) (int, error) {
+	n, err := w.ReadFrom(bytes.NewBuffer(b))
+	return int(n), err
+}
+
+// ReadFrom reads from the given io.Reader until EOF or error, encrypts and
+// writes to the embedded io.Writer. Returns number of bytes read from r and
+// any error encountered.
+func (w *writer) ReadFrom(r io.Reader) (n int64, err error) {
+	for {
+		payloadBuf := w.buf[2+w.Overhead() : 2+w.Overhead()+maxPayloadSize]
+		nr, er := r.Read(payloadBuf)
+
+		if nr > 0 {
+			n += int64(nr)
+			var size [2]byte
+			binary.BigEndian.PutUint16(size[:], uint16(nr))
+			buf := w.seal(w.buf[:0], size[:])
+			buf = w.seal(buf, payloadBuf[:nr])
+
+			if _, ew := w.Writer.Write(buf); ew != nil {
+				err = ew
+				break
+			}
+		}
+
+		if er != nil {
+			if er != io.EOF { // ignore EOF as per io.ReaderFrom contract
+				err = er
+			}
+			break
+		}
+	}
+
+	return n, err
+}
+
+type reader struct {
+	io.Reader
+	cipher.AEAD
+	nonce    []byte
+	buf      []byte
+	leftover []byte
+}
+
+func newReader(r io.Reader, aead cipher.AEAD) *reader {
+	return &reader{
+		Reader: r,
+		AEAD:   aead,
+		buf:    make([]byte, maxPayloadSize+aead.Overhead()),
+		nonce:  make([]byte, aead.NonceSize()),
+	}
+}
+
+// open reads and decrypts a record of size bytes into the internal buffer.
+func (r *reader) open(size int) ([]byte, error) {
+	buf := r.buf[:size+r.Overhead()]
+	if _, err := io.ReadFull(r.Reader, buf); err != nil {
+		return nil, err
+	}
+	b, err := r.Open(buf[:0], r.nonce, buf, nil)
+	increment(r.nonce)
+	return b, err
+}
+
+// read reads and decrypts the next length and payload into the internal buffer.
+func (r *reader) read() (int, error) {
+	b, err := r.open(2)
+	if err != nil {
+		return 0, err
+	}
+	b, err = r.open(int(binary.BigEndian.Uint16(b)))
+	return len(b), err
+}
+
+// Read reads from the embedded io.Reader, decrypts and writes to b.
+func (r *reader) Read(b []byte) (int, error) {
+	// copy decrypted bytes (if any) from previous record first
+	if len(r.leftover) > 0 {
+		n := copy(b, r.leftover)
+		r.leftover = r.leftover[n:]
+		return n, nil
+	}
+
+	n, err := r.read()
+	m := copy(b, r.buf[:n])
+	if m < n { // insufficient len(b), keep leftover for next read
+		r.leftover = r.buf[m:n]
+	}
+	return m, err
+}
+
+// WriteTo reads from the embedded io.Reader, decrypts and writes to w until
+// there's no more data to write or when an error occurs. Return number of
+// bytes written to w and any error encountered.
+func (r *reader) WriteTo(w io.Writer) (n int64, err error) {
+	// write decrypted bytes left over from previous record
+	for len(r.leftover) > 0 {
+		nw, ew := w.Write(r.leftover)
+		r.leftover = r.leftover[nw:]
+		n += int64(nw)
+		if ew != nil {
+			return n, ew
+		}
+	}
+
+	for {
+		nr, er := r.read()
+		if nr > 0 {
+			nw, ew := w.Write(r.buf[:nr])
+			n += int64(nw)
+
+			if ew != nil {
+				err = ew
+				break
+			}
+		}
+
+		if er != nil {
+			if er != io.EOF { // ignore EOF as per io.Copy contract (using src.WriteTo shortcut)
+				err = er
+			}
+			break
+		}
+	}
+
+	return n, err
+}
+
+// increment little-endian encoded unsigned integer b. Wrap around on overflow.
+func increment(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
+
+// streamConn takes the role of the side that sends first: the client writes the request
+// before reading, the server reads the request before writing.
+type streamConn struct {
+	net.Conn
+	*Cipher
+	r           *reader
+	w           *writer
+	requestSalt []byte // sent by the client, echoed by the server in its response
+}
+
+func (c *streamConn) initReader() error {
+	salt := make([]byte, c.SaltSize())
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	aead, err := c.sessionAEAD(salt)
+	if err != nil {
+		return err
+	}
+	r := newReader(c.Conn, aead)
+
+	if c.w == nil { // server reading the request
+		hdr, err := r.open(1 + 8 + 2)
+		if err != nil {
+			return err
+		}
+		if hdr[0] != headerTypeRequest {
+			return errBadHeaderType
+		}
+		if err := checkTimestamp(hdr[1:9]); err != nil {
+			return err
+		}
+		if !salts.Add(salt) {
+			return shadowaead.ErrRepeatedSalt
+		}
+		b, err := r.open(int(binary.BigEndian.Uint16(hdr[9:])))
+		if err != nil {
+			return err
+		}
+		addr := socks.SplitAddr(b)
+		if addr == nil {
+			return socks.ErrAddressNotSupported
+		}
+		rest := b[len(addr):]
+		if len(rest) < 2 {
+			return errBadPadding
+		}
+		padding := int(binary.BigEndian.Uint16(rest))
+		if padding > maxPaddingSize || len(rest) < 2+padding {
+			return errBadPadding
+		}
+		payload := rest[2+padding:]
+		if padding == 0 && len(payload) == 0 {
+			return errBadPadding
+		}
+		// hand out the target address followed by the initial payload
+		n := copy(rest, payload)
+		r.leftover = b[:len(addr)+n]
+		c.requestSalt = salt
+	} else { // client reading the response
+		hdr, err := r.open(1 + 8 + len(c.requestSalt) + 2)
+		if err != nil {
+			return err
+		}
+		if hdr[0] != headerTypeResponse {
+			return errBadHeaderType
+		}
+		if err := checkTimestamp(hdr[1:9]); err != nil {
+			return err
+		}
+		if !bytes.Equal(hdr[9:9+len(c.requestSalt)], c.requestSalt) {
+			return errRequestSalt
+		}
+		if !salts.Add(salt) {
+			return shadowaead.ErrRepeatedSalt
+		}
+		if r.leftover, err = r.open(int(binary.BigEndian.Uint16(hdr[9+len(c.requestSalt):]))); err != nil {
+			return err
+		}
+	}
+
+	c.r = r
+	return nil
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	if c.r == nil {
+		if err := c.initReader(); err != nil {
+			return 0, err
+		}
+	}
+	return c.r.Read(b)
+}
+
+func (c *streamConn) WriteTo(w io.Writer) (int64, error) {
+	if c.r == nil {
+		if err := c.initReader(); err != nil {
+			return 0, err
+		}
+	}
+	return c.r.WriteTo(w)
+}
+
+// initWriter writes the salt and header, with as much of b as fits, and returns the rest of b.
+func (c *streamConn) initWriter(b []byte) ([]byte, error) {
+	salt := make([]byte, c.SaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.sessionAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	w := newWriter(c.Conn, aead)
+	buf := append([]byte{}, salt...)
+
+	if c.requestSalt == nil { // client writing the request, starting with the target address
+		addr := socks.SplitAddr(b)
+		if addr == nil {
+			return nil, socks.ErrAddressNotSupported
+		}
+		b = b[len(addr):]
+		padding := 0
+		if len(b) == 0 {
+			n, err := rand.Int(rand.Reader, big.NewInt(maxPaddingSize))
+			if err != nil {
+				return nil, err
+			}
+			padding = 1 + int(n.Int64())
+		}
+		hdr := make([]byte, len(addr)+2+padding, maxPayloadSize)
+		copy(hdr, addr)
+		binary.BigEndian.PutUint16(hdr[len(addr):], uint16(padding))
+		n := len(b)
+		if n > cap(hdr)-len(hdr) {
+			n = cap(hdr) - len(hdr)
+		}
+		hdr = append(hdr, b[:n]...)
+		b = b[n:]
+
+		fixed := append([]byte{headerTypeRequest}, timestamp()...)
+		fixed = append(fixed, byte(len(hdr)>>8), byte(len(hdr)))
+		buf = w.seal(buf, fixed)
+		buf = w.seal(buf, hdr)
+		c.requestSalt = salt
+	} else { // server writing the response
+		n := len(b)
+		if n > maxPayloadSize {
+			n = maxPayloadSize
+		}
+		fixed := append([]byte{headerTypeResponse}, timestamp()...)
+		fixed = append(fixed, c.requestSalt...)
+		fixed = append(fixed, byte(n>>8), byte(n))
+		buf = w.seal(buf, fixed)
+		buf = w.seal(buf, b[:n])
+		b = b[n:]
+	}
+
+	if _, err := c.Conn.Write(buf); err != nil {
+		return nil, err
+	}
+	salts.Add(salt)
+	c.w = w
+	return b, nil
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	if c.w == nil {
+		rest, err := c.initWriter(b)
+		if err != nil {
+			return 0, err
+		}
+		if len(rest) == 0 {
+			return len(b), nil
+		}
+		n, err := c.w.Write(rest)
+		return len(b) - len(rest) + n, err
+	}
+	return c.w.Write(b)
+}
+
+func (c *streamConn) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	if c.w == nil {
+		// the header goes out with the first payload
+		buf := make([]byte, maxPayloadSize)
+		for c.w == nil {
+			nr, er := r.Read(buf)
+			if nr > 0 {
+				nw, ew := c.Write(buf[:nr])
+				n += int64(nw)
+				if ew != nil {
+					return n, ew
+				}
+			}
+			if er != nil {
+				if er == io.EOF {
+					er = nil
+				}
+				return n, er
+			}
+		}
+	}
+	m, err := c.w.ReadFrom(r)
+	return n + m, err
+}
+
+// NewConn wraps a stream-oriented net.Conn with cipher.
+func NewConn(c net.Conn, ciph *Cipher) net.Conn { return &streamConn{Conn: c, Cipher: ciph} }
@@ -0,0 +1,8 @@
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import "os"
+
+// There are no signals to trigger upgrade or toggle verbose logging on this platform.
+var upgradeSignal, verboseSignal os.Signal
@@ -0,0 +1,13 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	upgradeSignal os.Signal = syscall.SIGUSR2 // triggers upgrade
+	verboseSignal os.Signal = syscall.SIGUSR1 // toggles verbose logging
+)
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// control runs f on the file descriptor of the TCP connection c, or of the connection
+// underlying c if it is a transport connection such as WebSocket.
+func control(c net.Conn, f func(fd int) error) error {
+	for {
+		u, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		c = u.NetConn()
+	}
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return errors.New("not a TCP connection")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := rc.Control(func(fd uintptr) { ferr = f(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// setCongestion sets the TCP congestion control algorithm of c, e.g. "bbr" or "cubic".
+// The algorithm must be available in the kernel, see /proc/sys/net/ipv4/tcp_available_congestion_control.
+func setCongestion(c net.Conn, algo string) error {
+	return control(c, func(fd int) error {
+		return syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, algo)
+	})
+}
+
+// setKeepAlive enables TCP keepalive on c, probing after idle without traffic every interval
+// and giving up after count unanswered probes. Zero values leave the system defaults.
+func setKeepAlive(c net.Conn, idle, interval time.Duration, count int) error {
+	return control(c, func(fd int) error {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+			return err
+		}
+		if idle > 0 {
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, int(idle/time.Second)); err != nil {
+				return err
+			}
+		}
+		if interval > 0 {
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, int(interval/time.Second)); err != nil {
+				return err
+			}
+		}
+		if count > 0 {
+			return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+		}
+		return nil
+	})
+}
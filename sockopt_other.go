@@ -0,0 +1,17 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+func setCongestion(c net.Conn, algo string) error {
+	return errors.New("TCP congestion control selection is only supported on Linux")
+}
+
+func setKeepAlive(c net.Conn, idle, interval time.Duration, count int) error {
+	return errors.New("TCP keepalive tuning is only supported on Linux")
+}
@@ -17,6 +17,12 @@ const (
 	CmdUDPAssociate = 3
 )
 
+// SOCKS request commands of the Tor extensions to look up names and addresses.
+const (
+	CmdResolve    = 0xF0
+	CmdResolvePTR = 0xF1
+)
+
 // SOCKS address types as defined in RFC 1928 section 5.
 const (
 	AtypIPv4       = 1
@@ -42,6 +48,8 @@ const (
 	ErrCommandNotSupported  = Error(7)
 	ErrAddressNotSupported  = Error(8)
 	InfoUDPAssociate        = Error(9)
+	InfoResolve             = Error(10)
+	InfoResolvePTR          = Error(11)
 )
 
 // MaxAddrLen is the maximum size of SOCKS address in bytes.
@@ -206,9 +214,19 @@ func Handshake(rw io.ReadWriter) (Addr, error) {
 			return nil, ErrCommandNotSupported
 		}
 		err = InfoUDPAssociate
+	case CmdResolve:
+		err = InfoResolve // the caller replies with WriteReply
+	case CmdResolvePTR:
+		err = InfoResolvePTR // the caller replies with WriteReply
 	default:
 		return nil, ErrCommandNotSupported
 	}
 
 	return addr, err // skip VER, CMD, RSV fields
 }
+
+// WriteReply writes a reply with status rep, 0 for success or an Error, and the bound address bnd.
+func WriteReply(w io.Writer, rep byte, bnd Addr) error {
+	_, err := w.Write(append([]byte{5, rep, 0}, bnd...))
+	return err
+}
@@ -0,0 +1,73 @@
+// +build !router
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// socksTLS is the TLS config of -socks set with -socks-cert, if any.
+var socksTLS *tls.Config
+
+// loadSocksTLS sets socksTLS to serve the certificate in certFile and keyFile, requiring
+// client certificates issued by a CA in caFile if not empty.
+func loadSocksTLS(certFile, keyFile, caFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", caFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	socksTLS = cfg
+	return nil
+}
+
+// withSocksTLS returns l serving TLS with socksTLS and true, or l and false without it.
+func withSocksTLS(l net.Listener) (net.Listener, bool) {
+	if socksTLS == nil {
+		return l, false
+	}
+	return tls.NewListener(l, socksTLS), true
+}
+
+// Create a SOCKS server for WebSocket clients, such as browser extensions, listening on addr
+// and proxy to server. Each WebSocket connection carries one SOCKS connection. Requests with
+// an Origin header are only accepted from the given origins, so that web pages cannot use it.
+func socksWSLocal(addr, server string, origins []string, shadow func(net.Conn) net.Conn) {
+	l, err := listenWebSocket(addr, nil, func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, o := range origins {
+			if o == "*" || strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		logf("rejected SOCKS over WebSocket from origin %q", origin)
+		return false
+	})
+	if err != nil {
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
+	logf("SOCKS over WebSocket %s <-> %s", addr, server)
+	tcpLocal(socksInbound{l}, server, shadow)
+}
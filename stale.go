@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const (
+	staleMax    = 4096             // names remembered at most
+	staleReport = 10 * time.Minute // how often the use of stale addresses is logged
+)
+
+// staleDNS remembers the IP each name last connected to, and connects to it if resolving
+// the name fails within maxAge of that, keeping connections working during outages of the
+// resolver of the server.
+type staleDNS struct {
+	maxAge time.Duration
+
+	sync.Mutex
+	m    map[string]staleEntry
+	used int // connections to stale addresses since the last report
+}
+
+type staleEntry struct {
+	ip   net.IP
+	seen time.Time
+}
+
+// stale is nil unless enabled on servers with -stale-dns.
+var stale *staleDNS
+
+func newStaleDNS(maxAge time.Duration) *staleDNS {
+	s := &staleDNS{maxAge: maxAge, m: make(map[string]staleEntry)}
+	go s.report()
+	return s
+}
+
+// Dial connects to tgt, falling back to the last IP of its name if resolving it fails.
+func (s *staleDNS) Dial(id string, tgt socks.Addr) (net.Conn, error) {
+	c, err := net.Dial("tcp", tgt.String())
+	if tgt[0] != socks.AtypDomainName {
+		return c, err
+	}
+	host, port, _ := net.SplitHostPort(tgt.String())
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if err == nil {
+		if ip, _ := ipPort(c.RemoteAddr()); ip != nil {
+			s.put(host, ip)
+		}
+		return c, nil
+	}
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		return nil, err
+	}
+	ip, age := s.get(host)
+	if ip == nil {
+		return nil, err
+	}
+	logf("[%s] failed to resolve %s, connecting to its address %s of %v ago: %v", id, host, ip, age.Round(time.Second), err)
+	c, err = net.Dial("tcp", net.JoinHostPort(ip.String(), port))
+	if err == nil {
+		s.Lock()
+		s.used++
+		s.Unlock()
+	}
+	return c, err
+}
+
+func (s *staleDNS) put(host string, ip net.IP) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.m[host]; !ok && len(s.m) >= staleMax {
+		now := time.Now()
+		for k, e := range s.m {
+			if now.Sub(e.seen) > s.maxAge {
+				delete(s.m, k)
+			}
+		}
+		if len(s.m) >= staleMax {
+			return
+		}
+	}
+	s.m[host] = staleEntry{ip, time.Now()}
+}
+
+// get returns the last IP of host and its age, or nil if none within maxAge.
+func (s *staleDNS) get(host string) (net.IP, time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.m[host]
+	age := time.Since(e.seen)
+	if !ok || age > s.maxAge {
+		return nil, 0
+	}
+	return e.ip, age
+}
+
+func (s *staleDNS) report() {
+	for range time.Tick(staleReport) {
+		s.Lock()
+		used := s.used
+		s.used = 0
+		s.Unlock()
+		if used > 0 {
+			logger.Printf("connected to stale addresses %d times in the last %v as resolving failed", used, staleReport)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/mux"
+	"github.com/shadowsocks/go-shadowsocks2/internal/relay"
+)
+
+const (
+	steerTTL      = 5 * time.Minute // how long clients honor a steering hint
+	steerInterval = time.Minute     // how often servers check their load for mux sessions
+)
+
+// A steering hint is a control message of mux sessions by which an overloaded server asks
+// clients to prefer a sibling server of its cluster for a while:
+//
+//	[expiry, uint64 Unix seconds][sibling address][Ed25519 signature of the preceding bytes]
+//
+// Clients honor hints signed with the key of the cluster only, so that a server cannot be
+// made to steer clients anywhere else by whoever is on the path.
+
+var errSteerHint = errors.New("invalid steering hint")
+
+// steerAdvisor sends steering hints to sibling on the mux sessions of clients while
+// more than load flows are relayed.
+type steerAdvisor struct {
+	key     ed25519.PrivateKey
+	sibling string
+	load    int64
+}
+
+// advisor is set on servers with -steer-sibling.
+var advisor *steerAdvisor
+
+// steer is set on clients with -steer-key.
+var steer *steering
+
+// newSteerAdvisor returns a steerAdvisor signing with the base64url-encoded Ed25519 seed
+// in the environment variable SHADOWSOCKS_STEER_SEED.
+func newSteerAdvisor(sibling string, load int) (*steerAdvisor, error) {
+	seed, err := base64.URLEncoding.DecodeString(os.Getenv("SHADOWSOCKS_STEER_SEED"))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("-steer-sibling requires SHADOWSOCKS_STEER_SEED, a base64url-encoded 32-byte seed, e.g. from -keygen 32")
+	}
+	if _, _, err := net.SplitHostPort(sibling); err != nil {
+		return nil, err
+	}
+	a := &steerAdvisor{key: ed25519.NewKeyFromSeed(seed), sibling: sibling, load: int64(load)}
+	logger.Printf("public key for -steer-key: %s", base64.StdEncoding.EncodeToString(a.key.Public().(ed25519.PublicKey)))
+	return a, nil
+}
+
+// Advise sends a hint on s whenever the server is overloaded until s is closed.
+func (a *steerAdvisor) Advise(id string, s *mux.Session) {
+	for {
+		if relay.Active() > a.load {
+			if err := s.WriteControl(a.hint()); err != nil {
+				return
+			}
+			logf("[%s] overloaded, steering client to %s", id, a.sibling)
+		}
+		select {
+		case <-time.After(steerInterval):
+		case <-s.Done():
+			return
+		}
+	}
+}
+
+func (a *steerAdvisor) hint() []byte {
+	b := make([]byte, 8, 8+len(a.sibling)+ed25519.SignatureSize)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Add(steerTTL).Unix()))
+	b = append(b, a.sibling...)
+	return append(b, ed25519.Sign(a.key, b)...)
+}
+
+// steering holds the sibling server clients were last steered to by a hint signed with key.
+type steering struct {
+	key ed25519.PublicKey
+
+	sync.Mutex
+	sibling string
+	expires time.Time
+}
+
+func newSteering(key string) (*steering, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(k) != ed25519.PublicKeySize {
+		return nil, errors.New("-steer-key must be a base64-encoded Ed25519 public key")
+	}
+	return &steering{key: k}, nil
+}
+
+// Hint verifies and honors the steering hint b.
+func (s *steering) Hint(b []byte) {
+	if err := s.hint(b); err != nil {
+		logf("ignoring steering hint: %v", err)
+	}
+}
+
+func (s *steering) hint(b []byte) error {
+	if len(b) < 8+ed25519.SignatureSize {
+		return errSteerHint
+	}
+	msg, sig := b[:len(b)-ed25519.SignatureSize], b[len(b)-ed25519.SignatureSize:]
+	if !ed25519.Verify(s.key, msg, sig) {
+		return errSteerHint
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(msg)), 0)
+	if time.Until(expires) > steerTTL {
+		expires = time.Now().Add(steerTTL)
+	}
+	sibling := string(msg[8:])
+	s.Lock()
+	defer s.Unlock()
+	if sibling != s.sibling || time.Now().After(s.expires) {
+		logger.Printf("server overloaded, preferring %s until %s", sibling, expires.Format(time.Kitchen))
+	}
+	s.sibling, s.expires = sibling, expires
+	return nil
+}
+
+// Sibling returns the server to prefer, or "" if no hint is in effect.
+func (s *steering) Sibling() string {
+	s.Lock()
+	defer s.Unlock()
+	if time.Now().After(s.expires) {
+		return ""
+	}
+	return s.sibling
+}
+
+// steerTransport dials the sibling the client was last steered to, if any, before the
+// given address.
+type steerTransport struct {
+	transport
+	s *steering
+}
+
+func (t steerTransport) Dial(addr string) (net.Conn, error) {
+	if sibling := t.s.Sibling(); sibling != "" && sibling != addr {
+		c, err := t.transport.Dial(sibling)
+		if err == nil {
+			return c, nil
+		}
+		logf("failed to connect to steered server %s: %v", sibling, err)
+	}
+	return t.transport.Dial(addr)
+}
@@ -6,17 +6,27 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
-	"os"
 	"sync"
 	"time"
 
+	"github.com/shadowsocks/go-shadowsocks2/internal/relay"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
 // Create a SOCKS server listening on addr and proxy to server.
 func socksLocal(addr, server string, shadow func(net.Conn) net.Conn) {
-	logf("SOCKS proxy %s <-> %s", addr, server)
-	tcpLocal(addr, server, shadow, func(c net.Conn) (socks.Addr, error) { return socks.Handshake(c) })
+	l, err := listen("tcp", addr)
+	if err != nil {
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
+	var secure bool
+	if l, secure = withSocksTLS(l); secure {
+		logf("SOCKS over TLS %s <-> %s", addr, server)
+	} else {
+		logf("SOCKS proxy %s <-> %s", addr, server)
+	}
+	tcpLocal(socksInbound{l}, server, shadow)
 }
 
 // Create a TCP tunnel from addr to target via server.
@@ -26,28 +36,37 @@ func tcpTun(addr, server, target string, shadow func(net.Conn) net.Conn) {
 		logf("invalid target address %q", target)
 		return
 	}
-	logf("TCP tunnel %s <-> %s <-> %s", addr, server, target)
-	tcpLocal(addr, server, shadow, func(net.Conn) (socks.Addr, error) { return tgt, nil })
-}
-
-// Listen on addr and proxy to server to reach target from getAddr.
-func tcpLocal(addr, server string, shadow func(net.Conn) net.Conn, getAddr func(net.Conn) (socks.Addr, error)) {
-	l, err := net.Listen("tcp", addr)
+	l, err := listen("tcp", addr)
 	if err != nil {
 		logf("failed to listen on %s: %v", addr, err)
 		return
 	}
+	logf("TCP tunnel %s <-> %s <-> %s", addr, server, target)
+	tcpLocal(tunInbound{l, tgt}, server, shadow)
+}
 
+// Accept connections from in and proxy them to server to reach their targets.
+func tcpLocal(in inbound, server string, shadow func(net.Conn) net.Conn) {
+	limit := newConnLimit()
 	for {
-		c, err := l.Accept()
+		c, err := in.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return // handed over on upgrade
+			}
 			logf("failed to accept: %s", err)
 			continue
 		}
 
 		go func() {
 			defer c.Close()
-			tgt, err := getAddr(c)
+			id := newSessionID()
+			if !limit.Acquire() {
+				logf("[%s] too many connections, closing %v", id, c.RemoteAddr())
+				return
+			}
+			defer limit.Release()
+			tgt, err := in.Handshake(c)
 			if err != nil {
 
 				// UDP: keep the connection until disconnect then free the UDP socket
@@ -59,110 +78,251 @@ func tcpLocal(addr, server string, shadow func(net.Conn) net.Conn, getAddr func(
 						if err, ok := err.(net.Error); ok && err.Timeout() {
 							continue
 						}
-						logf("UDP Associate End.")
+						logf("[%s] UDP Associate End.", id)
 						return
 					}
 				}
 
-				logf("failed to get target address: %v", err)
+				if err == socks.InfoResolve || err == socks.InfoResolvePTR {
+					socksResolve(c, id, tgt, err == socks.InfoResolvePTR)
+					return
+				}
+
+				logf("[%s] failed to get target address: %v", id, err)
 				return
 			}
+			if blocked(tgt) {
+				logf("[%s] blocked %s", id, tgt)
+				return
+			}
+			tgt, _ = lookupHosts(tgt)
 
-			rc, err := net.Dial("tcp", server)
+			start := time.Now()
+			rc, err := dialTarget(server, shadow, tgt)
 			if err != nil {
-				logf("failed to connect to server %v: %v", server, err)
+				logf("[%s] failed to connect to %s via server %v: %v", id, tgt, server, err)
 				return
 			}
 			defer rc.Close()
-			if config.TCPCork {
-				rc = timedCork(rc, 10*time.Millisecond, 1280)
+			if mirrors != nil {
+				c, rc = mirrors.Wrap(c, rc, start, id, tgt)
 			}
-			rc = shadow(rc)
 
-			if _, err = rc.Write(tgt); err != nil {
-				logf("failed to send target address: %v", err)
-				return
-			}
-
-			logf("proxy %s <-> %s <-> %s", c.RemoteAddr(), server, tgt)
-			if err = relay(rc, c); err != nil {
-				logf("relay error: %v", err)
+			logf("[%s] proxy %s <-> %s <-> %s", id, c.RemoteAddr(), server, tgt)
+			if err = relay.TCP(c, rc, relay.NewFlow(id, "tcp", c.RemoteAddr(), tgt.String())); err != nil {
+				logf("[%s] relay error: %v", id, err)
 			}
 		}()
 	}
 }
 
+// A dialer connects to targets through the server in another way than dialTarget does.
+type dialer interface {
+	// Dial returns a connection to tgt through the server.
+	Dial(tgt socks.Addr) (net.Conn, error)
+}
+
+// outbound is set on clients to the dialer used by dialTarget instead of dialing per target
+// with shadowsocks: a muxPool with -mux, or a trojanDialer for a Trojan server.
+var outbound dialer
+
+// dialTarget connects to server and sends it the target address tgt to connect to,
+// returning the shadowed connection to relay through.
+func dialTarget(server string, shadow func(net.Conn) net.Conn, tgt socks.Addr) (net.Conn, error) {
+	if warm != nil {
+		if c := warm.Take(tgt); c != nil {
+			return c, nil
+		}
+	}
+	if outbound != nil {
+		return outbound.Dial(tgt)
+	}
+	var rc net.Conn
+	var err error
+	if preconnect != nil {
+		rc, err = preconnect.Get()
+	} else {
+		rc, err = link.Dial(server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	setCongestionFor(rc, tgt)
+	setLinkKeepAlive(rc)
+	if config.TCPCork {
+		rc = timedCork(rc, 10*time.Millisecond, 1280)
+	}
+	rc = shadow(rc)
+
+	if _, err = rc.Write(tgt); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// discard drains c until the client closes it, as servers do after a failed handshake.
+func discard(id string, c net.Conn) {
+	// drain c to avoid leaking server behavioral features
+	// see https://www.ndss-symposium.org/ndss-paper/detecting-probe-resistant-proxies/
+	if _, err := io.Copy(ioutil.Discard, c); err != nil {
+		logf("[%s] discard error: %v", id, err)
+	}
+}
+
 // Listen on addr for incoming connections.
 func tcpRemote(addr string, shadow func(net.Conn) net.Conn) {
-	l, err := net.Listen("tcp", addr)
+	l, err := link.Listen(addr)
 	if err != nil {
 		logf("failed to listen on %s: %v", addr, err)
 		return
 	}
 
 	logf("listening TCP on %s", addr)
+	limit := newConnLimit()
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return // handed over on upgrade
+			}
 			logf("failed to accept: %v", err)
 			continue
 		}
 
 		go func() {
 			defer c.Close()
+			id := newSessionID()
+			if !limit.Acquire() {
+				logf("[%s] too many connections, closing %v", id, c.RemoteAddr())
+				return
+			}
+			defer limit.Release()
+			if ip, _ := ipPort(c.RemoteAddr()); bans != nil && ip != nil && bans.Banned(ip) {
+				// drained like failed handshakes, so that probers cannot tell they are banned
+				discard(id, c)
+				return
+			}
+			raw := c // for socket options
+			setLinkKeepAlive(raw)
 			if config.TCPCork {
 				c = timedCork(c, 10*time.Millisecond, 1280)
 			}
-			sc := shadow(c)
+			hc := &headConn{Conn: c}
+			sc := shadow(hc)
 
 			tgt, err := socks.ReadAddr(sc)
 			if err != nil {
-				logf("failed to get target address from %v: %v", c.RemoteAddr(), err)
-				// drain c to avoid leaking server behavioral features
-				// see https://www.ndss-symposium.org/ndss-paper/detecting-probe-resistant-proxies/
-				_, err = io.Copy(ioutil.Discard, c)
-				if err != nil {
-					logf("discard error: %v", err)
+				class := classifyFailure(err, hc.head)
+				if (class == failWrongKey || class == failTruncated) && config.LegacyPassword != "" {
+					if name, ota := detectLegacy(c, hc.head); name != "" {
+						if ota {
+							name += " with one-time auth"
+						}
+						logf("[%s] client %v uses the legacy stream cipher %s, which is not supported; upgrade or reconfigure it to use %s",
+							id, c.RemoteAddr(), name, config.Cipher)
+						if ip, _ := ipPort(c.RemoteAddr()); ip != nil {
+							recordFailure(ip, failLegacy)
+						}
+						return // close right away instead of draining, as only clients knowing the password get here
+					}
 				}
+				logf("[%s] failed to get target address from %v (%s): %v", id, c.RemoteAddr(), class, err)
+				if ip, _ := ipPort(c.RemoteAddr()); ip != nil && class != failEmpty {
+					recordFailure(ip, class)
+					if bans != nil {
+						bans.Fail(ip, class == failReplay)
+					}
+				}
+				discard(id, c)
 				return
 			}
-
-			rc, err := net.Dial("tcp", tgt.String())
-			if err != nil {
-				logf("failed to connect to target: %v", err)
+			if isPQ(tgt) != config.PQ {
+				logf("[%s] client %v and server disagree on -pq", id, c.RemoteAddr())
 				return
 			}
-			defer rc.Close()
-
-			logf("proxy %s <-> %s", c.RemoteAddr(), tgt)
-			if err = relay(sc, rc); err != nil {
-				logf("relay error: %v", err)
+			if config.PQ {
+				if sc, tgt, err = pqServer(sc); err != nil {
+					logf("[%s] failed the -pq key exchange with %v: %v", id, c.RemoteAddr(), err)
+					return
+				}
+			}
+			if isMux(tgt) {
+				serveMux(id, sc, c.RemoteAddr())
+				return
+			}
+			if isReverse(tgt) {
+				if len(reversePorts) > 0 {
+					serveReverse(id, sc, c.RemoteAddr())
+				}
+				return
 			}
+			tgt, _ = lookupHosts(tgt)
+			setCongestionFor(raw, tgt)
+			relayTarget(id, sc, c.RemoteAddr(), tgt)
 		}()
 	}
 }
 
-// relay copies between left and right bidirectionally
-func relay(left, right net.Conn) error {
-	var err, err1 error
-	var wg sync.WaitGroup
-	var wait = 5 * time.Second
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		_, err1 = io.Copy(right, left)
-		right.SetReadDeadline(time.Now().Add(wait)) // unblock read on right
-	}()
-	_, err = io.Copy(left, right)
-	left.SetReadDeadline(time.Now().Add(wait)) // unblock read on left
-	wg.Wait()
-	if err1 != nil && !errors.Is(err1, os.ErrDeadlineExceeded) { // requires Go 1.15+
-		return err1
-	}
-	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
-		return err
-	}
-	return nil
+// relayTarget connects to tgt for the client at from and relays between it and c.
+func relayTarget(id string, c net.Conn, from net.Addr, tgt socks.Addr) {
+	if isUoT(tgt) {
+		serveUoT(id, c, from)
+		return
+	}
+	if blocked(tgt) {
+		logf("[%s] blocked %s", id, tgt)
+		return
+	}
+	var rc net.Conn
+	var err error
+	if stale != nil {
+		rc, err = stale.Dial(id, tgt)
+	} else {
+		rc, err = net.Dial("tcp", tgt.String())
+	}
+	if err != nil {
+		logf("[%s] failed to connect to target: %v", id, err)
+		return
+	}
+	defer rc.Close()
+
+	logf("[%s] proxy %s <-> %s", id, from, tgt)
+	if err = relay.TCP(c, rc, relay.NewFlow(id, "tcp", from, tgt.String())); err != nil {
+		logf("[%s] relay error: %v", id, err)
+	}
+}
+
+// interactivePorts are the target ports of connections using -tcp-congestion-interactive:
+// SSH, Telnet, RDP and VNC, whose latency matters more than their throughput.
+var interactivePorts = map[string]bool{"22": true, "23": true, "3389": true, "5900": true}
+
+// setCongestionFor sets the congestion control algorithm of c, a connection between client
+// and server, according to -tcp-congestion and the class of its target tgt.
+func setCongestionFor(c net.Conn, tgt socks.Addr) {
+	algo := config.Congestion
+	if config.CongestionInteractive != "" {
+		if _, port, err := net.SplitHostPort(tgt.String()); err == nil && interactivePorts[port] {
+			algo = config.CongestionInteractive
+		}
+	}
+	if algo == "" {
+		return
+	}
+	if err := setCongestion(c, algo); err != nil {
+		logf("failed to set TCP congestion control %s: %v", algo, err)
+	}
+}
+
+// setLinkKeepAlive applies -keepalive-idle, -keepalive-interval and -keepalive-count to c,
+// a connection between client and server, so that a dead peer is noticed quickly.
+func setLinkKeepAlive(c net.Conn) {
+	if config.KeepAliveIdle == 0 && config.KeepAliveInterval == 0 && config.KeepAliveCount == 0 {
+		return
+	}
+	if err := setKeepAlive(c, config.KeepAliveIdle, config.KeepAliveInterval, config.KeepAliveCount); err != nil {
+		logf("failed to set TCP keepalive: %v", err)
+	}
 }
 
 type corkedConn struct {
@@ -0,0 +1,33 @@
+// +build freebsd openbsd
+
+package main
+
+import (
+	"net"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// divertInbound accepts TCP connections forwarded by ipfw fwd (FreeBSD) or pf divert-to
+// (OpenBSD). Both keep the original destination as the local address of the connection.
+type divertInbound struct{ net.Listener }
+
+func (divertInbound) Handshake(c net.Conn) (socks.Addr, error) {
+	return socks.ParseAddr(c.LocalAddr().String()), nil
+}
+
+// Listen on addr for TCP connections forwarded by ipfw or pf.
+func redirLocal(addr, server string, shadow func(net.Conn) net.Conn) {
+	l, err := listen("tcp", addr)
+	if err != nil {
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
+	logf("TCP redirect %s <-> %s", addr, server)
+	tcpLocal(divertInbound{l}, server, shadow)
+}
+
+// Listen on addr for TCP IPv6 connections forwarded by ipfw or pf.
+func redir6Local(addr, server string, shadow func(net.Conn) net.Conn) {
+	redirLocal(addr, server, shadow)
+}
@@ -7,8 +7,36 @@ import (
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
+// pfInbound accepts TCP connections redirected by Packet Filter.
+type pfInbound struct{ net.Listener }
+
+func (pfInbound) Handshake(c net.Conn) (socks.Addr, error) { return natLookup(c) }
+
+// Listen on addr for TCP connections redirected by Packet Filter, installing the
+// redirect rules for -pf-iface if given.
 func redirLocal(addr, server string, shadow func(net.Conn) net.Conn) {
-	tcpLocal(addr, server, shadow, natLookup)
+	l, err := listen("tcp", addr)
+	if err != nil {
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
+	if config.PFIface != "" {
+		a := l.Addr().(*net.TCPAddr)
+		token, err := pfutil.InstallRdr(config.PFIface, a.IP, a.Port)
+		if err != nil {
+			logf("failed to install pf rules: %v", err)
+			l.Close()
+			return
+		}
+		atExit(func() {
+			if err := pfutil.UninstallRdr(token); err != nil {
+				logf("failed to uninstall pf rules: %v", err)
+			}
+		})
+		logf("pf redirect TCP on %s -> %s", config.PFIface, l.Addr())
+	}
+	logf("TCP redirect %s <-> %s", addr, server)
+	tcpLocal(pfInbound{l}, server, shadow)
 }
 
 func redir6Local(addr, server string, shadow func(net.Conn) net.Conn) {
@@ -15,14 +15,32 @@ func getOrigDst(c net.Conn, ipv6 bool) (socks.Addr, error) {
 	panic("not a TCP connection")
 }
 
+// redirInbound accepts TCP connections redirected by netfilter.
+type redirInbound struct {
+	net.Listener
+	ipv6 bool
+}
+
+func (in redirInbound) Handshake(c net.Conn) (socks.Addr, error) { return getOrigDst(c, in.ipv6) }
+
 // Listen on addr for netfilter redirected TCP connections
 func redirLocal(addr, server string, shadow func(net.Conn) net.Conn) {
+	l, err := listen("tcp", addr)
+	if err != nil {
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
 	logf("TCP redirect %s <-> %s", addr, server)
-	tcpLocal(addr, server, shadow, func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, false) })
+	tcpLocal(redirInbound{l, false}, server, shadow)
 }
 
 // Listen on addr for netfilter redirected TCP IPv6 connections.
 func redir6Local(addr, server string, shadow func(net.Conn) net.Conn) {
+	l, err := listen("tcp", addr)
+	if err != nil {
+		logf("failed to listen on %s: %v", addr, err)
+		return
+	}
 	logf("TCP6 redirect %s <-> %s", addr, server)
-	tcpLocal(addr, server, shadow, func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, true) })
+	tcpLocal(redirInbound{l, true}, server, shadow)
 }
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"sync"
+	"syscall"
+)
+
+var tfoFailed struct{ listen, dial sync.Once }
+
+// tfoControl returns a Control function for net.ListenConfig or net.Dialer that enables
+// TCP Fast Open with set. If the kernel rejects it, the socket is used without, and the
+// first failure is logged once.
+func tfoControl(set func(fd int) error, once *sync.Once) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		c.Control(func(fd uintptr) { err = set(int(fd)) })
+		if err != nil {
+			once.Do(func() { logger.Printf("TCP Fast Open not enabled: %v", err) })
+		}
+		return nil
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const tcpFastOpen = 0x105 // TCP_FASTOPEN
+
+func setListenTFO(fd int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpen, 1)
+}
+
+// setDialTFO is not supported, as macOS only sends data in the SYN with connectx.
+func setDialTFO(fd int) error {
+	return errors.New("TCP Fast Open is only supported on listeners on macOS")
+}
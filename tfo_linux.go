@@ -0,0 +1,20 @@
+package main
+
+import "syscall"
+
+const (
+	tcpFastOpen        = 23 // TCP_FASTOPEN
+	tcpFastOpenConnect = 30 // TCP_FASTOPEN_CONNECT, Linux 4.11+
+)
+
+// tfoQueue is the maximum number of pending TCP Fast Open requests of a listener.
+const tfoQueue = 256
+
+func setListenTFO(fd int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpen, tfoQueue)
+}
+
+// setDialTFO makes connect on fd return at once and send the SYN with the first write.
+func setDialTFO(fd int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+}
@@ -0,0 +1,13 @@
+// +build !linux,!darwin
+
+package main
+
+import "errors"
+
+func setListenTFO(fd int) error {
+	return errors.New("TCP Fast Open is only supported on Linux and macOS")
+}
+
+func setDialTFO(fd int) error {
+	return errors.New("TCP Fast Open is only supported on Linux and macOS")
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/dnstt"
+	"github.com/shadowsocks/go-shadowsocks2/internal/icmptun"
+	"github.com/shadowsocks/go-shadowsocks2/internal/padding"
+)
+
+// A transport carries the encrypted stream between client and server.
+type transport interface {
+	// Dial connects to the server at addr.
+	Dial(addr string) (net.Conn, error)
+	// Listen listens for client connections on addr.
+	Listen(addr string) (net.Listener, error)
+}
+
+// link is the transport selected with -transport.
+var link transport = tcpTransport{}
+
+// parseTransport returns the transport described by s: "tcp", "ws://host/path",
+// "wss://host/path", "grpc://host/service", "shadowtls://password@host:port",
+// "dnstt://domain?resolver=host:port" or "icmp".
+func parseTransport(s string) (transport, error) {
+	switch s {
+	case "", "tcp":
+		return tcpTransport{}, nil
+	case "icmp":
+		return icmpTransport{}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "dnstt":
+		if u.Host == "" {
+			return nil, fmt.Errorf("transport %q lacks a domain", s)
+		}
+		return &dnsttTransport{domain: u.Host, resolver: u.Query().Get("resolver")}, nil
+	}
+	return parseWebTransport(u)
+}
+
+// tcpTransport carries the stream in plain TCP connections.
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error)       { return dialServer(addr) }
+func (tcpTransport) Listen(addr string) (net.Listener, error) { return listen("tcp", addr) }
+
+// dnsttTransport carries the stream in DNS queries for names under domain and their
+// responses, through resolver if set or directly to the server, which must be the
+// authoritative name server of domain. It is slow, and meant for networks letting nothing
+// else through.
+type dnsttTransport struct {
+	domain   string
+	resolver string
+}
+
+func (t *dnsttTransport) Dial(addr string) (net.Conn, error) {
+	if t.resolver != "" {
+		addr = t.resolver
+	}
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return dnstt.Dial(c, t.domain), nil
+}
+
+func (t *dnsttTransport) Listen(addr string) (net.Listener, error) {
+	pc, err := listenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return dnstt.Listen(pc, t.domain), nil
+}
+
+// icmpTransport carries the stream in ICMP echo requests and replies, for networks letting
+// nothing but ping through. Both ends need raw sockets, i.e. root or CAP_NET_RAW on Linux.
+// The port of addresses is ignored.
+type icmpTransport struct{}
+
+func (icmpTransport) Dial(addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	raddr, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	return icmptun.Dial(pc, raddr), nil
+}
+
+func (icmpTransport) Listen(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	pc, err := listenPacket("ip4:icmp", host)
+	if err != nil {
+		return nil, err
+	}
+	return icmptun.Listen(pc), nil
+}
+
+// parsePadding returns t wrapped in the padding layer with frames of the comma-separated
+// sizes s, and frames without data after idle without writes if not 0.
+func parsePadding(t transport, s string, idle time.Duration) (transport, error) {
+	config := &padding.Config{Idle: idle}
+	for _, size := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return nil, fmt.Errorf("invalid padding size %q", size)
+		}
+		config.Sizes = append(config.Sizes, n)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &paddingTransport{transport: t, config: config}, nil
+}
+
+// paddingTransport pads the connections of a transport to hide the sizes and timing of
+// writes. The padding is below the cipher, so both ends need the same configuration.
+type paddingTransport struct {
+	transport
+	config *padding.Config
+}
+
+func (t *paddingTransport) Dial(addr string) (net.Conn, error) {
+	c, err := t.transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return padding.New(c, t.config), nil
+}
+
+func (t *paddingTransport) Listen(addr string) (net.Listener, error) {
+	l, err := t.transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return wrapListener{l, func(c net.Conn) net.Conn { return padding.New(c, t.config) }}, nil
+}
+
+// baseTransport returns the transport t wraps to add padding or faults, or t itself.
+func baseTransport(t transport) transport {
+	for {
+		switch w := t.(type) {
+		case *paddingTransport:
+			t = w.transport
+		case *chaosTransport:
+			t = w.transport
+		default:
+			return t
+		}
+	}
+}
+
+// wrapListener wraps the connections it accepts with wrap.
+type wrapListener struct {
+	net.Listener
+	wrap func(net.Conn) net.Conn
+}
+
+func (l wrapListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.wrap(c), nil
+}
+
+// chanListener accepts the connections handed over on conns, e.g. by the handlers of an
+// HTTP server on its listener.
+type chanListener struct {
+	net.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	err   error // ending the connections, set once done is closed
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// hostname returns host without port.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,69 @@
+// +build !router
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// trojanDialer connects to targets through a Trojan server: in TLS connections over the
+// transport, each starting with the hex-encoded SHA-224 of the password and the target.
+type trojanDialer struct {
+	server    string
+	hash      string
+	tlsConfig *tls.Config
+}
+
+// parseTrojanURL returns the server address of the Trojan URL s, trojan://password@host:port,
+// and a dialer for it. The sni query parameter overrides the server name sent in TLS.
+func parseTrojanURL(s string) (string, *trojanDialer, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", nil, err
+	}
+	password := u.User.Username()
+	if password == "" {
+		return "", nil, fmt.Errorf("trojan server %s lacks a password", u.Host)
+	}
+	addSecret(password)
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "443")
+	}
+	name := u.Query().Get("sni")
+	if name == "" {
+		name = u.Hostname()
+	}
+	h := sha256.Sum224([]byte(password))
+	return addr, &trojanDialer{
+		server:    addr,
+		hash:      hex.EncodeToString(h[:]),
+		tlsConfig: &tls.Config{ServerName: name},
+	}, nil
+}
+
+func (d *trojanDialer) Dial(tgt socks.Addr) (net.Conn, error) {
+	c, err := link.Dial(d.server)
+	if err != nil {
+		return nil, err
+	}
+	setLinkKeepAlive(c)
+	tc := tls.Client(fragment(c), d.tlsConfig)
+	req := make([]byte, 0, len(d.hash)+2+1+len(tgt)+2)
+	req = append(req, d.hash...)
+	req = append(req, "\r\n\x01"...) // CONNECT
+	req = append(req, tgt...)
+	req = append(req, "\r\n"...)
+	if _, err := tc.Write(req); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tc, nil
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/shadowsocks/go-shadowsocks2/internal/relay"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
@@ -17,8 +22,6 @@ const (
 	socksClient
 )
 
-const udpBufSize = 64 * 1024
-
 // Listen on laddr for UDP packets, encrypt and send to server to reach target.
 func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.PacketConn) {
 	srvAddr, err := net.ResolveUDPAddr("udp", server)
@@ -33,13 +36,14 @@ func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.Pack
 		logf("UDP target address error: %v", err)
 		return
 	}
+	tgt, _ = lookupHosts(tgt)
 
-	c, err := net.ListenPacket("udp", laddr)
+	c, err := listenPacket("udp", laddr)
 	if err != nil {
 		logf("UDP local listen error: %v", err)
 		return
 	}
-	defer c.Close()
+	// not closed on return: after an upgrade it still carries the responses of sessions
 
 	nm := newNATmap(config.UDPTimeout)
 	buf := make([]byte, udpBufSize)
@@ -49,20 +53,37 @@ func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.Pack
 	for {
 		n, raddr, err := c.ReadFrom(buf[len(tgt):])
 		if err != nil {
+			if handedOver(err) {
+				return
+			}
 			logf("UDP local read error: %v", err)
 			continue
 		}
 
+		if dnsFast != nil && isDNSQuery(buf[:len(tgt)+n]) {
+			if err := dnsFast.Query(buf[:len(tgt)+n], srvAddr, raddr, c, relayClient); err != nil {
+				logf("DNS fast path error: %v", err)
+			}
+			continue
+		}
+
 		pc := nm.Get(raddr.String())
 		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
+			pc, err = newUDPSession(shadow)
 			if err != nil {
 				logf("UDP local listen error: %v", err)
 				continue
 			}
 
-			pc = shadow(pc)
-			nm.Add(raddr, c, pc, relayClient)
+			id := newSessionID()
+			logf("[%s] UDP %s <-> %s <-> %s", id, raddr, server, target)
+			f := relay.NewFlow(id, "udp", raddr, target)
+			f.Remote = srvAddr
+			if pc, err = relay.PacketConn(pc, f); err != nil {
+				logf("[%s] UDP session refused: %v", id, err)
+				continue
+			}
+			nm.Add(raddr, c, pc, relayClient, target)
 		}
 
 		_, err = pc.WriteTo(buf[:len(tgt)+n], srvAddr)
@@ -81,12 +102,12 @@ func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketC
 		return
 	}
 
-	c, err := net.ListenPacket("udp", laddr)
+	c, err := listenPacket("udp", laddr)
 	if err != nil {
 		logf("UDP local listen error: %v", err)
 		return
 	}
-	defer c.Close()
+	// not closed on return: after an upgrade it still carries the responses of sessions
 
 	nm := newNATmap(config.UDPTimeout)
 	buf := make([]byte, udpBufSize)
@@ -94,23 +115,47 @@ func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketC
 	for {
 		n, raddr, err := c.ReadFrom(buf)
 		if err != nil {
+			if handedOver(err) {
+				return
+			}
 			logf("UDP local read error: %v", err)
 			continue
 		}
 
+		if dnsFast != nil && n > 3 && isDNSQuery(buf[3:n]) {
+			if err := dnsFast.Query(buf[3:n], srvAddr, raddr, c, socksClient); err != nil {
+				logf("DNS fast path error: %v", err)
+			}
+			continue
+		}
+
 		pc := nm.Get(raddr.String())
 		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
+			pc, err = newUDPSession(shadow)
 			if err != nil {
 				logf("UDP local listen error: %v", err)
 				continue
 			}
-			logf("UDP socks tunnel %s <-> %s <-> %s", laddr, server, socks.Addr(buf[3:]))
-			pc = shadow(pc)
-			nm.Add(raddr, c, pc, socksClient)
+			id := newSessionID()
+			tgt := socks.Addr(buf[3:])
+			logf("[%s] UDP socks tunnel %s <-> %s <-> %s", id, laddr, server, tgt)
+			f := relay.NewFlow(id, "udp", raddr, tgt.String())
+			f.Remote = srvAddr
+			if pc, err = relay.PacketConn(pc, f); err != nil {
+				logf("[%s] UDP session refused: %v", id, err)
+				continue
+			}
+			nm.Add(raddr, c, pc, socksClient, tgt.String())
 		}
 
-		_, err = pc.WriteTo(buf[3:n], srvAddr)
+		pkt := buf[3:n]
+		if tgt := socks.SplitAddr(pkt); tgt != nil {
+			if addr, ok := lookupHosts(tgt); ok {
+				pkt = append(addr, pkt[len(tgt):]...)
+			}
+		}
+
+		_, err = pc.WriteTo(pkt, srvAddr)
 		if err != nil {
 			logf("UDP local write error: %v", err)
 			continue
@@ -120,12 +165,12 @@ func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketC
 
 // Listen on addr for encrypted packets and basically do UDP NAT.
 func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
-	c, err := net.ListenPacket("udp", addr)
+	c, err := listenPacket("udp", addr)
 	if err != nil {
 		logf("UDP remote listen error: %v", err)
 		return
 	}
-	defer c.Close()
+	// not closed on return: after an upgrade it still carries the responses of sessions
 	c = shadow(c)
 
 	nm := newNATmap(config.UDPTimeout)
@@ -134,25 +179,50 @@ func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
 	logf("listening UDP on %s", addr)
 	for {
 		n, raddr, err := c.ReadFrom(buf)
+		ip, _ := ipPort(raddr)
 		if err != nil {
-			logf("UDP remote read error: %v", err)
+			if handedOver(err) {
+				return
+			}
+			head := buf[:n]
+			if len(head) > headSize {
+				head = head[:headSize]
+			}
+			class := classifyFailure(err, head)
+			logf("UDP remote read error from %v (%s): %v", raddr, class, err)
+			if ip != nil {
+				recordFailure(ip, class)
+				if bans != nil {
+					bans.Fail(ip, class == failReplay)
+				}
+			}
+			continue
+		}
+		if bans != nil && ip != nil && bans.Banned(ip) {
 			continue
 		}
 
 		tgtAddr := socks.SplitAddr(buf[:n])
 		if tgtAddr == nil {
 			logf("failed to split target address from packet: %q", buf[:n])
+			if ip != nil {
+				recordFailure(ip, failBadAddress)
+			}
 			continue
 		}
 
+		if blocked(tgtAddr) {
+			continue
+		}
+		payload := buf[len(tgtAddr):n]
+		tgtAddr, _ = lookupHosts(tgtAddr)
+
 		tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr.String())
 		if err != nil {
 			logf("failed to resolve target UDP address: %v", err)
 			continue
 		}
 
-		payload := buf[len(tgtAddr):n]
-
 		pc := nm.Get(raddr.String())
 		if pc == nil {
 			pc, err = net.ListenPacket("udp", "")
@@ -161,7 +231,15 @@ func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
 				continue
 			}
 
-			nm.Add(raddr, c, pc, remoteServer)
+			id := newSessionID()
+			logf("[%s] UDP %s <-> %s", id, raddr, tgtAddr)
+			f := relay.NewFlow(id, "udp", raddr, tgtAddr.String())
+			f.Remote = tgtUDPAddr
+			if pc, err = relay.PacketConn(pc, f); err != nil {
+				logf("[%s] UDP session refused: %v", id, err)
+				continue
+			}
+			nm.Add(raddr, c, pc, remoteServer, tgtAddr.String())
 		}
 
 		_, err = pc.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
@@ -175,13 +253,45 @@ func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
 // Packet NAT table
 type natmap struct {
 	sync.RWMutex
-	m       map[string]net.PacketConn
+	m       map[string]*natEntry
 	timeout time.Duration
+	evicted map[string]natEviction // recently removed sessions by peer, to notice them resume
+	swept   time.Time
+}
+
+type natEntry struct {
+	active  int64 // time of the last packet from the peer in Unix nanoseconds, accessed atomically
+	pc      net.PacketConn
+	evicted bool // removed to make room for another session
+}
+
+type natEviction struct {
+	at      time.Time
+	evicted bool // to make room rather than after the timeout
 }
 
+// natResumeWindow is how soon after its removal a session resuming counts as broken by it.
+const natResumeWindow = time.Minute
+
+// natStats counts removed UDP sessions, and those resumed within natResumeWindow, which
+// suggest that -udptimeout or -udp-max-sessions are too low for them.
+var natStats struct {
+	sync.Mutex
+	natCounts
+}
+
+type natCounts struct {
+	expired, expiredResumed int
+	evicted, evictedResumed int
+}
+
+var natReportOnce sync.Once
+
 func newNATmap(timeout time.Duration) *natmap {
+	natReportOnce.Do(func() { go reportNAT() })
 	m := &natmap{}
-	m.m = make(map[string]net.PacketConn)
+	m.m = make(map[string]*natEntry)
+	m.evicted = make(map[string]natEviction)
 	m.timeout = timeout
 	return m
 }
@@ -189,39 +299,136 @@ func newNATmap(timeout time.Duration) *natmap {
 func (m *natmap) Get(key string) net.PacketConn {
 	m.RLock()
 	defer m.RUnlock()
-	return m.m[key]
+	e := m.m[key]
+	if e == nil {
+		return nil
+	}
+	atomic.StoreInt64(&e.active, time.Now().UnixNano())
+	return e.pc
 }
 
-func (m *natmap) Set(key string, pc net.PacketConn) {
+// set adds e as the session of key, evicting the least recently active session if the
+// table holds -udp-max-sessions.
+func (m *natmap) set(key string, e *natEntry) {
 	m.Lock()
 	defer m.Unlock()
 
-	m.m[key] = pc
+	now := time.Now()
+	if ev, ok := m.evicted[key]; ok && now.Sub(ev.at) < natResumeWindow {
+		natStats.Lock()
+		if ev.evicted {
+			natStats.evictedResumed++
+		} else {
+			natStats.expiredResumed++
+		}
+		natStats.Unlock()
+	}
+	delete(m.evicted, key)
+	if now.Sub(m.swept) > natResumeWindow {
+		for k, ev := range m.evicted {
+			if now.Sub(ev.at) >= natResumeWindow {
+				delete(m.evicted, k)
+			}
+		}
+		m.swept = now
+	}
+
+	if max := config.UDPMaxSessions; max > 0 && len(m.m) >= max {
+		var oldest string
+		var oldestActive int64
+		for k, o := range m.m {
+			if a := atomic.LoadInt64(&o.active); oldest == "" || a < oldestActive {
+				oldest, oldestActive = k, a
+			}
+		}
+		o := m.m[oldest]
+		o.evicted = true
+		delete(m.m, oldest)
+		o.pc.Close()
+		m.evicted[oldest] = natEviction{at: now, evicted: true}
+		natStats.Lock()
+		natStats.evicted++
+		natStats.Unlock()
+	}
+	atomic.StoreInt64(&e.active, now.UnixNano())
+	m.m[key] = e
 }
 
-func (m *natmap) Del(key string) net.PacketConn {
+// del removes e as the session of key after it ended with err.
+func (m *natmap) del(key string, e *natEntry, err error) {
 	m.Lock()
 	defer m.Unlock()
 
-	pc, ok := m.m[key]
-	if ok {
+	if m.m[key] == e {
 		delete(m.m, key)
-		return pc
 	}
-	return nil
+	var ne net.Error
+	if !e.evicted && errors.As(err, &ne) && ne.Timeout() {
+		m.evicted[key] = natEviction{at: time.Now()}
+		natStats.Lock()
+		natStats.expired++
+		natStats.Unlock()
+	}
 }
 
-func (m *natmap) Add(peer net.Addr, dst, src net.PacketConn, role mode) {
-	m.Set(peer.String(), src)
+// Add relays packets from src back to peer through dst until no packets arrive for the
+// timeout of target, the address of the first packet of the session.
+func (m *natmap) Add(peer net.Addr, dst, src net.PacketConn, role mode, target string) {
+	e := &natEntry{pc: src}
+	m.set(peer.String(), e)
 
-	go func() {
-		timedCopy(dst, peer, src, m.timeout, role)
-		if pc := m.Del(peer.String()); pc != nil {
-			pc.Close()
+	timeout := m.timeout
+	if _, port, err := net.SplitHostPort(target); err == nil {
+		if t, ok := config.UDPPortTimeouts[port]; ok {
+			timeout = t
 		}
+	}
+	go func() {
+		err := timedCopy(dst, peer, src, timeout, role)
+		m.del(peer.String(), e, err)
+		src.Close()
 	}()
 }
 
+// parsePortTimeouts parses -udptimeout-ports, a comma-separated list of port=timeout.
+func parsePortTimeouts(s string) (map[string]time.Duration, error) {
+	m := make(map[string]time.Duration)
+	if s == "" {
+		return m, nil
+	}
+	for _, pt := range strings.Split(s, ",") {
+		p := strings.SplitN(pt, "=", 2)
+		if len(p) != 2 {
+			return nil, fmt.Errorf("invalid port timeout %q", pt)
+		}
+		if _, err := strconv.ParseUint(p[0], 10, 16); err != nil {
+			return nil, fmt.Errorf("invalid port in %q", pt)
+		}
+		d, err := time.ParseDuration(p[1])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid timeout in %q", pt)
+		}
+		m[p[0]] = d
+	}
+	return m, nil
+}
+
+// reportNAT logs how many UDP sessions were removed every natReportInterval.
+func reportNAT() {
+	const natReportInterval = 10 * time.Minute
+	for range time.Tick(natReportInterval) {
+		natStats.Lock()
+		s := natStats.natCounts
+		natStats.natCounts = natCounts{}
+		natStats.Unlock()
+		if s.expired == 0 && s.evicted == 0 {
+			continue
+		}
+		logf("UDP sessions in the last %v: %d expired (%d resumed within %v), %d evicted at -udp-max-sessions (%d resumed)",
+			natReportInterval, s.expired, s.expiredResumed, natResumeWindow, s.evicted, s.evictedResumed)
+	}
+}
+
 // copy from src to dst at target with read timeout
 func timedCopy(dst net.PacketConn, target net.Addr, src net.PacketConn, timeout time.Duration, role mode) error {
 	buf := make([]byte, udpBufSize)
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/relay"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// uotAddr is the target address by which clients open a UDP-over-TCP session with the
+// server, as in the original version of the protocol of sing-box. Each packet of the
+// session is then framed as its address, a 16-bit payload length and the payload.
+var uotAddr = socks.ParseAddr("sp.udp-over-tcp.arpa:0")
+
+var errUoTFrame = errors.New("invalid UDP-over-TCP frame")
+
+// uotClient carries the UDP sessions of a client in TCP connections to server.
+type uotClient struct {
+	server string
+	shadow func(net.Conn) net.Conn
+}
+
+// uot is set on clients with -udp-over-tcp and used by newUDPSession instead of UDP sockets.
+var uot *uotClient
+
+// isUoT reports whether tgt requests a UDP-over-TCP session.
+func isUoT(tgt socks.Addr) bool { return bytes.Equal(tgt, uotAddr) }
+
+// newUDPSession returns the packet connection the packets of a new UDP session are sent
+// to the server through: a new UDP socket, or a new UDP-over-TCP session with -udp-over-tcp.
+func newUDPSession(shadow func(net.PacketConn) net.PacketConn) (net.PacketConn, error) {
+	if uot != nil {
+		return uot.Dial()
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return shadow(pc), nil
+}
+
+// Dial opens a UDP-over-TCP session with the server.
+func (u *uotClient) Dial() (net.PacketConn, error) {
+	c, err := dialTarget(u.server, u.shadow, uotAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &uotConn{Conn: c, br: bufio.NewReader(c)}, nil
+}
+
+// uotConn is the client end of a UDP-over-TCP session. Like the packet connections of
+// ciphers, it reads and writes packets prefixed with their address, and ignores the
+// address passed to WriteTo.
+type uotConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *uotConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := readUoTFrame(c.br, b)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *uotConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	addr := socks.SplitAddr(b)
+	if addr == nil {
+		return 0, errUoTFrame
+	}
+	if err := writeUoTFrame(c.Conn, addr, b[len(addr):]); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// readUoTFrame reads a frame from r into b as the address followed by the payload.
+func readUoTFrame(r io.Reader, b []byte) (int, error) {
+	addr, err := socks.ReadAddr(r)
+	if err != nil {
+		return 0, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(l[:]))
+	if len(addr)+n > len(b) {
+		return 0, errUoTFrame
+	}
+	copy(b, addr)
+	if _, err := io.ReadFull(r, b[len(addr):len(addr)+n]); err != nil {
+		return 0, err
+	}
+	return len(addr) + n, nil
+}
+
+// writeUoTFrame writes payload to w as a frame from or to addr.
+func writeUoTFrame(w io.Writer, addr socks.Addr, payload []byte) error {
+	if len(payload) > 0xffff {
+		return errUoTFrame
+	}
+	frame := make([]byte, 0, len(addr)+2+len(payload))
+	frame = append(frame, addr...)
+	frame = append(frame, byte(len(payload)>>8), byte(len(payload)))
+	frame = append(frame, payload...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// serveUoT relays the packets of the UDP-over-TCP session on c from a client at from
+// until either side closes.
+func serveUoT(id string, c net.Conn, from net.Addr) {
+	br := bufio.NewReader(c)
+	buf := make([]byte, udpBufSize)
+	var pc net.PacketConn
+	for {
+		n, err := readUoTFrame(br, buf)
+		if err != nil {
+			if pc != nil {
+				pc.Close()
+			}
+			if err != io.EOF {
+				logf("[%s] UDP-over-TCP read error: %v", id, err)
+			}
+			return
+		}
+		tgt := socks.SplitAddr(buf[:n])
+		if blocked(tgt) {
+			continue
+		}
+		payload := buf[len(tgt):n]
+		tgt, _ = lookupHosts(tgt)
+		tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgt.String())
+		if err != nil {
+			logf("[%s] failed to resolve target UDP address: %v", id, err)
+			continue
+		}
+		if pc == nil {
+			if pc, err = net.ListenPacket("udp", ""); err != nil {
+				logf("[%s] UDP remote listen error: %v", id, err)
+				return
+			}
+			logf("[%s] UDP-over-TCP %s <-> %s", id, from, tgt)
+			f := relay.NewFlow(id, "udp", from, tgt.String())
+			f.Remote = tgtUDPAddr
+			if pc, err = relay.PacketConn(pc, f); err != nil {
+				logf("[%s] UDP session refused: %v", id, err)
+				return
+			}
+			go uotDownlink(id, c, pc)
+		}
+		if _, err := pc.WriteTo(payload, tgtUDPAddr); err != nil {
+			logf("[%s] UDP remote write error: %v", id, err)
+		}
+	}
+}
+
+// uotDownlink relays packets arriving at pc to the client over c until pc is closed.
+func uotDownlink(id string, c net.Conn, pc net.PacketConn) {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, raddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logf("[%s] UDP remote read error: %v", id, err)
+				c.Close()
+			}
+			return
+		}
+		if err := writeUoTFrame(c, socks.ParseAddr(raddr.String()), buf[:n]); err != nil {
+			pc.Close()
+			return
+		}
+	}
+}
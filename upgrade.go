@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/relay"
+)
+
+// takeoverTimeout is how long upgrade waits for the new process to listen on all sockets.
+const takeoverTimeout = time.Minute
+
+// upgrade starts the executable, possibly replaced by a new version, again with the same
+// arguments, handing it all listening sockets, and stops accepting on them once the new
+// process listens on them all. Connections already accepted stay with this process, see
+// drain, as do the UDP sockets, which still carry the responses of its UDP sessions.
+func upgrade() error {
+	if pluginCmd != nil {
+		return errors.New("not supported with -plugin")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	listeners.Lock()
+	defer listeners.Unlock()
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners.list {
+		f, err := l.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	// the new process reports on r once it listens on every socket, see tookOver
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, listenFDsEnv+"=") {
+			cmd.Env = append(cmd.Env, e)
+		}
+	}
+	cmd.Env = append(cmd.Env, listenFDsEnv+"="+strings.Join(listeners.keys, ","))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	w.Close() // for r to read EOF if the new process exits
+
+	// keep serving if the new process fails, e.g. on a bad flag or a socket it cannot use
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	took := make(chan bool, 1)
+	go func() {
+		n, _ := r.Read(make([]byte, 1))
+		took <- n > 0
+	}()
+	select {
+	case err := <-exited:
+		return fmt.Errorf("new process exited: %v", err)
+	case ok := <-took:
+		if !ok {
+			cmd.Process.Kill()
+			return errors.New("new process did not take over the listeners")
+		}
+	case <-time.After(takeoverTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process did not take over the listeners within %v", takeoverTimeout)
+	}
+
+	logf("upgraded to process %d, handing over %d listeners", cmd.Process.Pid, len(listeners.list))
+	for _, l := range listeners.list {
+		if pc, ok := l.(net.PacketConn); ok {
+			// stop reading, leaving new packets to the new process, but keep writing responses
+			pc.SetReadDeadline(time.Now())
+			continue
+		}
+		l.Close()
+	}
+	return nil
+}
+
+// handedOver reports whether err of a read loop means its socket was handed over on upgrade.
+func handedOver(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// drain waits until all flows are closed, timeout has passed or a signal arrives on stop.
+func drain(timeout time.Duration, stop <-chan os.Signal) {
+	deadline := time.After(timeout)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for relay.Active() > 0 {
+		select {
+		case <-deadline:
+			logf("closing %d flows after waiting %v", relay.Active(), timeout)
+			return
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+	}
+}
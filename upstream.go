@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// proxyDialer connects to servers through an upstream SOCKS5 or HTTP proxy, e.g. where
+// the local network only allows connections out through a corporate proxy.
+type proxyDialer struct {
+	scheme string // "socks5" or "http"
+	addr   string
+	user   *url.Userinfo
+}
+
+// upstreamProxy is set on clients with -upstream and used by dialServer.
+var upstreamProxy *proxyDialer
+
+// parseUpstream returns the dialer of the proxy at the URL s, socks5://[user:password@]host:port
+// or http://[user:password@]host:port.
+func parseUpstream(s string) (*proxyDialer, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported upstream proxy %q", s)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("upstream proxy %q lacks a port", s)
+	}
+	if p, ok := u.User.Password(); ok {
+		addSecret(p)
+	}
+	return &proxyDialer{scheme: u.Scheme, addr: u.Host, user: u.User}, nil
+}
+
+// dialServer connects to the server at addr over TCP, through -upstream if set, or with
+// TCP Fast Open if -tfo is set.
+func dialServer(addr string) (net.Conn, error) {
+	if upstreamProxy != nil {
+		return upstreamProxy.Dial(addr)
+	}
+	if config.TFO {
+		d := net.Dialer{Control: tfoControl(setDialTFO, &tfoFailed.dial)}
+		return d.Dial("tcp", addr)
+	}
+	return net.Dial("tcp", addr)
+}
+
+// Dial connects to addr through the proxy.
+func (d *proxyDialer) Dial(addr string) (net.Conn, error) {
+	c, err := net.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.scheme == "http" {
+		err = d.connect(c, addr)
+	} else {
+		err = d.socks5(c, addr)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("upstream proxy %s: %v", d.addr, err)
+	}
+	return c, nil
+}
+
+// socks5 requests a connection to addr with the SOCKS5 CONNECT command, authenticating with
+// username and password (RFC 1929) if given.
+func (d *proxyDialer) socks5(c net.Conn, addr string) error {
+	tgt := socks.ParseAddr(addr)
+	if tgt == nil {
+		return fmt.Errorf("invalid address %q", addr)
+	}
+	method := byte(0) // no authentication
+	if d.user != nil {
+		method = 2 // username and password
+	}
+	if _, err := c.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return err
+	}
+	if buf[0] != 5 || buf[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+	if method == 2 {
+		user, pass := d.user.Username(), ""
+		if p, ok := d.user.Password(); ok {
+			pass = p
+		}
+		auth := append([]byte{1, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		if _, err := c.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	}
+	if _, err := c.Write(append([]byte{5, socks.CmdConnect, 0}, tgt...)); err != nil {
+		return err
+	}
+	rep := make([]byte, 3)
+	if _, err := io.ReadFull(c, rep); err != nil {
+		return err
+	}
+	if rep[0] != 5 || rep[1] != 0 {
+		return fmt.Errorf("connect failed with reply %d", rep[1])
+	}
+	_, err := socks.ReadAddr(c)
+	return err
+}
@@ -0,0 +1,38 @@
+// +build !router
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// connect requests a tunnel to addr with the HTTP CONNECT method.
+func (d *proxyDialer) connect(c net.Conn, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.user != nil {
+		p, _ := d.user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(d.user.Username()+":"+p)))
+	}
+	if err := req.Write(c); err != nil {
+		return err
+	}
+	// the server sends nothing before the client, so nothing past the response is buffered
+	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+// +build js,wasm
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+// wsConn is a connection over a WebSocket of the browser, carrying the stream in binary
+// messages like the ws and wss transports of the server.
+type wsConn struct {
+	ws    js.Value
+	funcs []js.Func
+
+	mu       sync.Mutex
+	msgs     [][]byte // received, not yet read
+	closed   bool
+	err      error         // of closing, io.EOF on a clean close
+	ready    chan struct{} // signaled on new messages and on closing, with capacity 1
+	deadline time.Time
+}
+
+// dialWS opens a WebSocket to url, e.g. wss://example.com/tunnel.
+func dialWS(url string) (*wsConn, error) {
+	c := &wsConn{ready: make(chan struct{}, 1)}
+	opened := make(chan error, 1)
+	c.ws = js.Global().Get("WebSocket").New(url)
+	c.ws.Set("binaryType", "arraybuffer")
+	c.on("open", func(js.Value) { opened <- nil })
+	c.on("message", func(ev js.Value) {
+		data := js.Global().Get("Uint8Array").New(ev.Get("data"))
+		b := make([]byte, data.Length())
+		js.CopyBytesToGo(b, data)
+		c.mu.Lock()
+		c.msgs = append(c.msgs, b)
+		c.mu.Unlock()
+		c.signal()
+	})
+	c.on("close", func(ev js.Value) {
+		err := io.EOF
+		if !ev.Get("wasClean").Bool() {
+			err = fmt.Errorf("websocket closed with code %d", ev.Get("code").Int())
+		}
+		c.mu.Lock()
+		if !c.closed {
+			c.closed, c.err = true, err
+		}
+		c.mu.Unlock()
+		c.signal()
+		select {
+		case opened <- err:
+		default:
+		}
+	})
+	if err := <-opened; err != nil {
+		c.release()
+		return nil, err
+	}
+	return c, nil
+}
+
+// on sets the handler of the WebSocket event typ.
+func (c *wsConn) on(typ string, handler func(ev js.Value)) {
+	f := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		handler(args[0])
+		return nil
+	})
+	c.funcs = append(c.funcs, f)
+	c.ws.Set("on"+typ, f)
+}
+
+func (c *wsConn) signal() {
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.msgs) > 0 {
+			n := copy(b, c.msgs[0])
+			if c.msgs[0] = c.msgs[0][n:]; len(c.msgs[0]) == 0 {
+				c.msgs = c.msgs[1:]
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		closed, err, deadline := c.closed, c.err, c.deadline
+		c.mu.Unlock()
+		if closed {
+			return 0, err
+		}
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, errTimeout{}
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case <-c.ready:
+		case <-timeout:
+		}
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	closed, err := c.closed, c.err
+	c.mu.Unlock()
+	if closed {
+		if err == io.EOF {
+			err = net.ErrClosed
+		}
+		return 0, err
+	}
+	data := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(data, b)
+	c.ws.Call("send", data)
+	return len(b), nil
+}
+
+func (c *wsConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed, c.err = true, net.ErrClosed
+	c.mu.Unlock()
+	c.signal()
+	c.ws.Call("close")
+	c.release()
+	return nil
+}
+
+// release frees the event handlers.
+func (c *wsConn) release() {
+	for _, typ := range []string{"open", "message", "close"} {
+		c.ws.Set("on"+typ, js.Null())
+	}
+	for _, f := range c.funcs {
+		f.Release()
+	}
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return wsAddr(location()) }
+func (c *wsConn) RemoteAddr() net.Addr { return wsAddr(c.ws.Get("url").String()) }
+
+// SetDeadline sets the read deadline only, as writes never block.
+func (c *wsConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	c.signal()
+	return nil
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// location returns the URL of the page.
+func location() string {
+	if l := js.Global().Get("location"); l.Truthy() {
+		return l.Get("href").String()
+	}
+	return ""
+}
+
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
+
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return "i/o timeout" }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
@@ -0,0 +1,138 @@
+// +build js,wasm
+
+// Command wasm is a Shadowsocks client compiled to WebAssembly, for web applications that
+// open tunnels from the browser to servers with the ws or wss transport. Build it with
+//
+//	GOOS=js GOARCH=wasm go build -o shadowsocks.wasm ./wasm
+//
+// and run it with wasm_exec.js of the Go distribution. It sets the global shadowsocks.dial,
+// taking the options
+//
+//	{server: "wss://example.com/tunnel", cipher: "AEAD_CHACHA20_POLY1305", password: "...", target: "host:port"}
+//
+// with key in place of password for a base64 key, and returning a promise of a connection
+// to target through the server. Connections have the methods read, returning a promise of
+// a Uint8Array or of null at the end of the stream, write, taking a Uint8Array and returning
+// a promise, and close.
+//
+// Browsers open WebSockets only, so raw TCP and the other transports are not supported.
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"syscall/js"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// readSize is the maximum size of the chunks read returns.
+const readSize = 32 << 10
+
+func main() {
+	js.Global().Set("shadowsocks", map[string]interface{}{
+		"dial": promised(func(args []js.Value) (interface{}, error) {
+			if len(args) < 1 || args[0].Type() != js.TypeObject {
+				return nil, errors.New("dial needs an options object")
+			}
+			c, err := dial(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return jsConn(c), nil
+		}),
+	})
+	select {}
+}
+
+// dial connects to the target of opts through the server of opts.
+func dial(opts js.Value) (net.Conn, error) {
+	option := func(name string) string {
+		if v := opts.Get(name); v.Type() == js.TypeString {
+			return v.String()
+		}
+		return ""
+	}
+	tgt := socks.ParseAddr(option("target"))
+	if tgt == nil {
+		return nil, errors.New("invalid target address " + option("target"))
+	}
+	var key []byte
+	if s := option("key"); s != "" {
+		var err error
+		if key, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, err
+		}
+	}
+	ciph, err := core.PickCipher(option("cipher"), key, option("password"))
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := dialWS(option("server"))
+	if err != nil {
+		return nil, err
+	}
+	c := ciph.StreamConn(ws)
+	if _, err := c.Write(tgt); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// jsConn returns the JavaScript object of c.
+func jsConn(c net.Conn) map[string]interface{} {
+	return map[string]interface{}{
+		"read": promised(func([]js.Value) (interface{}, error) {
+			b := make([]byte, readSize)
+			n, err := c.Read(b)
+			if err == io.EOF {
+				return nil, nil
+			} else if err != nil {
+				return nil, err
+			}
+			data := js.Global().Get("Uint8Array").New(n)
+			js.CopyBytesToJS(data, b[:n])
+			return data, nil
+		}),
+		"write": promised(func(args []js.Value) (interface{}, error) {
+			if len(args) < 1 {
+				return nil, errors.New("write needs a Uint8Array")
+			}
+			b := make([]byte, args[0].Length())
+			js.CopyBytesToGo(b, args[0])
+			_, err := c.Write(b)
+			return nil, err
+		}),
+		"close": js.FuncOf(func(js.Value, []js.Value) interface{} {
+			c.Close()
+			return nil
+		}),
+	}
+}
+
+// promised returns a JavaScript function returning a promise of the result of f, run in a
+// goroutine as it may block. Functions of connections are not released, as connections are
+// assumed few.
+func promised(f func(args []js.Value) (interface{}, error)) js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		executor := js.FuncOf(func(this js.Value, p []js.Value) interface{} {
+			resolve, reject := p[0], p[1]
+			go func() {
+				v, err := f(args)
+				if err != nil {
+					reject.Invoke(js.Global().Get("Error").New(err.Error()))
+					return
+				}
+				resolve.Invoke(v)
+			}()
+			return nil
+		})
+		defer executor.Release()
+		return js.Global().Get("Promise").New(executor)
+	})
+}
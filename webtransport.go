@@ -0,0 +1,372 @@
+// +build !router
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/shadowsocks/go-shadowsocks2/internal/gun"
+	"github.com/shadowsocks/go-shadowsocks2/internal/obfs"
+	"github.com/shadowsocks/go-shadowsocks2/internal/shadowtls"
+	"github.com/shadowsocks/go-shadowsocks2/internal/websocket"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// parseWebTransport returns the transport of the URL u built on HTTP or TLS: ws, wss, grpc
+// or shadowtls.
+func parseWebTransport(u *url.URL) (transport, error) {
+	switch u.Scheme {
+	case "ws", "wss":
+		path := u.Path
+		if path == "" {
+			path = "/"
+		}
+		return &wsTransport{tls: u.Scheme == "wss", host: u.Host, path: path}, nil
+	case "grpc":
+		service := strings.Trim(u.Path, "/")
+		if service == "" {
+			return nil, fmt.Errorf("transport %q lacks a service name", u)
+		}
+		return &grpcTransport{host: u.Host, service: service}, nil
+	case "shadowtls":
+		password := u.User.Username()
+		if password == "" {
+			return nil, fmt.Errorf("transport %q lacks a password", u)
+		}
+		addSecret(password)
+		decoy := u.Host
+		if u.Port() == "" {
+			decoy = net.JoinHostPort(u.Hostname(), "443")
+		}
+		return &shadowtlsTransport{decoy: decoy, key: []byte(password)}, nil
+	}
+	return nil, fmt.Errorf("unsupported transport %q", u)
+}
+
+// setTransportTLS sets the TLS config of servers of t terminating TLS, wss and grpc, with
+// transportTLS.
+func setTransportTLS(t transport, certFile, keyFile, acmeCache string) error {
+	var err error
+	switch t := t.(type) {
+	case *wsTransport:
+		if t.tls {
+			t.tlsConfig, err = transportTLS(certFile, keyFile, acmeCache, t.host)
+		}
+	case *grpcTransport:
+		t.tlsConfig, err = transportTLS(certFile, keyFile, acmeCache, t.host)
+	}
+	return err
+}
+
+// transportTLS returns the TLS config of a server terminating TLS of the transport for host:
+// the certificate in certFile and keyFile, or, given acmeCache, one obtained from Let's
+// Encrypt and renewed automatically, cached in the directory acmeCache.
+func transportTLS(certFile, keyFile, acmeCache, host string) (*tls.Config, error) {
+	if acmeCache != "" {
+		if hostname(host) == "" {
+			return nil, errors.New("-acme-cache requires the host name in -transport")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(acmeCache),
+			HostPolicy: autocert.HostWhitelist(hostname(host)),
+		}
+		return m.TLSConfig(), nil
+	}
+	if certFile == "" {
+		return nil, errors.New("-transport wss and grpc require -transport-cert and -transport-key, or -acme-cache, on servers")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// wsTransport carries the stream in binary WebSocket messages, so that it can pass through
+// HTTP reverse proxies and CDNs. Clients send host in the Host header, or the server address
+// if empty. Servers answer upgrade requests for path, and for host if set, and 404 to the rest.
+// With wss, servers terminate TLS with tlsConfig, unless behind a TLS reverse proxy with ws.
+type wsTransport struct {
+	tls        bool
+	host       string
+	path       string
+	tlsConfig  *tls.Config       // of wss servers
+	clientCert []tls.Certificate // of wss clients, if any
+}
+
+func (t *wsTransport) Dial(addr string) (net.Conn, error) {
+	c, err := dialServer(addr)
+	if err != nil {
+		return nil, err
+	}
+	host := t.host
+	if host == "" {
+		host = addr
+	}
+	if t.tls {
+		tc := tls.Client(fragment(c), &tls.Config{ServerName: hostname(host), Certificates: t.clientCert})
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+	wc, err := websocket.Client(c, host, t.path)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return wc, nil
+}
+
+func (t *wsTransport) Listen(addr string) (net.Listener, error) {
+	var cfg *tls.Config
+	if t.tlsConfig != nil {
+		cfg = withProtos(t.tlsConfig, "http/1.1")
+	}
+	return listenWebSocket(addr, cfg, func(r *http.Request) bool {
+		return r.URL.Path == t.path && (t.host == "" || hostname(r.Host) == hostname(t.host))
+	})
+}
+
+// listenWebSocket listens on addr for WebSocket upgrade requests, over TLS with tlsConfig
+// if not nil, accepts the connections of those passing check, and responds with 404 Not
+// Found to anything else.
+func listenWebSocket(addr string, tlsConfig *tls.Config, check func(*http.Request) bool) (net.Listener, error) {
+	l, err := listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	wl := &chanListener{Listener: l, conns: make(chan net.Conn), done: make(chan struct{})}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !websocket.IsUpgrade(r) || !check(r) {
+				http.NotFound(w, r)
+				return
+			}
+			c, err := websocket.Upgrade(w, r)
+			if err != nil {
+				logf("WebSocket upgrade from %v failed: %v", r.RemoteAddr, err)
+				return
+			}
+			select {
+			case wl.conns <- c:
+			case <-wl.done:
+				c.Close()
+			}
+		}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	go func() {
+		if tlsConfig != nil {
+			wl.err = srv.Serve(tls.NewListener(l, tlsConfig))
+		} else {
+			wl.err = srv.Serve(l)
+		}
+		close(wl.done)
+	}()
+	return wl, nil
+}
+
+// grpcTransport carries the stream in calls of the gRPC method Tun of service, compatible
+// with the gun transport of V2Ray and Xray, so that it can pass through gRPC reverse proxies.
+// Calls of a client share HTTP/2 connections. As with ws, clients send host as authority and
+// servers answer calls for host, if set. HTTP/2 requires TLS: servers need tlsConfig.
+type grpcTransport struct {
+	host       string
+	service    string
+	tlsConfig  *tls.Config       // of servers
+	clientCert []tls.Certificate // of clients, if any
+
+	once   sync.Once
+	client *http.Client
+}
+
+func (t *grpcTransport) Dial(addr string) (net.Conn, error) {
+	t.once.Do(func() {
+		host := t.host
+		if host == "" {
+			host = addr
+		}
+		t.client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				c, err := dialServer(addr)
+				if err != nil {
+					return nil, err
+				}
+				return fragment(c), nil
+			},
+			TLSClientConfig:   &tls.Config{ServerName: hostname(host), NextProtos: []string{"h2"}, Certificates: t.clientCert},
+			ForceAttemptHTTP2: true,
+		}}
+	})
+	return gun.Dial(t.client, "https://"+addr+gun.Path(t.service), t.host)
+}
+
+func (t *grpcTransport) Listen(addr string) (net.Listener, error) {
+	l, err := listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	gl := &chanListener{Listener: l, conns: make(chan net.Conn), done: make(chan struct{})}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if t.host != "" && hostname(r.Host) != hostname(t.host) || !gun.IsCall(r, t.service) {
+				http.NotFound(w, r)
+				return
+			}
+			c, err := gun.Accept(w, r)
+			if err != nil {
+				logf("gRPC call from %v failed: %v", r.RemoteAddr, err)
+				return
+			}
+			select {
+			case gl.conns <- c:
+				gun.Serve(c, w, r)
+			case <-gl.done:
+				c.Close()
+			}
+		}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	cfg := withProtos(t.tlsConfig, "h2", "http/1.1")
+	go func() {
+		gl.err = srv.Serve(tls.NewListener(l, cfg))
+		close(gl.done)
+	}()
+	return gl, nil
+}
+
+// shadowtlsTransport carries the stream in TLS records after a real TLS handshake with the
+// decoy server, which servers relay, so that probers see the certificate of the decoy.
+// Servers relay connections of anyone not authenticating with key to the decoy.
+type shadowtlsTransport struct {
+	decoy string
+	key   []byte
+}
+
+func (t *shadowtlsTransport) Dial(addr string) (net.Conn, error) {
+	c, err := dialServer(addr)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := shadowtls.Client(fragment(c), &tls.Config{ServerName: hostname(t.decoy), NextProtos: []string{"h2", "http/1.1"}}, t.key)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+func (t *shadowtlsTransport) Listen(addr string) (net.Listener, error) {
+	l, err := listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sl := &chanListener{Listener: l, conns: make(chan net.Conn), done: make(chan struct{})}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					sl.err = err
+					close(sl.done)
+					return
+				}
+				logf("failed to accept: %v", err)
+				continue
+			}
+			go func() {
+				sc, err := shadowtls.Server(c, t.decoy, t.key)
+				if err != nil {
+					logf("ShadowTLS from %v: %v", c.RemoteAddr(), err)
+					c.Close()
+					return
+				}
+				select {
+				case sl.conns <- sc:
+				case <-sl.done:
+					sc.Close()
+				}
+			}()
+		}
+	}()
+	return sl, nil
+}
+
+// parseObfs returns t wrapped in the simple-obfs obfuscation described by s, e.g.
+// "http;host=example.com" or "tls". Clients send host, or the server address if empty.
+func parseObfs(t transport, s string) (transport, error) {
+	opts := strings.Split(s, ";")
+	o := &obfsTransport{transport: t, mode: opts[0]}
+	if o.mode != "http" && o.mode != "tls" {
+		return nil, fmt.Errorf("unsupported obfs %q", o.mode)
+	}
+	for _, opt := range opts[1:] {
+		switch {
+		case strings.HasPrefix(opt, "host="):
+			o.host = strings.TrimPrefix(opt, "host=")
+		default:
+			return nil, fmt.Errorf("unsupported obfs option %q", opt)
+		}
+	}
+	return o, nil
+}
+
+// obfsTransport disguises the connections of a transport as a WebSocket upgrade (mode http)
+// or a resumed TLS session (mode tls) in the way of simple-obfs, without a plugin process.
+type obfsTransport struct {
+	transport
+	mode string
+	host string
+}
+
+func (t *obfsTransport) Dial(addr string) (net.Conn, error) {
+	c, err := t.transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	host := t.host
+	if host == "" {
+		host = hostname(addr)
+	}
+	if t.mode == "http" {
+		return obfs.HTTPClient(c, host), nil
+	}
+	return obfs.TLSClient(c, host), nil
+}
+
+func (t *obfsTransport) Listen(addr string) (net.Listener, error) {
+	l, err := t.transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.mode == "http" {
+		return wrapListener{l, obfs.HTTPServer}, nil
+	}
+	return wrapListener{l, obfs.TLSServer}, nil
+}
+
+// withProtos returns a copy of config offering the application protocols protos, and
+// acme-tls/1 if config does, for certificates obtained with -acme-cache.
+func withProtos(config *tls.Config, protos ...string) *tls.Config {
+	cfg := config.Clone()
+	for _, p := range config.NextProtos {
+		if p == "acme-tls/1" {
+			protos = append(protos, p)
+		}
+	}
+	cfg.NextProtos = protos
+	return cfg
+}